@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Takes a snapshot every hour and prunes old ones, until ctx is cancelled
+func runBackupSchedule(ctx context.Context, db database.Store, dbCfg dbConfig, backupCfg backupConfig) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			backupPath, err := database.WriteBackup(db, dbCfg.backend, backupCfg.dir, now)
+			if err != nil {
+				log.Printf("Error taking scheduled backup: %s", err)
+				continue
+			}
+			log.Printf("Saved scheduled backup to %s", backupPath)
+
+			deleted, err := database.PruneBackups(backupCfg.dir, backupCfg.keepHourly, backupCfg.keepDaily)
+			if err != nil {
+				log.Printf("Error pruning backups: %s", err)
+			}
+			for _, backupPath := range deleted {
+				log.Printf("Deleted old backup %s", backupPath)
+			}
+		}
+	}
+}
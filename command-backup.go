@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Saves a snapshot of the database, along with its checksum, in a backup directory
+// The server can keep running while this happens
+func runBackup(args []string, dbCfg dbConfig) error {
+	backupCfg, err := loadBackupConfig()
+	if err != nil {
+		return err
+	}
+	if backupCfg.dir == "" {
+		backupCfg.dir = "backups"
+	}
+
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := flags.String("dir", backupCfg.dir, "Directory to save the snapshot in")
+	flags.Parse(args)
+
+	// Snapshot the database exactly as it is, without migrating it first
+	// Read only, since the server may have it open and be appending to its event log
+	dbCfg.opts.ManualMigrations = true
+	dbCfg.opts.ReadOnly = true
+	db, err := dbCfg.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	backupPath, err := database.WriteBackup(db, dbCfg.backend, *dir, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Saved backup to %s\n", backupPath)
+	return nil
+}
+
+// Replaces the live database with a snapshot, after checking its checksum
+// The server must be stopped first, or it will overwrite the restored file with what it has in memory
+func runRestore(args []string, dbCfg dbConfig) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	checksum := flags.String("checksum", "", "Expected SHA-256 of the snapshot. Defaults to the contents of <snapshot>.sha256")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("Usage: chirpy restore [--checksum <sha256>] <snapshot>")
+	}
+	snapshotPath := flags.Arg(0)
+
+	err := database.Restore(dbCfg.backend, dbCfg.path, snapshotPath, *checksum, dbCfg.opts.Keys)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s from %s. The previous database was kept as %s.bak\n", dbCfg.path, snapshotPath, dbCfg.path)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Runs a "chirpy db <subcommand>" command
+func runDBCommand(args []string, dbCfg dbConfig) error {
+	if len(args) == 0 {
+		return errors.New("Usage: chirpy db <rekey|genkey>")
+	}
+	switch args[0] {
+	case "rekey":
+		return runRekey(args[1:], dbCfg)
+	case "genkey":
+		key, err := database.GenerateKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	default:
+		return fmt.Errorf("Unknown db command %q. Available commands: rekey, genkey", args[0])
+	}
+}
+
+// Re-encrypts the JSON database, and its .bak copy, with a new key
+// Without --new-key-file it uses the primary key from DB_ENCRYPTION_KEY(_FILE), which is how a rotated key is
+// applied: put the new key first, keep the old one after it, and rekey. The server must be stopped first
+func runRekey(args []string, dbCfg dbConfig) error {
+	flags := flag.NewFlagSet("db rekey", flag.ExitOnError)
+	newKeyFile := flags.String("new-key-file", "", "File with the key to encrypt with. Defaults to the configured primary key")
+	flags.Parse(args)
+
+	if dbCfg.backend == database.BackendSQLite {
+		return database.ErrEncryptionUnsupported
+	}
+	newKeys := dbCfg.opts.Keys
+	if *newKeyFile != "" {
+		dat, err := os.ReadFile(*newKeyFile)
+		if err != nil {
+			return err
+		}
+		newKeys, err = database.ParseKeyring(string(dat))
+		if err != nil {
+			return err
+		}
+	}
+	if newKeys == nil {
+		return errors.New("No key to encrypt with. Set DB_ENCRYPTION_KEY or DB_ENCRYPTION_KEY_FILE, or pass --new-key-file")
+	}
+
+	// Rekey the database exactly as it is, without migrating it first
+	dbCfg.opts.ManualMigrations = true
+	db, err := database.NewDBConnection(dbCfg.path, dbCfg.opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = db.Rekey(newKeys)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Re-encrypted %s and %s.bak with key %s\n", dbCfg.path, dbCfg.path, newKeys.PrimaryKeyID())
+	if *newKeyFile != "" {
+		fmt.Println("Update DB_ENCRYPTION_KEY or DB_ENCRYPTION_KEY_FILE to use the new key before starting the server")
+	}
+	return nil
+}
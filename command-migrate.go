@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Applies pending database migrations, or with --dry-run reports what would be applied
+// Migrations also run automatically when the server starts, this is for checking them beforehand
+func runMigrate(args []string, dbCfg dbConfig) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Run pending migrations without saving, and report them")
+	flags.Parse(args)
+
+	// Open without migrating, so the current version can be reported first
+	// A dry run saves nothing, so it only needs to read the database and can run next to the server
+	dbCfg.opts.ManualMigrations = true
+	dbCfg.opts.ReadOnly = *dryRun
+	db, err := dbCfg.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := db.Migrate(*dryRun)
+	fmt.Printf("Database %s is at schema version %d\n", dbCfg.path, report.FromVersion)
+	if len(report.Applied) == 0 && err == nil {
+		fmt.Println("No pending migrations")
+		return nil
+	}
+
+	if report.DryRun {
+		fmt.Println("Pending migrations:")
+	} else {
+		fmt.Println("Applied migrations:")
+	}
+	for _, migration := range report.Applied {
+		fmt.Printf("  %d: %s\n", migration.Version, migration.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	if report.DryRun {
+		fmt.Printf("Dry run, nothing was saved. Migrating would bring the database to version %d\n", report.ToVersion)
+		return nil
+	}
+	fmt.Printf("Database is now at schema version %d\n", report.ToVersion)
+	return nil
+}
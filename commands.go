@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Runs one of the command line subcommands, e.g. "chirpy migrate --dry-run"
+func runCommand(name string, args []string, dbCfg dbConfig) error {
+	switch name {
+	case "migrate":
+		return runMigrate(args, dbCfg)
+	case "backup":
+		return runBackup(args, dbCfg)
+	case "restore":
+		return runRestore(args, dbCfg)
+	case "db":
+		return runDBCommand(args, dbCfg)
+	default:
+		return fmt.Errorf("Unknown command %q. Available commands: migrate, backup, restore, db", name)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Database settings, read from the environment
+type dbConfig struct {
+	backend string
+	path    string
+	opts    database.Options
+}
+
+// Reads the DB_* environment variables, and CHIRP_EDIT_WINDOW_MINUTES, into a dbConfig
+func loadDBConfig() (dbConfig, error) {
+	// Choose the storage backend with DB_BACKEND ("json" or "sqlite"), defaulting to the JSON file
+	// DB_PATH optionally overrides where the database file lives
+	cfg := dbConfig{
+		backend: os.Getenv("DB_BACKEND"),
+		path:    os.Getenv("DB_PATH"),
+	}
+	if cfg.path == "" {
+		cfg.path = "database.json"
+		if cfg.backend == database.BackendSQLite {
+			cfg.path = "database.db"
+		}
+	}
+
+	// DB_FLUSH picks when the JSON database is written to disk: "sync" (default), "batched", "shutdown" or "log"
+	// DB_FLUSH_INTERVAL_MS sets how often batched writes happen, DB_COMPACT_EVENTS how long the event log gets
+	flushPolicy, err := database.ParseFlushPolicy(os.Getenv("DB_FLUSH"))
+	if err != nil {
+		return dbConfig{}, err
+	}
+	// DB_OPAQUE_IDS=true gives new chirps and users an opaque uid that can be used in place of the numeric ID
+	cfg.opts = database.Options{
+		FlushPolicy: flushPolicy,
+		OpaqueIDs:   os.Getenv("DB_OPAQUE_IDS") == "true",
+	}
+	if interval := os.Getenv("DB_FLUSH_INTERVAL_MS"); interval != "" {
+		ms, err := strconv.Atoi(interval)
+		if err != nil {
+			return dbConfig{}, errors.New("Invalid DB_FLUSH_INTERVAL_MS")
+		}
+		cfg.opts.FlushInterval = time.Duration(ms) * time.Millisecond
+	}
+	// DB_TRASH_RETENTION_HOURS sets how long deleted chirps can be restored before they are purged
+	if hours := os.Getenv("DB_TRASH_RETENTION_HOURS"); hours != "" {
+		n, err := strconv.Atoi(hours)
+		if err != nil || n <= 0 {
+			return dbConfig{}, errors.New("Invalid DB_TRASH_RETENTION_HOURS")
+		}
+		cfg.opts.TrashRetention = time.Duration(n) * time.Hour
+	}
+	// MEDIA_RETENTION_HOURS sets how long uploads that nothing refers to are kept before they are deleted
+	if hours := os.Getenv("MEDIA_RETENTION_HOURS"); hours != "" {
+		n, err := strconv.Atoi(hours)
+		if err != nil || n <= 0 {
+			return dbConfig{}, errors.New("Invalid MEDIA_RETENTION_HOURS")
+		}
+		cfg.opts.MediaRetention = time.Duration(n) * time.Hour
+	}
+	// CHIRP_EDIT_WINDOW_MINUTES sets how long authors can edit a chirp after posting it. Chirpy Red members always can
+	if minutes := os.Getenv("CHIRP_EDIT_WINDOW_MINUTES"); minutes != "" {
+		n, err := strconv.Atoi(minutes)
+		if err != nil || n <= 0 {
+			return dbConfig{}, errors.New("Invalid CHIRP_EDIT_WINDOW_MINUTES")
+		}
+		cfg.opts.EditWindow = time.Duration(n) * time.Minute
+	}
+	if compactEvery := os.Getenv("DB_COMPACT_EVENTS"); compactEvery != "" {
+		n, err := strconv.Atoi(compactEvery)
+		if err != nil || n <= 0 {
+			return dbConfig{}, errors.New("Invalid DB_COMPACT_EVENTS")
+		}
+		cfg.opts.CompactEvery = n
+	}
+
+	keys, err := loadEncryptionKeys()
+	if err != nil {
+		return dbConfig{}, err
+	}
+	cfg.opts.Keys = keys
+	return cfg, nil
+}
+
+// Reads the keys for encrypting the JSON database from DB_ENCRYPTION_KEY, or from the file named by
+// DB_ENCRYPTION_KEY_FILE. Either holds base64 encoded keys separated by commas or newlines, the first one
+// encrypts and the rest are old keys that can still decrypt. Returns nil if neither is set
+func loadEncryptionKeys() (*database.Keyring, error) {
+	encoded := os.Getenv("DB_ENCRYPTION_KEY")
+	if keyFile := os.Getenv("DB_ENCRYPTION_KEY_FILE"); keyFile != "" {
+		if encoded != "" {
+			return nil, errors.New("Only one of DB_ENCRYPTION_KEY and DB_ENCRYPTION_KEY_FILE can be set")
+		}
+		dat, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(dat)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	return database.ParseKeyring(encoded)
+}
+
+// Opens the database described by the config
+func (cfg dbConfig) open() (database.Store, error) {
+	return database.NewStore(cfg.backend, cfg.path, cfg.opts)
+}
+
+// Settings for scheduled backups, read from the environment
+type backupConfig struct {
+	dir        string
+	keepHourly int
+	keepDaily  int
+}
+
+// Reads the BACKUP_* environment variables. Scheduled backups are off unless BACKUP_DIR is set
+func loadBackupConfig() (backupConfig, error) {
+	cfg := backupConfig{
+		dir:        os.Getenv("BACKUP_DIR"),
+		keepHourly: 24,
+		keepDaily:  7,
+	}
+	for name, keep := range map[string]*int{"BACKUP_KEEP_HOURLY": &cfg.keepHourly, "BACKUP_KEEP_DAILY": &cfg.keepDaily} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return backupConfig{}, errors.New("Invalid " + name)
+		}
+		*keep = n
+	}
+	return cfg, nil
+}
+
+// Settings for uploaded media, read from the environment
+type mediaConfig struct {
+	dir      string
+	maxBytes int64
+}
+
+// Reads MEDIA_DIR, where uploads are kept, and MEDIA_MAX_UPLOAD_KB, how large an upload can be
+func loadMediaConfig() (mediaConfig, error) {
+	cfg := mediaConfig{
+		dir:      os.Getenv("MEDIA_DIR"),
+		maxBytes: 5 << 20,
+	}
+	if cfg.dir == "" {
+		cfg.dir = "media"
+	}
+	if kb := os.Getenv("MEDIA_MAX_UPLOAD_KB"); kb != "" {
+		n, err := strconv.Atoi(kb)
+		if err != nil || n <= 0 {
+			return mediaConfig{}, errors.New("Invalid MEDIA_MAX_UPLOAD_KB")
+		}
+		cfg.maxBytes = int64(n) << 10
+	}
+	return cfg, nil
+}
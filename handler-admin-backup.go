@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Streams a consistent point-in-time snapshot of the database, without stopping the server
+// The snapshot's SHA-256 is sent in the X-Checksum-Sha256 header, pass it to `chirpy restore --checksum`
+func (cfg apiConfig) handlerAdminBackup(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// The snapshot includes password hashes, so this endpoint is off unless ADMIN_API_KEY is set
+	if cfg.adminKey == "" {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	apiKey, found := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	// Compared in constant time, so the response time gives nothing away about how much of the key matched
+	if subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.adminKey)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized")
+		return
+	}
+
+	snapshot, err := cfg.DB.Snapshot()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	filename := database.BackupFilename(cfg.dbBackend, time.Now())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(snapshot)))
+	w.Header().Set("X-Checksum-Sha256", database.Checksum(snapshot))
+	w.WriteHeader(http.StatusOK)
+	w.Write(snapshot)
+}
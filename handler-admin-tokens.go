@@ -0,0 +1,12 @@
+package main
+
+import "net/http"
+
+// Responds with statistics from the revoked token sweeper
+func (cfg apiConfig) handlerAdminTokenStats(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	cfg.sweepStats.mu.Lock()
+	defer cfg.sweepStats.mu.Unlock()
+	respondWithJSON(w, http.StatusOK, cfg.sweepStats)
+}
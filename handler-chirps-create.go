@@ -3,18 +3,65 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+
+	"github.com/rivo/uniseg"
+	"golang.org/x/text/unicode/norm"
 
 	auth "github.com/ellielle/chirpy/internal/auth"
+	database "github.com/ellielle/chirpy/internal/database"
 )
 
-func (cfg apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
+// What a chirp is posted with, in POST /api/chirps and when saving a draft
+type chirpParameters struct {
+	Body string `json:"body"`
+	// Optional ID of the chirp this one replies to
+	InReplyTo int `json:"in_reply_to"`
+	// Optional ID of the chirp this one rechirps, without a body, or quotes under its body
+	RechirpOf int `json:"rechirp_of"`
+	QuoteOf   int `json:"quote_of"`
+	// Optional IDs of up to four images from POST /api/media
+	MediaIDs []string `json:"media_ids"`
+	// Optional poll for the chirp to carry
+	Poll *struct {
+		Options        []string  `json:"options"`
+		MultipleChoice bool      `json:"multiple_choice"`
+		ClosesAt       time.Time `json:"closes_at"`
+	} `json:"poll"`
+	// Optional time to publish the chirp at. Until then it is a scheduled draft
+	PublishAt time.Time `json:"publish_at"`
+}
 
-	type parameters struct {
-		Body string `json:"body"`
+// Returns the links, media and poll to save the chirp with
+// Poll options are normalised and cleaned the same way as the body, their length is checked with the rest of the poll
+func (params chirpParameters) chirpParams() (database.ChirpParams, error) {
+	var poll *database.Poll
+	if params.Poll != nil {
+		poll = &database.Poll{MultipleChoice: params.Poll.MultipleChoice, ClosesAt: params.Poll.ClosesAt}
+		for _, option := range params.Poll.Options {
+			option, err := normalizeText(option)
+			if err != nil {
+				return database.ChirpParams{}, err
+			}
+			poll.Options = append(poll.Options, getCleanedBody(option))
+		}
 	}
+	return database.ChirpParams{
+		InReplyTo: params.InReplyTo,
+		RechirpOf: params.RechirpOf,
+		QuoteOf:   params.QuoteOf,
+		MediaIDs:  params.MediaIDs,
+		Poll:      poll,
+	}, nil
+}
+
+func (cfg apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
 
 	// Grab Authorization Bearer token from headers and then validate it
 	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
@@ -37,7 +84,7 @@ func (cfg apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request)
 
 	// Create a new JSON decoder and check the validity of the JSON from the Request body
 	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
+	params := chirpParameters{}
 	err = decoder.Decode(&params)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Malformed request body")
@@ -50,9 +97,36 @@ func (cfg apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	chirpParams, err := params.chirpParams()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// A chirp with a publish time is saved as a scheduled draft, and only becomes a chirp once it is published
+	if !params.PublishAt.IsZero() {
+		userIDInt, err := strconv.Atoi(userID)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		draft, err := cfg.DB.CreateDraft(userIDInt, cleanedChirp, chirpParams, params.PublishAt)
+		if respondWithChirpParamsError(w, err) {
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusAccepted, draft)
+		return
+	}
 
 	// Create a new chirp with the body and save it to database
-	chirp, err := cfg.DB.CreateChirp(cleanedChirp, userID)
+	chirp, err := cfg.DB.CreateChirp(cleanedChirp, userID, chirpParams)
+	if respondWithChirpParamsError(w, err) {
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -60,16 +134,59 @@ func (cfg apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request)
 	respondWithJSON(w, http.StatusCreated, chirp)
 }
 
-// Checks for profanity usage by looping over theProfane slice and checking the words against a lower cased params.Body
+// Responds with the status for an error a new chirp, or a draft, is rejected with for what it links to,
+// attaches or when it is scheduled. Any other error is left to the caller, and false is returned
+func respondWithChirpParamsError(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, database.ErrAlreadyRechirped) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return true
+	}
+	if database.IsInvalidChirpParams(err) || errors.Is(err, database.ErrPublishTime) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return true
+	}
+	return false
+}
+
+// Longest a chirp can be, in grapheme clusters: what a reader sees as one character. An emoji with a skin tone,
+// a flag, a letter with combining accents and a CJK character each count as one
+const maxChirpLength = 140
+
+// Most bytes a chirp can take, however few characters it is. 140 of the longest emoji sequences still fit,
+// it only stops text that stacks endless combining marks onto a few characters
+const maxChirpBytes = 8192
+
+// Checks that a chirp is short enough and has no control or bidirectional override characters
+// Returns it normalised with normalizeText, and with profanity cleaned out
 func validateChirp(bodyText string) (string, error) {
-	// Disallow any chirps longer than 140 characters
-	if len(bodyText) > 140 {
-		return "", errors.New("Chirp is too long")
+	bodyText, err := normalizeText(bodyText)
+	if err != nil {
+		return "", err
+	}
+	if length := uniseg.GraphemeClusterCount(bodyText); length > maxChirpLength {
+		return "", fmt.Errorf("Chirp is too long: %d characters, the limit is %d", length, maxChirpLength)
+	}
+	if len(bodyText) > maxChirpBytes {
+		return "", fmt.Errorf("Chirp is too long: %d bytes, the limit is %d", len(bodyText), maxChirpBytes)
 	}
 	cleanedBody := getCleanedBody(bodyText)
 	return cleanedBody, nil
 }
 
+// Returns text as chirps store it: in NFC, so the same characters are always stored as the same bytes, and with
+// Windows line endings turned into newlines
+// Control characters other than newlines and tabs are rejected, as are the embeddings, overrides and isolates
+// that change the direction of the text around them, which can make a chirp read differently than it is stored
+func normalizeText(text string) (string, error) {
+	text = norm.NFC.String(strings.ReplaceAll(text, "\r\n", "\n"))
+	for _, r := range text {
+		if (unicode.IsControl(r) && r != '\n' && r != '\t') || (r >= '\u202A' && r <= '\u202E') || (r >= '\u2066' && r <= '\u2069') {
+			return "", fmt.Errorf("Chirps can't contain control or bidirectional override characters, found U+%04X", r)
+		}
+	}
+	return text, nil
+}
+
 func getCleanedBody(bodyText string) string {
 	// Remove profanity because this is a Christian Minecraft server
 	// The profanity list is created as a map with an empty struct to be easily matched against
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
 
 	auth "github.com/ellielle/chirpy/internal/auth"
+	database "github.com/ellielle/chirpy/internal/database"
 )
 
 func (cfg apiConfig) handlerChirpsDelete(w http.ResponseWriter, r *http.Request) {
@@ -36,13 +38,21 @@ func (cfg apiConfig) handlerChirpsDelete(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	chirpIDInt, err := strconv.Atoi(chirpID)
+	chirpIDInt, err := cfg.DB.ResolveChirpID(chirpID)
+	if errors.Is(err, database.ErrInvalidID) {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		respondWithError(w, http.StatusNotFound, "Not Found")
 		return
 	}
 
 	err = cfg.DB.DeleteChirp(chirpIDInt, userIDInt)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusForbidden, "Unauthorized")
 		return
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	auth "github.com/ellielle/chirpy/internal/auth"
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Replaces the body of one of the logged in user's chirps. The old body is kept in the chirp's history
+func (cfg apiConfig) handlerChirpsEdit(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirpID, err := cfg.DB.ResolveChirpID(r.PathValue("chirpID"))
+	if errors.Is(err, database.ErrInvalidID) {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed request body")
+		return
+	}
+
+	// Edits have to meet the same requirements as new chirps
+	cleanedChirp, err := validateChirp(params.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirp, err := cfg.DB.EditChirp(chirpID, userIDInt, cleanedChirp)
+	if errors.Is(err, database.ErrUnauthorized) {
+		respondWithError(w, http.StatusForbidden, "Unauthorized")
+		return
+	}
+	if errors.Is(err, database.ErrRechirpNotEditable) || errors.Is(err, database.ErrEmptyQuote) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrEditWindowClosed) {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+// Lists the earlier bodies of a chirp, oldest first. Chirps that were never edited have an empty history
+func (cfg apiConfig) handlerChirpsHistory(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	chirpID, err := cfg.DB.ResolveChirpID(r.PathValue("chirpID"))
+	if errors.Is(err, database.ErrInvalidID) {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	revisions, err := cfg.DB.GetChirpHistory(chirpID)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, revisions)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Gets a page of the chirps with a hashtag. The tag is matched ignoring case, with or without its #
+func (cfg apiConfig) handlerTagsChirps(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	tag, err := database.NormalizeTag(r.PathValue("tag"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cfg.respondWithChirpPage(w, r, database.ChirpQuery{Tag: tag})
+}
+
+// Gets a page of the chirps that mention a user
+func (cfg apiConfig) handlerUsersMentions(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	cfg.respondWithChirpPage(w, r, database.ChirpQuery{MentionedUserID: userID})
+}
@@ -1,60 +1,172 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
-	"sort"
 	"strconv"
+	"strings"
+	"time"
+
+	auth "github.com/ellielle/chirpy/internal/auth"
+	database "github.com/ellielle/chirpy/internal/database"
 )
 
-// Gets all chirps in database and returns them in ascending order
+// Gets a page of chirps, in ascending order by default
+// When there are more chirps, the Link header points at the next page
 func (cfg apiConfig) handlerChirpsGetAll(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	cfg.respondWithChirpPage(w, r, database.ChirpQuery{})
+}
+
+// Responds with a page of the chirps matching query, narrowed down by the listing parameters in the request:
+// author_id, sort, since, until, limit and cursor. Shared by every endpoint that lists chirps by ID
+func (cfg apiConfig) respondWithChirpPage(w http.ResponseWriter, r *http.Request, query database.ChirpQuery) {
+	// Logging in is optional here. With a bearer token, each chirp says whether the user liked it,
+	// and shows the results of polls they voted in
+	var err error
+	query.ViewerID, err = cfg.optionalUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
 	// Check for optional author_id query parameter
-	authorID := r.URL.Query().Get("author_id")
+	// If an authorID was passed in, only chirps from that author will be returned
+	if authorID := r.URL.Query().Get("author_id"); authorID != "" {
+		id, err := strconv.Atoi(authorID)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid author_id")
+			return
+		}
+		query.AuthorID = id
+	}
 	// Check for optional sort query parameter
 	// sort can either be "asc" or "desc"
 	// ascending is the default if no parameter is provided
-	sortBy := r.URL.Query().Get("sort")
+	switch r.URL.Query().Get("sort") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		respondWithError(w, http.StatusBadRequest, "Invalid sort, expected asc or desc")
+		return
+	}
+	// Optional since and until parameters only keep chirps created at or after since, and before until
+	// Both are RFC 3339 timestamps, e.g. 2024-03-15T12:00:00Z
+	query.Since, err = parseTimeParam(r, "since")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query.Until, err = parseTimeParam(r, "until")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	// If an authorID was passed in, only chirps from that author will be returned
-	// If authorID is "", all chirps will be returned
-	chirps, err := cfg.DB.GetChirps(authorID)
+	// Page through with limit, and the opaque cursor from the previous page's Link header
+	limit, err := parseLimit(r)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil || cursor.Descending != query.Descending {
+			respondWithError(w, http.StatusBadRequest, ErrInvalidCursor.Error())
+			return
+		}
+		query.AfterID = cursor.AfterID
+	}
+	// Ask for one extra chirp to find out whether there is a next page
+	query.Limit = limit + 1
 
-	// Sort chirps by id in ascending order before sending response
-	if sortBy == "" || sortBy == "asc" {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].Id < chirps[j].Id
-		})
+	chirps, err := cfg.DB.GetChirps(query)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
-	if sortBy == "desc" {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].Id > chirps[j].Id
-		})
+	if len(chirps) > limit {
+		chirps = chirps[:limit]
+		setNextPageLink(w, r, pageCursor{AfterID: chirps[limit-1].Id, Descending: query.Descending})
 	}
 
 	respondWithJSON(w, http.StatusOK, chirps)
 }
 
+// Reads an optional RFC 3339 timestamp from the query string. A missing parameter is the zero time
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid %s, expected an RFC 3339 timestamp", name)
+	}
+	return t, nil
+}
+
 // Gets a single chirp by ID and returns it
 func (cfg apiConfig) handlerChirpsGet(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	chirp := r.PathValue("chirpID")
-	chirpID, err := strconv.Atoi(chirp)
-	if err != nil {
+	// The chirp ID can be either the numeric ID or the chirp's opaque uid
+	chirpID, err := cfg.DB.ResolveChirpID(r.PathValue("chirpID"))
+	if errors.Is(err, database.ErrInvalidID) {
 		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
 		return
 	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	// Logging in is optional, it shows the results of polls the user voted in, here or in a quoted chirp
+	viewerID, err := cfg.optionalUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
 
 	foundChirp, err := cfg.DB.GetChirp(chirpID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Not Found")
 		return
 	}
+	for _, chirp := range []*database.Chirp{&foundChirp, foundChirp.Original} {
+		if chirp == nil || chirp.Poll == nil || viewerID == 0 {
+			continue
+		}
+		poll, err := cfg.DB.GetPoll(chirp.Id, viewerID)
+		if errors.Is(err, database.ErrChirpNotFound) {
+			// A quoted chirp that has been deleted since
+			continue
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		chirp.Poll = &poll
+	}
 	respondWithJSON(w, http.StatusOK, foundChirp)
 }
+
+// Returns the ID of the user logged in with the request's bearer token, for endpoints where logging in is optional
+// Returns 0 when there is no token, and an error when there is one but it isn't valid
+func (cfg apiConfig) optionalUserID(r *http.Request) (int, error) {
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return 0, nil
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		return 0, err
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(userID)
+}
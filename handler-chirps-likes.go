@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	auth "github.com/ellielle/chirpy/internal/auth"
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Likes a chirp as the logged in user. Liking it again does nothing
+func (cfg apiConfig) handlerChirpsLike(w http.ResponseWriter, r *http.Request) {
+	cfg.changeLike(w, r, cfg.DB.LikeChirp)
+}
+
+// Takes back the logged in user's like of a chirp. Unliking it again does nothing
+func (cfg apiConfig) handlerChirpsUnlike(w http.ResponseWriter, r *http.Request) {
+	cfg.changeLike(w, r, cfg.DB.UnlikeChirp)
+}
+
+// Handles both like endpoints, which only differ in the change they make
+func (cfg apiConfig) changeLike(w http.ResponseWriter, r *http.Request, change func(chirpID, userID int) (database.Chirp, error)) {
+	defer r.Body.Close()
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirpID, err := cfg.DB.ResolveChirpID(r.PathValue("chirpID"))
+	if errors.Is(err, database.ErrInvalidID) {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	chirp, err := change(chirpID, userIDInt)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+// Lists the chirps a user has liked, most recently liked first
+func (cfg apiConfig) handlerUsersLikes(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	chirps, err := cfg.DB.GetLikedChirps(userID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, chirps)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	auth "github.com/ellielle/chirpy/internal/auth"
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Votes in a chirp's poll as the logged in user. Each user votes once, and can't change their vote
+// Responds with the poll and its results, which the user can see now that they have voted
+func (cfg apiConfig) handlerChirpsPollVote(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type parameters struct {
+		// Indexes of the options to vote for. Exactly one unless the poll is multiple choice
+		Options []int `json:"options"`
+	}
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirpID, err := cfg.DB.ResolveChirpID(r.PathValue("chirpID"))
+	if errors.Is(err, database.ErrInvalidID) {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed request body")
+		return
+	}
+
+	poll, err := cfg.DB.VotePoll(chirpID, userIDInt, params.Options)
+	if errors.Is(err, database.ErrChirpNotFound) || errors.Is(err, database.ErrNoPoll) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrInvalidVote) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrAlreadyVoted) || errors.Is(err, database.ErrPollClosed) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, poll)
+}
+
+// Gets a chirp's poll. Logging in is optional, the results are shown to users who voted, or to anyone once it closes
+func (cfg apiConfig) handlerChirpsPollGet(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	viewerID, err := cfg.optionalUserID(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	chirpID, err := cfg.DB.ResolveChirpID(r.PathValue("chirpID"))
+	if errors.Is(err, database.ErrInvalidID) {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	poll, err := cfg.DB.GetPoll(chirpID, viewerID)
+	if errors.Is(err, database.ErrChirpNotFound) || errors.Is(err, database.ErrNoPoll) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, poll)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"golang.org/x/text/unicode/norm"
+
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Searches chirp bodies for the words in the q query parameter, returning a page of matches best match first
+// Pages work like the main chirps listing, with limit, cursor and the Link header
+func (cfg apiConfig) handlerChirpsSearch(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Chirps are stored in NFC, so the query has to be too for accented words to match
+	query := database.SearchQuery{Text: norm.NFC.String(r.URL.Query().Get("q"))}
+	limit, err := parseLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, ErrInvalidCursor.Error())
+			return
+		}
+		query.AfterScore = cursor.AfterScore
+		query.AfterID = cursor.AfterID
+	}
+	// Ask for one extra result to find out whether there is a next page
+	query.Limit = limit + 1
+
+	results, err := cfg.DB.SearchChirps(query)
+	if errors.Is(err, database.ErrEmptySearch) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(results) > limit {
+		results = results[:limit]
+		last := results[limit-1]
+		setNextPageLink(w, r, pageCursor{AfterID: last.Id, AfterScore: last.Score})
+	}
+
+	respondWithJSON(w, http.StatusOK, results)
+}
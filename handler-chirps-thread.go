@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// How many levels of ancestors and replies a thread shows when no depth is given, and the most allowed
+const defaultThreadDepth = 10
+const maxThreadDepth = 50
+
+// Gets the conversation around a chirp: the chirps it replies to and the replies below it
+func (cfg apiConfig) handlerChirpsThread(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	chirpID, err := cfg.DB.ResolveChirpID(r.PathValue("chirpID"))
+	if errors.Is(err, database.ErrInvalidID) {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	// Optional depth query parameter limits how far up and down the thread goes
+	depth := defaultThreadDepth
+	if value := r.URL.Query().Get("depth"); value != "" {
+		depth, err = strconv.Atoi(value)
+		if err != nil || depth < 1 || depth > maxThreadDepth {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid depth, expected a number from 1 to %d", maxThreadDepth))
+			return
+		}
+	}
+
+	thread, err := cfg.DB.GetThread(chirpID, depth)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, thread)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	auth "github.com/ellielle/chirpy/internal/auth"
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Lists the logged in user's deleted chirps that can still be restored
+func (cfg apiConfig) handlerChirpsTrash(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	trash, err := cfg.DB.GetTrash(userIDInt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, trash)
+}
+
+// Takes one of the logged in user's chirps back out of the trash
+func (cfg apiConfig) handlerChirpsRestore(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirpID, err := cfg.DB.ResolveChirpID(r.PathValue("chirpID"))
+	if errors.Is(err, database.ErrInvalidID) {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	chirp, err := cfg.DB.RestoreChirp(chirpID, userIDInt)
+	if errors.Is(err, database.ErrUnauthorized) {
+		respondWithError(w, http.StatusForbidden, "Unauthorized")
+		return
+	}
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, chirp)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	auth "github.com/ellielle/chirpy/internal/auth"
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Lists the logged in user's drafts, scheduled ones included
+func (cfg apiConfig) handlerDraftsGet(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	drafts, err := cfg.DB.GetDrafts(userIDInt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, drafts)
+}
+
+// Saves a new draft for the logged in user. It is checked like a new chirp, and scheduled if it has a publish_at
+func (cfg apiConfig) handlerDraftsCreate(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := chirpParameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed request body")
+		return
+	}
+
+	// Drafts have to meet the same requirements as new chirps
+	cleanedChirp, err := validateChirp(params.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	chirpParams, err := params.chirpParams()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	draft, err := cfg.DB.CreateDraft(userIDInt, cleanedChirp, chirpParams, params.PublishAt)
+	if respondWithChirpParamsError(w, err) {
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, draft)
+}
+
+// Replaces one of the logged in user's drafts. Leaving out publish_at unschedules it
+func (cfg apiConfig) handlerDraftsUpdate(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	draftID, err := strconv.Atoi(r.PathValue("draftID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid draft ID")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := chirpParameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Malformed request body")
+		return
+	}
+
+	cleanedChirp, err := validateChirp(params.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	chirpParams, err := params.chirpParams()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	draft, err := cfg.DB.UpdateDraft(draftID, userIDInt, cleanedChirp, chirpParams, params.PublishAt)
+	if errors.Is(err, database.ErrDraftNotFound) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if respondWithChirpParamsError(w, err) {
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, draft)
+}
+
+// Deletes one of the logged in user's drafts, which also cancels it if it is scheduled
+func (cfg apiConfig) handlerDraftsDelete(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	draftID, err := strconv.Atoi(r.PathValue("draftID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid draft ID")
+		return
+	}
+
+	err = cfg.DB.DeleteDraft(draftID, userIDInt)
+	if errors.Is(err, database.ErrDraftNotFound) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusOK, "OK")
+}
+
+// Publishes one of the logged in user's drafts as a chirp right away, checking it again first
+func (cfg apiConfig) handlerDraftsPublish(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	draftID, err := strconv.Atoi(r.PathValue("draftID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid draft ID")
+		return
+	}
+
+	chirp, err := cfg.DB.PublishDraft(draftID, userIDInt)
+	if errors.Is(err, database.ErrDraftNotFound) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if respondWithChirpParamsError(w, err) {
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, chirp)
+}
@@ -66,8 +66,12 @@ func (cfg apiConfig) handlerUsersLogin(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, response{
 		User: User{
 			Id:          user.Id,
+			Uid:         user.Uid,
 			Email:       user.Email,
 			IsChirpyRed: user.IsChirpyRed,
+			Avatar:      user.Avatar,
+			CreatedAt:   user.CreatedAt,
+			UpdatedAt:   user.UpdatedAt,
 		},
 		Token:        token,
 		RefreshToken: refreshToken,
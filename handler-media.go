@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	auth "github.com/ellielle/chirpy/internal/auth"
+	blobs "github.com/ellielle/chirpy/internal/blobs"
+	database "github.com/ellielle/chirpy/internal/database"
+	imaging "github.com/ellielle/chirpy/internal/imaging"
+)
+
+var errUploadTooLarge = errors.New("Upload is too large")
+
+// Uploads an image that the logged in user can attach to their chirps, sent as the "file" field of a multipart form
+func (cfg apiConfig) handlerMediaUpload(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	media, ok := cfg.uploadImage(w, r, userIDInt, cfg.DB.CreateMedia)
+	if !ok {
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, media)
+}
+
+// Reads the image uploaded as the "file" field of a multipart form, and saves it and its renditions for userID
+// The media record is saved with create, once the files are in the blob store
+// Metadata like the GPS position a photo was taken at is stripped before anything is saved
+// Responds with the error and returns false if the upload can't be saved
+func (cfg apiConfig) uploadImage(w http.ResponseWriter, r *http.Request, userID int,
+	create func(media database.Media) (database.Media, error)) (database.Media, bool) {
+	data, err := readUpload(w, r, "file", cfg.maxUploadBytes)
+	if errors.Is(err, errUploadTooLarge) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload is too large, the limit is %d KB", cfg.maxUploadBytes>>10))
+		return database.Media{}, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return database.Media{}, false
+	}
+	processed, err := imaging.Process(data)
+	if errors.Is(err, imaging.ErrUnsupportedFormat) {
+		respondWithError(w, http.StatusUnsupportedMediaType, err.Error())
+		return database.Media{}, false
+	}
+	if errors.Is(err, imaging.ErrUnreadable) || errors.Is(err, imaging.ErrTooLarge) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return database.Media{}, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return database.Media{}, false
+	}
+
+	// Renditions are saved next to the original, under its key with their name added
+	base := newBlobKey()
+	original := processed.Original
+	media := database.Media{
+		OwnerID:     userID,
+		ContentType: original.ContentType,
+		Size:        int64(len(original.Data)),
+		Width:       original.Width,
+		Height:      original.Height,
+		BlobKey:     base + imaging.Extensions[original.ContentType],
+		Placeholder: processed.Placeholder,
+	}
+	media.URL = "/media/" + media.BlobKey
+	saved := []string{}
+	// Nothing refers to the blobs until the media is created, so they can all go if anything fails
+	deleteSaved := func() {
+		for _, key := range saved {
+			cfg.blobs.Delete(key)
+		}
+	}
+
+	err = cfg.blobs.Put(media.BlobKey, bytes.NewReader(original.Data))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return database.Media{}, false
+	}
+	saved = append(saved, media.BlobKey)
+	for _, rendition := range processed.Renditions {
+		key := base + "-" + rendition.Name + imaging.Extensions[rendition.ContentType]
+		err = cfg.blobs.Put(key, bytes.NewReader(rendition.Data))
+		if err != nil {
+			deleteSaved()
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return database.Media{}, false
+		}
+		saved = append(saved, key)
+		media.Renditions = append(media.Renditions, database.Rendition{
+			Name:        rendition.Name,
+			ContentType: rendition.ContentType,
+			Size:        int64(len(rendition.Data)),
+			Width:       rendition.Width,
+			Height:      rendition.Height,
+			BlobKey:     key,
+			URL:         "/media/" + key,
+		})
+	}
+
+	media, err = create(media)
+	if err != nil {
+		deleteSaved()
+		if errors.Is(err, database.ErrUserNotFound) {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return database.Media{}, false
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return database.Media{}, false
+	}
+	return media, true
+}
+
+// Serves an uploaded file. Blobs never change once they are saved, so they can be cached for good
+func (cfg apiConfig) handlerMediaGet(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	key := r.PathValue("key")
+	blob, err := cfg.blobs.Open(key)
+	if errors.Is(err, blobs.ErrNotFound) || errors.Is(err, blobs.ErrInvalidKey) {
+		respondWithError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+key+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// ServeContent picks the content type from the extension, and answers conditional and range requests
+	http.ServeContent(w, r, path.Base(key), time.Time{}, blob)
+}
+
+// Reads the named file field of a multipart form into memory
+// Returns errUploadTooLarge if the file is larger than maxBytes, without reading the rest of it
+func readUpload(w http.ResponseWriter, r *http.Request, field string, maxBytes int64) ([]byte, error) {
+	// Leave some room for the rest of the form around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64<<10)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, errors.New("Expected a multipart/form-data body")
+	}
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("Missing %s field", field)
+		}
+		if err != nil {
+			return nil, uploadError(err)
+		}
+		if part.FormName() != field {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(part, maxBytes+1))
+		if err != nil {
+			return nil, uploadError(err)
+		}
+		if int64(len(data)) > maxBytes {
+			return nil, errUploadTooLarge
+		}
+		return data, nil
+	}
+}
+
+// Turns an error reading a multipart form into errUploadTooLarge if the body went over its limit
+func uploadError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errUploadTooLarge
+	}
+	return errors.New("Malformed multipart body")
+}
+
+// Returns a new random blob key, without an extension
+func newBlobKey() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	auth "github.com/ellielle/chirpy/internal/auth"
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Uploads an image as the "file" field of a multipart form and makes it the logged in user's avatar
+// It goes through the same processing as any other upload, so the response lists its thumbnail and other renditions
+func (cfg apiConfig) handlerUsersAvatar(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	// Grab Authorization Bearer token from headers and then validate it
+	headerToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header missing")
+		return
+	}
+	token, err := auth.ValidateJWT(headerToken, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID, err := auth.GetUserIDWithToken(*token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userIDInt, err := strconv.Atoi(userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The media record and the avatar are saved together, so a failure leaves neither behind, nor the files
+	user := database.User{}
+	_, ok := cfg.uploadImage(w, r, userIDInt, func(media database.Media) (database.Media, error) {
+		user, err = cfg.DB.CreateAvatar(media)
+		if err != nil {
+			return database.Media{}, err
+		}
+		return *user.Avatar, nil
+	})
+	if !ok {
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, User{
+		Id:          user.Id,
+		Uid:         user.Uid,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+		Avatar:      user.Avatar,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+	})
+}
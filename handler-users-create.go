@@ -5,13 +5,21 @@ import (
 	"errors"
 	"net/http"
 	"strings"
+	"time"
+
+	database "github.com/ellielle/chirpy/internal/database"
 )
 
 type User struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"-"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id          int       `json:"id"`
+	Uid         string    `json:"uid,omitempty"`
+	Email       string    `json:"email"`
+	Password    string    `json:"-"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Left out until the user uploads an avatar
+	Avatar *database.Media `json:"avatar,omitempty"`
 }
 
 var ErrInvalidPassword = errors.New("password missing or invalid")
@@ -51,7 +59,7 @@ func (cfg apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	respondWithJSON(w, http.StatusCreated, User{Id: user.Id, Email: user.Email})
+	respondWithJSON(w, http.StatusCreated, User{Id: user.Id, Uid: user.Uid, Email: user.Email, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt})
 }
 
 // Validate User's email. For now, it's a basic check
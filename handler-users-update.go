@@ -75,5 +75,12 @@ func (cfg apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, User{Id: updatedUser.Id, Email: updatedUser.Email})
+	respondWithJSON(w, http.StatusOK, User{
+		Id:        updatedUser.Id,
+		Uid:       updatedUser.Uid,
+		Email:     updatedUser.Email,
+		Avatar:    updatedUser.Avatar,
+		CreatedAt: updatedUser.CreatedAt,
+		UpdatedAt: updatedUser.UpdatedAt,
+	})
 }
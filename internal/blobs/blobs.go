@@ -0,0 +1,33 @@
+package blobs
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrNotFound = errors.New("Blob not found")
+var ErrInvalidKey = errors.New("Invalid blob key")
+
+// Store keeps uploaded files, like chirp media, outside the database. Blobs are never changed once they are
+// saved, so they can be cached forever. LocalStore keeps them on the local filesystem
+type Store interface {
+	// Saves data under key. Keys are made of letters, digits, dots, dashes and underscores
+	Put(key string, data io.Reader) error
+	// Opens the blob saved under key. The caller has to close it
+	Open(key string) (io.ReadSeekCloser, error)
+	// Removes the blob saved under key, if there is one
+	Delete(key string) error
+}
+
+// Returns ErrInvalidKey unless key can safely be used as a blob key
+func checkKey(key string) error {
+	if key == "" || key[0] == '.' || len(key) > 128 {
+		return ErrInvalidKey
+	}
+	for _, c := range []byte(key) {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '.' && c != '-' && c != '_' {
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package blobs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Keeps blobs as files in a directory on the local filesystem
+type LocalStore struct {
+	dir string
+}
+
+// Returns a LocalStore that keeps its blobs in dir, creating the directory if it doesn't exist
+func NewLocalStore(dir string) (*LocalStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+// Saves data under key. It is written to a temporary file first, so a blob is never seen half written
+func (store *LocalStore) Put(key string, data io.Reader) error {
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(store.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(store.dir, key))
+}
+
+// Opens the blob saved under key
+func (store *LocalStore) Open(key string) (io.ReadSeekCloser, error) {
+	err := checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filepath.Join(store.dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Removes the blob saved under key. Removing a blob that doesn't exist is not an error
+func (store *LocalStore) Delete(key string) error {
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(store.dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,236 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrChecksumMismatch = errors.New("Backup checksum does not match")
+var ErrNoChecksum = errors.New("No checksum to verify the backup against")
+
+// Snapshot files are named chirpy-<UTC timestamp>.<ext>, which keeps them sorted by age
+const backupPrefix = "chirpy-"
+const backupTimeFormat = "20060102-150405"
+
+// Returns a consistent point-in-time copy of the whole database in its on-disk format
+// Taken under the read lock, so it never contains half of a transaction
+// An encrypted database gives an encrypted snapshot, so backups are never stored in plaintext
+func (db *DB) Snapshot() ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.encode(db.data)
+}
+
+// Returns a consistent point-in-time copy of the whole database as a SQLite database file
+// VACUUM INTO writes a transactionally consistent copy without blocking other readers
+func (db *SQLiteDB) Snapshot() ([]byte, error) {
+	dir, err := os.MkdirTemp("", "chirpy-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	snapshotPath := filepath.Join(dir, "snapshot.db")
+	_, err = db.conn.Exec("VACUUM INTO ?", snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(snapshotPath)
+}
+
+// Returns the hex encoded SHA-256 checksum of a snapshot
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the file name for a snapshot of the given backend taken at now
+func BackupFilename(backend string, now time.Time) string {
+	extension := ".json"
+	if backend == BackendSQLite {
+		extension = ".db"
+	}
+	return backupPrefix + now.UTC().Format(backupTimeFormat) + extension
+}
+
+// Takes a snapshot of store and saves it in dir, next to a <name>.sha256 file holding its checksum
+// Returns the path of the snapshot
+func WriteBackup(store Store, backend, dir string, now time.Time) (string, error) {
+	data, err := store.Snapshot()
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	name := BackupFilename(backend, now)
+	backupPath := filepath.Join(dir, name)
+	err = writeFileAtomic(backupPath, data, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	// Same format as sha256sum, so backups can also be checked with `sha256sum -c`
+	checksumLine := Checksum(data) + "  " + name + "\n"
+	err = writeFileAtomic(backupPath+".sha256", []byte(checksumLine), 0600)
+	if err != nil {
+		return "", err
+	}
+	return backupPath, nil
+}
+
+// Deletes scheduled snapshots in dir that fall outside the retention policy, and returns the deleted paths
+// A snapshot is kept if it is the newest one of its hour within the keepHourly most recent hours that
+// have a snapshot, or the newest one of its day within the keepDaily most recent days
+func PruneBackups(dir string, keepHourly, keepDaily int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type backup struct {
+		name string
+		at   time.Time
+	}
+	backups := []backup{}
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(strings.TrimSuffix(name, filepath.Ext(name)), backupPrefix)
+		if !ok || strings.HasSuffix(name, ".sha256") || entry.IsDir() {
+			continue
+		}
+		at, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{name: name, at: at})
+	}
+	// Newest first, so the first snapshot seen in each hour or day is the one that is kept
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].at.After(backups[j].at)
+	})
+
+	keep := map[string]bool{}
+	hours := map[string]bool{}
+	days := map[string]bool{}
+	for _, b := range backups {
+		hour := b.at.Format("2006010215")
+		if !hours[hour] && len(hours) < keepHourly {
+			hours[hour] = true
+			keep[b.name] = true
+		}
+		day := b.at.Format("20060102")
+		if !days[day] && len(days) < keepDaily {
+			days[day] = true
+			keep[b.name] = true
+		}
+	}
+
+	deleted := []string{}
+	for _, b := range backups {
+		if keep[b.name] {
+			continue
+		}
+		backupPath := filepath.Join(dir, b.name)
+		err = os.Remove(backupPath)
+		if err != nil {
+			return deleted, err
+		}
+		os.Remove(backupPath + ".sha256")
+		deleted = append(deleted, backupPath)
+	}
+	return deleted, nil
+}
+
+// Replaces the database at path with the snapshot at snapshotPath. The server must not be running,
+// a database it has open is refused with ErrDatabaseLocked
+// The snapshot's SHA-256 checksum must match checksum, or the one in snapshotPath.sha256 if checksum is empty,
+// and the snapshot must be a readable database of the given backend before the live file is touched
+// The database being replaced is kept as path.bak, and its event log as path.log.bak. keys is needed to check an encrypted JSON snapshot
+func Restore(backend, path, snapshotPath, checksum string, keys *Keyring) error {
+	data, err := os.ReadFile(snapshotPath)
+	if err != nil {
+		return err
+	}
+
+	if checksum == "" {
+		checksumLine, err := os.ReadFile(snapshotPath + ".sha256")
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrNoChecksum
+		}
+		if err != nil {
+			return err
+		}
+		checksum, _, _ = strings.Cut(strings.TrimSpace(string(checksumLine)), " ")
+	}
+	if !strings.EqualFold(Checksum(data), checksum) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, checksum, Checksum(data))
+	}
+
+	err = verifySnapshot(backend, snapshotPath, data, keys)
+	if err != nil {
+		return err
+	}
+	// A server would carry on writing to the file it has open, and those writes would be lost
+	lock, err := lockFile(path + lockSuffix)
+	if err != nil {
+		return err
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	err = writeFileAtomic(path, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	// The event log holds changes to the database that was replaced, they must not be replayed onto the snapshot
+	err = os.Rename(path+eventLogSuffix, path+eventLogSuffix+".bak")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Makes sure a snapshot can actually be opened by this version of chirpy
+func verifySnapshot(backend, snapshotPath string, data []byte, keys *Keyring) error {
+	if backend != BackendSQLite {
+		dbStructure, _, err := decodeDBFile(data, keys, snapshotPath)
+		if err != nil {
+			return err
+		}
+		return checkSchemaVersion(dbStructure.SchemaVersion, latestJSONSchemaVersion())
+	}
+
+	conn, err := sql.Open("sqlite", "file:"+snapshotPath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	result := ""
+	err = conn.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrCorruptDatabase, snapshotPath, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%w: %s: %s", ErrCorruptDatabase, snapshotPath, result)
+	}
+	version := 0
+	err = conn.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	return checkSchemaVersion(version, latestSQLiteSchemaVersion())
+}
@@ -3,107 +3,239 @@ package database
 import (
 	"errors"
 	"strconv"
+	"time"
 )
 
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	Id        int       `json:"id"`
+	Uid       string    `json:"uid,omitempty"`
+	Body      string    `json:"body"`
+	AuthorId  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// The hashtags, mentions and URLs in the body, found when it was posted or last edited
+	Entities []Entity `json:"entities,omitempty"`
+	// Images attached to the chirp, in the order they were given
+	Media []Media `json:"media,omitempty"`
+	Poll  *Poll   `json:"poll,omitempty"`
+	// ID of the chirp this one replies to, if it is a reply
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	// ID of the chirp this one rechirps or quotes, if it is a reshare
+	RechirpOf int `json:"rechirp_of,omitempty"`
+	QuoteOf   int `json:"quote_of,omitempty"`
+	// The chirp a rechirp or quote reshares. Filled in when chirps are read, never stored
+	Original *Chirp `json:"original,omitempty"`
+	// Number of direct replies that aren't deleted
+	ReplyCount int `json:"reply_count"`
+	LikeCount  int `json:"like_count"`
+	// Whether the user viewing the chirp has liked it. Only set on chirps listed for a logged in user,
+	// never stored
+	LikedByMe *bool `json:"liked_by_me,omitempty"`
+	// Whether the body has been edited since the chirp was posted. The earlier bodies are its revisions
+	Edited bool `json:"edited"`
+	// Set when the chirp is deleted. Deleted chirps stay in the author's trash until they are purged
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Set on a deleted chirp that is only kept so its replies still have a parent. Its body is gone
+	Tombstone bool `json:"tombstone,omitempty"`
 }
 
 var ErrChirpNotFound = errors.New("Chirp not found")
 var ErrUnauthorized = errors.New("Unauthorized")
 
-// Creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body, id string) (Chirp, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
+// Returns the current time as it is stored in created_at and updated_at
+func timestamp() time.Time {
+	return time.Now().UTC()
+}
+
+// Creates a new chirp and saves it to disk. Any chirps params links to have to exist and not be deleted
+func (db *DB) CreateChirp(body, id string, params ChirpParams) (Chirp, error) {
 	userID, err := strconv.Atoi(id)
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	// Create a new Chirp with the next incremental ID
-	nextID := len(dbStructure.Chirps) + 1
-	chirp := Chirp{
-		Id:       nextID,
-		Body:     body,
-		AuthorId: userID,
-	}
-	dbStructure.Chirps[nextID] = chirp
-	err = db.writeDB(dbStructure)
+	chirp := Chirp{}
+	err = db.Update(func(dbStructure *DBStructure) error {
+		created, err := db.newChirp(dbStructure, body, userID, params)
+		if err != nil {
+			return err
+		}
+		// The event keeps its own copy, the embedded original must not end up in the event log
+		err = dbStructure.apply(Event{Type: EventChirpCreated, Chirp: &created})
+		if err != nil {
+			return err
+		}
+		chirp = dbStructure.expand(created, 0)
+		return nil
+	})
 	if err != nil {
-		return Chirp{}, nil
+		return Chirp{}, err
 	}
 
 	return chirp, nil
 }
 
-// Returns all chirps in the database in ascending order based on ID
-func (db *DB) GetChirps(searchByAuthorID string) ([]Chirp, error) {
-	dbStructure, err := db.loadDB()
+// Checks a chirp userID would post at now against the rest of the database
+// Returns the params it would be posted with, which reshare the original rather than a rechirp of it,
+// and the media they attach
+func (dbStructure *DBStructure) checkChirp(body string, userID int, params ChirpParams, now time.Time) (ChirpParams, []Media, error) {
+	err := params.check(body, now)
 	if err != nil {
-		return nil, err
+		return ChirpParams{}, nil, err
 	}
-
-	// Create a []Chirp slice and append all current chirps to it
-	chirpSlice := make([]Chirp, 0, len(dbStructure.Chirps))
-	for _, chirp := range dbStructure.Chirps {
-		if searchByAuthorID == "" {
-			chirpSlice = append(chirpSlice, chirp)
-			continue
-		}
-
-		authorID, err := strconv.Atoi(searchByAuthorID)
+	if parent, ok := dbStructure.Chirps[params.InReplyTo]; params.InReplyTo != 0 && (!ok || parent.deleted()) {
+		return ChirpParams{}, nil, ErrParentNotFound
+	}
+	if params.RechirpOf != 0 {
+		params.RechirpOf, err = dbStructure.resolveOriginal(params.RechirpOf)
 		if err != nil {
-			return nil, err
+			return ChirpParams{}, nil, err
 		}
-
-		// Only get chirps from author with optional ID passed in
-		if chirp.AuthorId == authorID {
-			chirpSlice = append(chirpSlice, chirp)
+		for _, chirpID := range dbStructure.chirpIDsByAuthor[userID] {
+			if existing := dbStructure.Chirps[chirpID]; existing.RechirpOf == params.RechirpOf && !existing.deleted() {
+				return ChirpParams{}, nil, ErrAlreadyRechirped
+			}
 		}
 	}
-	return chirpSlice, nil
+	if params.QuoteOf != 0 {
+		params.QuoteOf, err = dbStructure.resolveOriginal(params.QuoteOf)
+		if err != nil {
+			return ChirpParams{}, nil, err
+		}
+	}
+	media, err := dbStructure.attachableMedia(params.MediaIDs, userID)
+	if err != nil {
+		return ChirpParams{}, nil, err
+	}
+	return params, media, nil
 }
 
-// Get a specific Chirp from the database
-func (db *DB) GetChirp(chirpID int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+// Returns a new chirp by userID, posted now, with the next ID from the chirp sequence
+// It is checked with checkChirp first, and only takes an ID once it passes. The caller applies the event that saves it
+func (db *DB) newChirp(dbStructure *DBStructure, body string, userID int, params ChirpParams) (Chirp, error) {
+	createdAt := timestamp()
+	params, media, err := dbStructure.checkChirp(body, userID, params, createdAt)
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	chirp, ok := dbStructure.Chirps[chirpID]
-	if !ok {
-		return Chirp{}, ErrChirpNotFound
+	chirp := Chirp{
+		Id:        dbStructure.nextChirpID(),
+		Body:      body,
+		AuthorId:  userID,
+		Entities:  dbStructure.findEntities(body),
+		Media:     media,
+		InReplyTo: params.InReplyTo,
+		RechirpOf: params.RechirpOf,
+		QuoteOf:   params.QuoteOf,
+		CreatedAt: createdAt,
+		UpdatedAt: createdAt,
+	}
+	if params.Poll != nil {
+		chirp.Poll = params.Poll.stored()
+	}
+	if db.opts.OpaqueIDs {
+		chirp.Uid = newOpaqueID()
 	}
 	return chirp, nil
 }
 
-func (db *DB) DeleteChirp(chirpID, authorID int) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
+// Fills in what a chirp shows when it is read but isn't stored with it: the original it reshares,
+// and its poll as viewerID sees it, or as someone who isn't logged in does if viewerID is 0
+func (dbStructure *DBStructure) expand(chirp Chirp, viewerID int) Chirp {
+	now := timestamp()
+	chirp = dbStructure.withOriginal(chirp)
+	chirp.Poll = dbStructure.pollView(chirp, viewerID, now)
+	if chirp.Original != nil {
+		chirp.Original.Poll = dbStructure.pollView(*chirp.Original, viewerID, now)
 	}
+	return chirp
+}
 
-	chirp, ok := dbStructure.Chirps[chirpID]
-	if !ok {
-		return ErrChirpNotFound
-	}
+// Reports whether the chirp has been deleted and is only in its author's trash
+func (chirp Chirp) deleted() bool {
+	return chirp.DeletedAt != nil
+}
 
-	// User must be the owner of the chirp to delete it
-	if chirp.AuthorId != authorID {
-		return ErrUnauthorized
+// Returns the chirps matching query, in ID order, leaving out deleted ones
+// Only the chirps on the requested page are looked at, walking the ID index from the cursor
+func (db *DB) GetChirps(query ChirpQuery) ([]Chirp, error) {
+	chirpSlice := []Chirp{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		// Start from the narrowest index the query allows, the other filters are checked on each chirp
+		chirpIDs := dbStructure.chirpIDs
+		switch {
+		case query.Tag != "":
+			chirpIDs = dbStructure.chirpIDsByTag[query.Tag]
+		case query.MentionedUserID != 0:
+			chirpIDs = dbStructure.chirpIDsByMention[query.MentionedUserID]
+		case query.AuthorID != 0:
+			chirpIDs = dbStructure.chirpIDsByAuthor[query.AuthorID]
+		}
+		chirpSlice = query.page(chirpIDs, func(chirpID int) (Chirp, bool) {
+			chirp := dbStructure.expand(dbStructure.Chirps[chirpID], query.ViewerID)
+			if query.ViewerID != 0 {
+				_, liked := dbStructure.Likes[chirpID][query.ViewerID]
+				chirp.LikedByMe = &liked
+			}
+			return chirp, !chirp.deleted()
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return chirpSlice, nil
+}
 
-	delete(dbStructure.Chirps, chirpID)
-	err = db.writeDB(dbStructure)
+// Get a specific Chirp from the database. Deleted chirps are not found
+func (db *DB) GetChirp(chirpID int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		found, ok := dbStructure.Chirps[chirpID]
+		if !ok || found.deleted() {
+			return ErrChirpNotFound
+		}
+		chirp = dbStructure.expand(found, 0)
+		return nil
+	})
 	if err != nil {
-		return err
+		return Chirp{}, err
 	}
+	return chirp, nil
+}
 
-	return nil
+// Moves a chirp to its author's trash. It can be restored until it is purged
+func (db *DB) DeleteChirp(chirpID, authorID int) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		chirp, ok := dbStructure.Chirps[chirpID]
+		if !ok || chirp.deleted() {
+			return ErrChirpNotFound
+		}
+
+		// User must be the owner of the chirp to delete it
+		if chirp.AuthorId != authorID {
+			return ErrUnauthorized
+		}
+
+		return dbStructure.apply(Event{Type: EventChirpDeleted, ChirpID: chirpID})
+	})
+}
+
+// Turns a chirp ID from a URL into a numeric chirp ID. ref can be the numeric ID or the chirp's opaque uid
+// Deleted chirps still resolve, so they can be restored
+func (db *DB) ResolveChirpID(ref string) (int, error) {
+	chirpID, ok, err := parseNumericID(ref)
+	if ok || err != nil {
+		return chirpID, err
+	}
+
+	err = db.View(func(dbStructure *DBStructure) error {
+		chirpID, ok = dbStructure.chirpIDsByUid[ref]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		return nil
+	})
+	return chirpID, err
 }
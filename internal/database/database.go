@@ -3,6 +3,9 @@ package database
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"maps"
 	"os"
 	"sync"
 	"time"
@@ -11,73 +14,472 @@ import (
 type DB struct {
 	path string
 	mu   *sync.RWMutex
+	opts Options
+
+	// The whole database is kept in memory, reads never touch the disk
+	data DBStructure
+	// Number of changes not yet written to disk, only used when writes are deferred
+	unflushed int
+
+	// The event log, only used with FlushLog. It is opened on the first append
+	eventLog       *os.File
+	eventLogSize   int64
+	eventLogEvents int
+	compactNow     chan struct{}
+
+	flushMu   sync.Mutex
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	// Exclusive lock on <path>.lock, held by the one process that may write the database. nil when read only
+	lock *os.File
 }
 
 type DBStructure struct {
-	Chirps        map[int]Chirp        `json:"chirps"`
-	Users         map[int]User         `json:"users"`
-	RevokedTokens map[string]time.Time `json:"revoked_tokens"`
+	SchemaVersion int           `json:"schema_version"`
+	Chirps        map[int]Chirp `json:"chirps"`
+	Users         map[int]User  `json:"users"`
+	// Revoked refresh tokens, keyed by tokenKey
+	RevokedTokens map[string]RevokedToken `json:"revoked_token_hashes"`
+	Sequences     Sequences               `json:"sequences"`
+	// Earlier bodies of edited chirps, keyed by chirp ID, oldest first
+	ChirpRevisions map[int][]ChirpRevision `json:"chirp_revisions"`
+	// Chirp ID to the IDs of the users who liked it, with when they did
+	Likes map[int]map[int]time.Time `json:"likes"`
+	// Uploaded media, keyed by media ID
+	Media map[string]Media `json:"media"`
+	// Chirp ID to the votes in its poll, keyed by the ID of the user who voted
+	PollVotes map[int]map[int]PollVote `json:"poll_votes"`
+	// Unpublished chirps, scheduled or not, keyed by draft ID
+	Drafts map[int]Draft `json:"drafts"`
+	// Revoked tokens as stored before schema version 2, raw JWT to revocation time
+	// Only read by the migration that moves them into RevokedTokens
+	LegacyRevokedTokens map[string]time.Time `json:"revoked_tokens,omitempty"`
+	// Seq of the last event log entry included in this file
+	LogSequence int64 `json:"log_sequence,omitempty"`
+
+	indexes
+	// Events applied in the current transaction, waiting to be appended to the event log on commit
+	pendingEvents []Event
+	// How to undo the current transaction's changes, nil outside of a transaction
+	undo *undoLog
 }
 
+var ErrCorruptDatabase = errors.New("Database file is corrupt")
+var ErrDatabaseLocked = errors.New("Database is in use by another process, stop the server first")
+var ErrReadOnly = errors.New("Database was opened read only")
+
+// Suffix of the file writers lock, next to the database file
+const lockSuffix = ".lock"
+
 // Creates a new 'connection' to the JSON database file and returns a pointer for access
-func NewDBConnection(path string) (*DB, error) {
+// The file is read once, after that the database is served from memory and written back according to opts.FlushPolicy
+func NewDBConnection(path string, opts Options) (*DB, error) {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.CompactEvery <= 0 {
+		opts.CompactEvery = DefaultCompactEvery
+	}
+	if opts.TrashRetention <= 0 {
+		opts.TrashRetention = DefaultTrashRetention
+	}
+	if opts.MediaRetention <= 0 {
+		opts.MediaRetention = DefaultMediaRetention
+	}
+	if opts.EditWindow <= 0 {
+		opts.EditWindow = DefaultEditWindow
+	}
 	db := &DB{
-		path: path,
-		mu:   &sync.RWMutex{},
+		path:       path,
+		mu:         &sync.RWMutex{},
+		opts:       opts,
+		done:       make(chan struct{}),
+		compactNow: make(chan struct{}, 1),
+	}
+	if !opts.ReadOnly {
+		lock, err := lockFile(path + lockSuffix)
+		if err != nil {
+			return db, err
+		}
+		db.lock = lock
 	}
 	err := db.ensureDB()
-	return db, err
+	if err != nil {
+		db.unlock()
+		return db, err
+	}
+	if opts.ReadOnly {
+		return db, nil
+	}
+
+	switch opts.FlushPolicy {
+	case FlushBatched:
+		db.wg.Add(1)
+		go db.flushLoop()
+	case FlushLog:
+		db.wg.Add(1)
+		go db.compactLoop()
+	}
+	return db, nil
 }
 
 func (db *DB) DebugWipeTestDatabase() {
-	db.createDB()
+	db.Update(func(dbStructure *DBStructure) error {
+		return dbStructure.apply(Event{Type: EventDatabaseWiped})
+	})
+}
+
+// Writes any pending changes to disk and stops the background flusher
+// With FlushLog the event log is compacted, so the next start doesn't have to replay it
+// The DB must not be used after Close
+func (db *DB) Close() error {
+	err := error(nil)
+	db.closeOnce.Do(func() {
+		close(db.done)
+		db.wg.Wait()
+		err = db.flush()
+		if err == nil {
+			err = db.compact()
+		}
+		if db.eventLog != nil {
+			db.eventLog.Close()
+		}
+		db.unlock()
+	})
+	return err
+}
+
+// Lets another process open the database for writing
+func (db *DB) unlock() {
+	if db.lock != nil {
+		db.lock.Close()
+		db.lock = nil
+	}
 }
 
-// Returns an error if the database does not exist yet
+// Creates the database if it does not exist yet, and returns an error if the existing file is corrupt
+// A corrupt file is never overwritten, so it can be inspected or restored from the .bak copy
+// A read only database is never created, migrated or written, it is only read along with its event log
 func (db *DB) ensureDB() error {
-	_, err := os.ReadFile(db.path)
-	if errors.Is(err, os.ErrNotExist) {
+	_, err := os.Stat(db.path)
+	if errors.Is(err, os.ErrNotExist) && !db.opts.ReadOnly {
 		return db.createDB()
 	}
-	return err
+	if err != nil {
+		return err
+	}
+
+	dbStructure, keyID, err := db.loadWithEventLog()
+	if err != nil {
+		return err
+	}
+	// Fold the log into the file, so anything appended later starts on a clean line of an empty log
+	// Only the process holding the lock may do this, anyone else could be cutting off a running server's log
+	if info, err := os.Stat(db.eventLogPath()); err == nil && info.Size() > 0 && !db.opts.ReadOnly {
+		db.flushMu.Lock()
+		db.mu.Lock()
+		err = db.writeSnapshot(dbStructure)
+		db.mu.Unlock()
+		db.flushMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	// Refuse to open a database written by a newer version, rather than silently dropping what it added
+	err = checkSchemaVersion(dbStructure.SchemaVersion, latestJSONSchemaVersion())
+	if err != nil {
+		return err
+	}
+	db.data = dbStructure
+	// The file is re-encrypted with the primary key on the next write, rekey does it right away
+	if db.opts.Keys != nil && keyID != db.opts.Keys.PrimaryKeyID() {
+		log.Printf("%s is not encrypted with the primary key yet, run `chirpy db rekey` to re-encrypt it now", db.path)
+	}
+	if db.opts.ManualMigrations || db.opts.ReadOnly {
+		return nil
+	}
+
+	report, err := db.Migrate(false)
+	if err != nil {
+		return err
+	}
+	for _, migration := range report.Applied {
+		log.Printf("Applied database migration %d: %s", migration.Version, migration.Name)
+	}
+	return nil
+}
+
+// How many times a read only open starts over when the server compacts the event log while it is being read
+const readOnlyLoadAttempts = 5
+
+// Reads the database file and replays the event log onto it
+// When the database is opened read only, the server can compact the log into a new file between the two reads,
+// which would leave out the events that were in the log, so then both are read again
+func (db *DB) loadWithEventLog() (DBStructure, string, error) {
+	for attempt := 1; ; attempt++ {
+		before, err := os.Stat(db.path)
+		if err != nil {
+			return DBStructure{}, "", err
+		}
+		dbStructure, keyID, err := db.loadDB()
+		if errors.Is(err, ErrCorruptDatabase) {
+			return DBStructure{}, "", fmt.Errorf("%w (the previous version is kept in %s.bak)", err, db.path)
+		}
+		if err != nil {
+			return DBStructure{}, "", err
+		}
+
+		// Bring the file up to date with the event log, whatever the flush policy is now,
+		// so the log never has to be replayed against a migrated schema
+		replayed, err := db.replayEventLog(&dbStructure)
+		if err != nil {
+			return DBStructure{}, "", err
+		}
+		// Compaction writes a new file and renames it over the old one
+		if db.opts.ReadOnly {
+			after, err := os.Stat(db.path)
+			if err != nil {
+				return DBStructure{}, "", err
+			}
+			if !os.SameFile(before, after) {
+				if attempt < readOnlyLoadAttempts {
+					continue
+				}
+				return DBStructure{}, "", fmt.Errorf("%s kept changing while it was read, try again", db.path)
+			}
+		}
+		if replayed > 0 {
+			log.Printf("Replayed %d events from %s", replayed, db.eventLogPath())
+		}
+		return dbStructure, keyID, nil
+	}
 }
 
 // Creates a new JSON database
 func (db *DB) createDB() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// A log left next to a deleted database file belongs to that database, so it is emptied too
+	dbStructure := newDBStructure()
+	err := db.writeSnapshot(dbStructure)
+	if err != nil {
+		return err
+	}
+	db.data = dbStructure
+	return nil
+}
+
+// Returns an empty DBStructure with all of its collections ready to be written to
+func newDBStructure() DBStructure {
 	dbStructure := DBStructure{
-		Chirps:        map[int]Chirp{},
-		Users:         map[int]User{},
-		RevokedTokens: map[string]time.Time{},
+		SchemaVersion:  latestJSONSchemaVersion(),
+		Chirps:         map[int]Chirp{},
+		Users:          map[int]User{},
+		RevokedTokens:  map[string]RevokedToken{},
+		ChirpRevisions: map[int][]ChirpRevision{},
+		Likes:          map[int]map[int]time.Time{},
+		Media:          map[string]Media{},
+		PollVotes:      map[int]map[int]PollVote{},
+		Drafts:         map[int]Draft{},
 	}
-	return db.writeDB(dbStructure)
+	dbStructure.buildIndexes()
+	return dbStructure
 }
 
-// Reads the database file into memory as a DBStructure struct
-func (db *DB) loadDB() (DBStructure, error) {
+// Returns a copy of the DBStructure that can be modified without affecting the original
+// Only migrations need one, since they change the collections directly. Everything else changes the data
+// in place inside Update, which undoes the changes if the transaction fails
+func (dbStructure DBStructure) clone() DBStructure {
+	cloned := DBStructure{
+		SchemaVersion:  dbStructure.SchemaVersion,
+		Chirps:         maps.Clone(dbStructure.Chirps),
+		Users:          maps.Clone(dbStructure.Users),
+		RevokedTokens:  maps.Clone(dbStructure.RevokedTokens),
+		Sequences:      dbStructure.Sequences,
+		ChirpRevisions: maps.Clone(dbStructure.ChirpRevisions),
+		Likes:          maps.Clone(dbStructure.Likes),
+		Media:          maps.Clone(dbStructure.Media),
+		PollVotes:      maps.Clone(dbStructure.PollVotes),
+		Drafts:         maps.Clone(dbStructure.Drafts),
+		LogSequence:    dbStructure.LogSequence,
+
+		LegacyRevokedTokens: maps.Clone(dbStructure.LegacyRevokedTokens),
+	}
+	cloned.buildIndexes()
+	return cloned
+}
+
+// Runs fn against a read-only view of the database. The read lock is held for the whole call,
+// so fn sees one consistent version of the data
+// fn must not modify dbStructure, it is the live in-memory copy
+func (db *DB) View(fn func(dbStructure *DBStructure) error) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	dbStructure := DBStructure{}
-	dat, err := os.ReadFile(db.path)
+	return fn(&db.data)
+}
+
+// Runs fn as a read-modify-write transaction. The write lock is held from reading the database
+// until the changes are committed, so concurrent transactions can't lose each other's writes
+// fn changes the data in place. If it returns an error, or the commit fails, its changes are undone and nothing changes
+// The same goes if it panics, the panic is passed on once the changes are undone
+func (db *DB) Update(fn func(dbStructure *DBStructure) error) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.data.begin()
+	// Runs before the unlock, so the next transaction never sees the half made changes
+	defer func() {
+		if p := recover(); p != nil {
+			db.data.rollback()
+			panic(p)
+		}
+	}()
+	err := fn(&db.data)
+	if err == nil {
+		err = db.commit()
+	}
 	if err != nil {
-		return dbStructure, err
+		db.data.rollback()
+		return err
 	}
+	db.data.commitUndo()
+	return nil
+}
 
-	// Unmarshal the json data into DBStructure
-	json.Unmarshal(dat, &dbStructure)
-	return dbStructure, nil
+// Saves the current transaction's changes. With FlushSync the database is written to disk first,
+// with FlushLog its events are appended to the event log first, otherwise it is only marked as unflushed
+// and written by the next flush
+// Callers must hold db.mu for writing
+func (db *DB) commit() error {
+	switch db.opts.FlushPolicy {
+	case FlushSync:
+		return db.writeDB(db.data)
+	case FlushLog:
+		return db.appendEvents(&db.data)
+	default:
+		db.unflushed++
+		return nil
+	}
 }
 
-// Writes the database file to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
+// Writes the in-memory database to disk if it has unflushed changes
+func (db *DB) flush() error {
+	// Only one flush writes the file at a time, so an older snapshot can never overwrite a newer one
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+
+	// Marshal under the write lock so the unflushed count matches the snapshot,
+	// but write the file after releasing it so requests aren't blocked on disk
 	db.mu.Lock()
-	defer db.mu.Unlock()
+	if db.unflushed == 0 {
+		db.mu.Unlock()
+		return nil
+	}
+	jsonData, err := json.Marshal(db.data)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	flushed := db.unflushed
+	db.unflushed = 0
+	db.mu.Unlock()
 
-	jsonData, err := json.Marshal(dbStructure)
+	fileData, err := encodeDBFile(jsonData, db.opts.Keys)
+	if err == nil {
+		err = writeFileAtomic(db.path, fileData, 0600)
+	}
+	if err != nil {
+		// Keep the changes marked as unflushed so the next flush tries again
+		db.mu.Lock()
+		db.unflushed += flushed
+		db.mu.Unlock()
+	}
+	return err
+}
+
+// Flushes the database every FlushInterval until the DB is closed
+func (db *DB) flushLoop() {
+	defer db.wg.Done()
+	ticker := time.NewTicker(db.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+			err := db.flush()
+			if err != nil {
+				log.Printf("Error flushing database: %s", err)
+			}
+		}
+	}
+}
+
+// Reads the database file into memory as a DBStructure struct, decrypting it if needed
+// Also returns the ID of the key the file was encrypted with, or "" if it wasn't encrypted
+func (db *DB) loadDB() (DBStructure, string, error) {
+	dat, err := os.ReadFile(db.path)
+	if err != nil {
+		return DBStructure{}, "", err
+	}
+
+	dbStructure, keyID, err := decodeDBFile(dat, db.opts.Keys, db.path)
+	if err != nil {
+		return DBStructure{}, "", err
+	}
+
+	// A valid file can still be missing collections, make sure they can be written to
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = map[int]Chirp{}
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = map[int]User{}
+	}
+	if dbStructure.RevokedTokens == nil {
+		dbStructure.RevokedTokens = map[string]RevokedToken{}
+	}
+	if dbStructure.ChirpRevisions == nil {
+		dbStructure.ChirpRevisions = map[int][]ChirpRevision{}
+	}
+	if dbStructure.Likes == nil {
+		dbStructure.Likes = map[int]map[int]time.Time{}
+	}
+	if dbStructure.Media == nil {
+		dbStructure.Media = map[string]Media{}
+	}
+	if dbStructure.PollVotes == nil {
+		dbStructure.PollVotes = map[int]map[int]PollVote{}
+	}
+	if dbStructure.Drafts == nil {
+		dbStructure.Drafts = map[int]Draft{}
+	}
+	dbStructure.buildIndexes()
+	return dbStructure, keyID, nil
+}
+
+// Writes the database file to disk atomically, keeping the previous version as a .bak file
+// The file is encrypted if the database has keys
+func (db *DB) writeDB(dbStructure DBStructure) error {
+	fileData, err := db.encode(dbStructure)
 	if err != nil {
 		return err
 	}
 
-	os.WriteFile(db.path, jsonData, 0600)
-	return nil
+	return writeFileAtomic(db.path, fileData, 0600)
+}
+
+// Returns dbStructure in the on-disk format, encrypted if the database has keys
+func (db *DB) encode(dbStructure DBStructure) ([]byte, error) {
+	jsonData, err := json.Marshal(dbStructure)
+	if err != nil {
+		return nil, err
+	}
+	return encodeDBFile(jsonData, db.opts.Keys)
 }
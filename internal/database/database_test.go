@@ -0,0 +1,444 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// A backend the tests run against, opened fresh at path by open
+type testStore struct {
+	name string
+	open func(path string) (Store, error)
+}
+
+// The JSON database with each flush policy, and SQLite
+func testStores() []testStore {
+	stores := []testStore{}
+	for _, policy := range []string{"sync", "batched", "shutdown", "log"} {
+		flushPolicy, _ := ParseFlushPolicy(policy)
+		stores = append(stores, testStore{
+			name: "json/" + policy,
+			open: func(path string) (Store, error) {
+				return NewDBConnection(path, Options{FlushPolicy: flushPolicy, CompactEvery: 50})
+			},
+		})
+	}
+	return append(stores, testStore{
+		name: "sqlite",
+		open: func(path string) (Store, error) {
+			return NewSQLiteConnection(path, Options{})
+		},
+	})
+}
+
+// Opens store in a new temporary directory, and returns it with the path it can be reopened from
+func openTestStore(t *testing.T, store testStore) (Store, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "database")
+	db, err := store.open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, path
+}
+
+// Closes db and opens it again from path, so the test sees what was written to disk
+func reopenTestStore(t *testing.T, store testStore, db Store, path string) Store {
+	t.Helper()
+	err := db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := store.open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reopened.Close() })
+	return reopened
+}
+
+// Runs fn(i) for i from 0 to n-1, all at once, and waits for them to finish
+func runConcurrently(n int, fn func(i int)) {
+	wg := sync.WaitGroup{}
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// Chirps created at the same time all get an ID of their own, and none of them are lost, in memory or on disk
+func TestConcurrentCreateChirp(t *testing.T) {
+	const writers = 20
+	const chirpsEach = 10
+	for _, store := range testStores() {
+		t.Run(store.name, func(t *testing.T) {
+			db, path := openTestStore(t, store)
+			user, err := db.CreateUser("writer@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := make(chan int, writers*chirpsEach)
+			runConcurrently(writers, func(i int) {
+				for j := range chirpsEach {
+					chirp, err := db.CreateChirp(fmt.Sprintf("Chirp %d from writer %d", j, i), strconv.Itoa(user.Id), ChirpParams{})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					ids <- chirp.Id
+				}
+			})
+			close(ids)
+
+			created := map[int]bool{}
+			for id := range ids {
+				if created[id] {
+					t.Fatalf("chirp ID %d was handed out twice", id)
+				}
+				created[id] = true
+			}
+			if len(created) != writers*chirpsEach {
+				t.Fatalf("expected %d chirps to be created, got %d", writers*chirpsEach, len(created))
+			}
+
+			db = reopenTestStore(t, store, db, path)
+			chirps, err := db.GetChirps(ChirpQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != len(created) {
+				t.Fatalf("expected %d chirps after reopening, got %d", len(created), len(chirps))
+			}
+			for _, chirp := range chirps {
+				if !created[chirp.Id] {
+					t.Errorf("chirp %d was never created", chirp.Id)
+				}
+			}
+		})
+	}
+}
+
+// Likes are read-modify-write on the like count, so concurrent likes of the same chirps must not lose any
+func TestConcurrentLikes(t *testing.T) {
+	const users = 4
+	const chirps = 10
+	for _, store := range testStores() {
+		t.Run(store.name, func(t *testing.T) {
+			db, path := openTestStore(t, store)
+			userIDs := make([]int, users)
+			runConcurrently(users, func(i int) {
+				user, err := db.CreateUser(fmt.Sprintf("user%d@example.com", i), "password")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				userIDs[i] = user.Id
+			})
+			chirpIDs := make([]int, chirps)
+			for i := range chirpIDs {
+				chirp, err := db.CreateChirp("Like me", strconv.Itoa(userIDs[0]), ChirpParams{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				chirpIDs[i] = chirp.Id
+			}
+
+			// Every user likes every chirp twice, the second like must change nothing
+			runConcurrently(users*chirps*2, func(i int) {
+				_, err := db.LikeChirp(chirpIDs[i%chirps], userIDs[i/chirps%users])
+				if err != nil {
+					t.Error(err)
+				}
+			})
+
+			db = reopenTestStore(t, store, db, path)
+			for _, chirpID := range chirpIDs {
+				chirp, err := db.GetChirp(chirpID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if chirp.LikeCount != users {
+					t.Errorf("expected chirp %d to have %d likes, got %d", chirpID, users, chirp.LikeCount)
+				}
+			}
+			for _, userID := range userIDs {
+				liked, err := db.GetLikedChirps(userID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(liked) != chirps {
+					t.Errorf("expected user %d to have liked %d chirps, got %d", userID, chirps, len(liked))
+				}
+			}
+		})
+	}
+}
+
+// Concurrent transactions see each other's committed changes and nothing of the ones that fail,
+// which are undone whatever they changed before failing
+func TestConcurrentUpdate(t *testing.T) {
+	const writers = 20
+	const updatesEach = 10
+	errFailed := errors.New("failed on purpose")
+	for _, store := range testStores() {
+		if store.name == "sqlite" {
+			continue
+		}
+		t.Run(store.name, func(t *testing.T) {
+			opened, path := openTestStore(t, store)
+			db := opened.(*DB)
+			user, err := db.CreateUser("writer@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			runConcurrently(writers, func(i int) {
+				for j := range updatesEach {
+					err := db.Update(func(dbStructure *DBStructure) error {
+						chirp, err := db.newChirp(dbStructure, fmt.Sprintf("Update %d from writer %d", j, i), user.Id, ChirpParams{})
+						if err != nil {
+							return err
+						}
+						err = dbStructure.apply(Event{Type: EventChirpCreated, Chirp: &chirp})
+						if err != nil {
+							return err
+						}
+						// Every other transaction fails after its chirp is in, which has to take the chirp back out
+						if j%2 == 1 {
+							return errFailed
+						}
+						return nil
+					})
+					if err != nil && !errors.Is(err, errFailed) {
+						t.Error(err)
+					}
+				}
+			})
+
+			check := func(db *DB) {
+				t.Helper()
+				err := db.View(func(dbStructure *DBStructure) error {
+					if len(dbStructure.Chirps) != writers*updatesEach/2 {
+						t.Errorf("expected %d chirps, got %d", writers*updatesEach/2, len(dbStructure.Chirps))
+					}
+					if len(dbStructure.chirpIDs) != len(dbStructure.Chirps) || len(dbStructure.searchTerms["update"]) != len(dbStructure.Chirps) {
+						t.Errorf("indexes out of step with %d chirps: %d IDs, %d postings",
+							len(dbStructure.Chirps), len(dbStructure.chirpIDs), len(dbStructure.searchTerms["update"]))
+					}
+					// The failed transactions gave their IDs back, so the committed ones are consecutive
+					if dbStructure.Sequences.Chirps != len(dbStructure.Chirps) {
+						t.Errorf("expected the chirp sequence at %d, got %d", len(dbStructure.Chirps), dbStructure.Sequences.Chirps)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			check(db)
+			check(reopenTestStore(t, store, db, path).(*DB))
+		})
+	}
+}
+
+// A transaction that panics is undone like one that fails, before the panic is passed on
+func TestUpdatePanic(t *testing.T) {
+	for _, store := range testStores() {
+		if store.name == "sqlite" {
+			continue
+		}
+		t.Run(store.name, func(t *testing.T) {
+			opened, path := openTestStore(t, store)
+			db := opened.(*DB)
+			user, err := db.CreateUser("writer@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Fatal("expected the panic to be passed on")
+					}
+				}()
+				db.Update(func(dbStructure *DBStructure) error {
+					chirp, err := db.newChirp(dbStructure, "Never committed", user.Id, ChirpParams{})
+					if err != nil {
+						return err
+					}
+					err = dbStructure.apply(Event{Type: EventChirpCreated, Chirp: &chirp})
+					if err != nil {
+						return err
+					}
+					panic("panicked on purpose")
+				})
+			}()
+
+			chirp, err := db.CreateChirp("Committed", strconv.Itoa(user.Id), ChirpParams{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.Id != 1 {
+				t.Fatalf("expected the panicked transaction to give its ID back, got chirp %d", chirp.Id)
+			}
+			db = reopenTestStore(t, store, db, path).(*DB)
+			err = db.View(func(dbStructure *DBStructure) error {
+				if len(dbStructure.Chirps) != 1 || len(dbStructure.searchTerms["never"]) != 0 {
+					t.Errorf("expected only the committed chirp, got %d chirps", len(dbStructure.Chirps))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// A read only open sees what the server has only written to its event log, and leaves the log alone
+// while the server keeps appending to it
+func TestReadOnlyWhileServing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database")
+	db, err := NewDBConnection(path, Options{FlushPolicy: FlushLog})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	user, err := db.CreateUser("writer@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("Only in the log", strconv.Itoa(user.Id), ChirpParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logInfo, err := os.Stat(path + eventLogSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readOnly, err := NewDBConnection(path, Options{FlushPolicy: FlushLog, ReadOnly: true, ManualMigrations: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirps, err := readOnly.GetChirps(ChirpQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 {
+		t.Errorf("expected the read only open to replay 1 chirp from the log, got %d", len(chirps))
+	}
+	_, err = readOnly.CreateChirp("Not allowed", strconv.Itoa(user.Id), ChirpParams{})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly writing a read only database, got %v", err)
+	}
+	err = readOnly.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterInfo, err := os.Stat(path + eventLogSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if afterInfo.Size() != logInfo.Size() {
+		t.Fatalf("read only open changed the event log from %d to %d bytes", logInfo.Size(), afterInfo.Size())
+	}
+
+	// The server's log is still intact, so it can carry on appending and replay everything
+	_, err = db.CreateChirp("Still appending", strconv.Itoa(user.Id), ChirpParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := testStore{open: func(path string) (Store, error) { return NewDBConnection(path, Options{FlushPolicy: FlushLog}) }}
+	reopened := reopenTestStore(t, store, db, path)
+	chirps, err = reopened.GetChirps(ChirpQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 {
+		t.Errorf("expected 2 chirps after reopening, got %d", len(chirps))
+	}
+}
+
+// Only one process can have the database open for writing, until it is closed
+func TestDatabaseLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database")
+	db, err := NewDBConnection(path, Options{FlushPolicy: FlushLog})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	_, err = NewDBConnection(path, Options{ManualMigrations: true})
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("expected ErrDatabaseLocked opening the database twice, got %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Restore(BackendJSON, path, path, Checksum(data), nil)
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("expected ErrDatabaseLocked restoring over an open database, got %v", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewDBConnection(path, Options{})
+	if err != nil {
+		t.Fatalf("expected the database to open once it was closed, got %v", err)
+	}
+	second.Close()
+}
+
+// A SQLite file the server has open can't be replaced by a restore, its writes would go to the old file
+func TestRestoreLockedSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.db")
+	db, err := NewSQLiteConnection(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotPath := filepath.Join(t.TempDir(), "snapshot.db")
+	err = os.WriteFile(snapshotPath, snapshot, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Restore(BackendSQLite, path, snapshotPath, Checksum(snapshot), nil)
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("expected ErrDatabaseLocked restoring over an open database, got %v", err)
+	}
+	// Backups only read, so they can still open it
+	readOnly, err := NewSQLiteConnection(path, Options{ReadOnly: true, ManualMigrations: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly.Close()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Restore(BackendSQLite, path, snapshotPath, Checksum(snapshot), nil)
+	if err != nil {
+		t.Fatalf("expected the restore to work once the database was closed, got %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// How far ahead a chirp can be scheduled
+const MaxScheduleAhead = 365 * 24 * time.Hour
+
+var ErrDraftNotFound = errors.New("Draft not found")
+var ErrPublishTime = fmt.Errorf("Chirps can only be scheduled for the future, at most %d days ahead", MaxScheduleAhead/(24*time.Hour))
+
+// A chirp that hasn't been posted yet. Only its author can see it
+// A draft with PublishAt set is scheduled, and is published on its own once that time has passed
+type Draft struct {
+	Id        int    `json:"id"`
+	AuthorId  int    `json:"author_id"`
+	Body      string `json:"body"`
+	InReplyTo int    `json:"in_reply_to,omitempty"`
+	RechirpOf int    `json:"rechirp_of,omitempty"`
+	QuoteOf   int    `json:"quote_of,omitempty"`
+	// IDs of the media to attach. They are only looked up when the draft is published
+	MediaIDs  []string   `json:"media_ids,omitempty"`
+	Poll      *Poll      `json:"poll,omitempty"`
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	// Why the draft couldn't be published when it was scheduled to be. It stays unscheduled until it is saved again
+	PublishError string    `json:"publish_error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Returns the params the draft is published with
+func (draft Draft) params() ChirpParams {
+	return ChirpParams{InReplyTo: draft.InReplyTo, RechirpOf: draft.RechirpOf, QuoteOf: draft.QuoteOf, MediaIDs: draft.MediaIDs, Poll: draft.Poll}
+}
+
+// Sets what the draft is published with, and when, once they are checked. A zero publishAt leaves it unscheduled
+func (draft *Draft) set(params ChirpParams, publishAt time.Time) {
+	draft.InReplyTo = params.InReplyTo
+	draft.RechirpOf = params.RechirpOf
+	draft.QuoteOf = params.QuoteOf
+	draft.MediaIDs = params.MediaIDs
+	draft.Poll = nil
+	if params.Poll != nil {
+		draft.Poll = params.Poll.stored()
+	}
+	draft.PublishAt = nil
+	if !publishAt.IsZero() {
+		publishAt = publishAt.UTC()
+		draft.PublishAt = &publishAt
+	}
+	draft.PublishError = ""
+}
+
+// Returns the time a draft saved at now would be published at, checking that it is a time it can be scheduled for
+// A zero publishAt is a draft that isn't scheduled, it is checked as if it were published now
+func publishTime(publishAt, now time.Time) (time.Time, error) {
+	if publishAt.IsZero() {
+		return now, nil
+	}
+	if !publishAt.After(now) || publishAt.After(now.Add(MaxScheduleAhead)) {
+		return time.Time{}, ErrPublishTime
+	}
+	return publishAt, nil
+}
+
+// Checks a draft's body and params as a chirp posted when it would be published, and sets them on the draft
+func (dbStructure *DBStructure) checkDraft(draft *Draft, params ChirpParams, publishAt, now time.Time) error {
+	postedAt, err := publishTime(publishAt, now)
+	if err != nil {
+		return err
+	}
+	params, _, err = dbStructure.checkChirp(draft.Body, draft.AuthorId, params, postedAt)
+	if err != nil {
+		return err
+	}
+	draft.set(params, publishAt)
+	return nil
+}
+
+// Saves a new draft by authorID, scheduled for publishAt unless it is zero
+// It has to pass the same checks as a new chirp, as if it were posted at publishAt
+func (db *DB) CreateDraft(authorID int, body string, params ChirpParams, publishAt time.Time) (Draft, error) {
+	draft := Draft{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		now := timestamp()
+		created := Draft{AuthorId: authorID, Body: body, CreatedAt: now, UpdatedAt: now}
+		err := dbStructure.checkDraft(&created, params, publishAt, now)
+		if err != nil {
+			return err
+		}
+		created.Id = dbStructure.nextDraftID()
+		draft = created
+		return dbStructure.apply(Event{Type: EventDraftSaved, At: now, Draft: &created})
+	})
+	if err != nil {
+		return Draft{}, err
+	}
+	return draft, nil
+}
+
+// Returns the author's drafts, scheduled or not, oldest first
+func (db *DB) GetDrafts(authorID int) ([]Draft, error) {
+	drafts := []Draft{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, draft := range dbStructure.Drafts {
+			if draft.AuthorId == authorID {
+				drafts = append(drafts, draft)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(drafts, func(a, b Draft) int { return a.Id - b.Id })
+	return drafts, nil
+}
+
+// Replaces the body, params and publish time of one of the author's drafts, checking them like CreateDraft does
+// Other users' drafts are not found
+func (db *DB) UpdateDraft(draftID, authorID int, body string, params ChirpParams, publishAt time.Time) (Draft, error) {
+	draft := Draft{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		found, ok := dbStructure.Drafts[draftID]
+		if !ok || found.AuthorId != authorID {
+			return ErrDraftNotFound
+		}
+		now := timestamp()
+		found.Body = body
+		found.UpdatedAt = now
+		err := dbStructure.checkDraft(&found, params, publishAt, now)
+		if err != nil {
+			return err
+		}
+		draft = found
+		return dbStructure.apply(Event{Type: EventDraftSaved, At: now, Draft: &found})
+	})
+	if err != nil {
+		return Draft{}, err
+	}
+	return draft, nil
+}
+
+// Deletes one of the author's drafts. Other users' drafts are not found
+func (db *DB) DeleteDraft(draftID, authorID int) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		draft, ok := dbStructure.Drafts[draftID]
+		if !ok || draft.AuthorId != authorID {
+			return ErrDraftNotFound
+		}
+		return dbStructure.apply(Event{Type: EventDraftDeleted, DraftID: draftID})
+	})
+}
+
+// Publishes one of the author's drafts as a new chirp right away, whether it is scheduled or not
+// It is checked again as a new chirp, since the chirps it links to may have been deleted since it was saved
+func (db *DB) PublishDraft(draftID, authorID int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		draft, ok := dbStructure.Drafts[draftID]
+		if !ok || draft.AuthorId != authorID {
+			return ErrDraftNotFound
+		}
+		published, err := db.newChirp(dbStructure, draft.Body, draft.AuthorId, draft.params())
+		if err != nil {
+			return err
+		}
+		// One event creates the chirp and removes the draft, so a replayed log can't publish it twice
+		err = dbStructure.apply(Event{Type: EventDraftPublished, DraftID: draftID, Chirp: &published})
+		if err != nil {
+			return err
+		}
+		chirp = dbStructure.expand(published, 0)
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+// Publishes every scheduled draft that is due at now, in the order they were scheduled for
+// A draft that no longer passes the checks for a new chirp is unscheduled instead, with the reason as its
+// PublishError, rather than tried again on every call
+func (db *DB) PublishDueDrafts(now time.Time) (published int, failed int, err error) {
+	due := 0
+	db.View(func(dbStructure *DBStructure) error {
+		due = len(dbStructure.dueDrafts(now))
+		return nil
+	})
+	// Don't rewrite the database when there is nothing to publish
+	if due == 0 {
+		return 0, 0, nil
+	}
+
+	err = db.Update(func(dbStructure *DBStructure) error {
+		for _, draft := range dbStructure.dueDrafts(now) {
+			chirp, err := db.newChirp(dbStructure, draft.Body, draft.AuthorId, draft.params())
+			if IsInvalidChirpParams(err) {
+				draft.PublishAt = nil
+				draft.PublishError = err.Error()
+				err = dbStructure.apply(Event{Type: EventDraftSaved, Draft: &draft})
+				if err != nil {
+					return err
+				}
+				failed++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = dbStructure.apply(Event{Type: EventDraftPublished, DraftID: draft.Id, Chirp: &chirp})
+			if err != nil {
+				return err
+			}
+			published++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return published, failed, nil
+}
+
+// Returns the scheduled drafts due at now, in the order they are published
+func (dbStructure *DBStructure) dueDrafts(now time.Time) []Draft {
+	due := []Draft{}
+	for _, draft := range dbStructure.Drafts {
+		if draft.PublishAt != nil && !draft.PublishAt.After(now) {
+			due = append(due, draft)
+		}
+	}
+	slices.SortFunc(due, compareDraftPublishAt)
+	return due
+}
+
+// Orders scheduled drafts by when they are published, and drafts scheduled for the same time by ID
+func compareDraftPublishAt(a, b Draft) int {
+	if c := a.PublishAt.Compare(*b.PublishAt); c != 0 {
+		return c
+	}
+	return a.Id - b.Id
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The draft publisher ticks every few seconds, a tick with nothing due must not rewrite the file
+func TestPublishDueDraftsIdle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database")
+	db, err := NewDBConnection(path, Options{FlushPolicy: FlushSync})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	user, err := db.CreateUser("writer@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishAt := time.Now().Add(time.Hour)
+	_, err = db.CreateDraft(user.Id, "Later", ChirpParams{}, publishAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Long enough for a rewrite to show up in the modification time
+	time.Sleep(20 * time.Millisecond)
+	published, failed, err := db.PublishDueDrafts(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published != 0 || failed != 0 {
+		t.Fatalf("expected nothing to be due, got %d published and %d failed", published, failed)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) || !os.SameFile(before, after) {
+		t.Fatal("an idle tick rewrote the database file")
+	}
+
+	published, _, err = db.PublishDueDrafts(publishAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published != 1 {
+		t.Fatalf("expected the draft to be published once due, got %d", published)
+	}
+	chirps, err := db.GetChirps(ChirpQuery{AuthorID: user.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 {
+		t.Errorf("expected 1 published chirp, got %d", len(chirps))
+	}
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrEditWindowClosed = errors.New("Chirp can no longer be edited")
+var ErrRechirpNotEditable = errors.New("Rechirps have no body to edit")
+
+// An earlier body of an edited chirp
+type ChirpRevision struct {
+	// 1 is the body the chirp was posted with, each edit adds the next one
+	Revision int    `json:"revision"`
+	Body     string `json:"body"`
+	// When this body was posted, and when an edit replaced it
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// Reports whether a chirp can still be edited at now. Chirpy Red members can edit their chirps at any time,
+// everyone else only within the edit window after posting
+func (opts Options) canEdit(chirp Chirp, authorIsChirpyRed bool, now time.Time) bool {
+	return authorIsChirpyRed || now.Before(chirp.CreatedAt.Add(opts.EditWindow))
+}
+
+// Replaces the body of a chirp, keeping the old body as a revision. Only the author can edit a chirp
+// An edit that doesn't change the body returns the chirp as it is, without adding a revision
+func (db *DB) EditChirp(chirpID, authorID int, body string) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		found, ok := dbStructure.Chirps[chirpID]
+		if !ok || found.deleted() {
+			return ErrChirpNotFound
+		}
+		if found.AuthorId != authorID {
+			return ErrUnauthorized
+		}
+		if found.RechirpOf != 0 {
+			return ErrRechirpNotEditable
+		}
+		if found.QuoteOf != 0 && body == "" {
+			return ErrEmptyQuote
+		}
+		now := timestamp()
+		if !db.opts.canEdit(found, dbStructure.Users[authorID].IsChirpyRed, now) {
+			return ErrEditWindowClosed
+		}
+		chirp = dbStructure.expand(found, 0)
+		if found.Body == body {
+			return nil
+		}
+
+		edited := found
+		edited.Body = body
+		edited.Entities = dbStructure.findEntities(body)
+		edited.UpdatedAt = now
+		edited.Edited = true
+		err := dbStructure.apply(Event{Type: EventChirpEdited, At: now, Chirp: &edited})
+		if err != nil {
+			return err
+		}
+		chirp = dbStructure.expand(edited, 0)
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+// Returns the earlier bodies of a chirp, oldest first. Deleted chirps are not found
+func (db *DB) GetChirpHistory(chirpID int) ([]ChirpRevision, error) {
+	revisions := []ChirpRevision{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		chirp, ok := dbStructure.Chirps[chirpID]
+		if !ok || chirp.deleted() {
+			return ErrChirpNotFound
+		}
+		revisions = append(revisions, dbStructure.ChirpRevisions[chirpID]...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
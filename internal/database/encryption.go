@@ -0,0 +1,263 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidEncryptionKey = errors.New("Encryption keys must be 32 bytes, base64 encoded")
+var ErrEncryptionKeyRequired = errors.New("Database is encrypted but no encryption key is configured")
+var ErrUnknownEncryptionKey = errors.New("Database is encrypted with a key that is not configured")
+var ErrEncryptionUnsupported = errors.New("Encryption at rest is only supported by the JSON backend")
+
+// The only encryption scheme so far. Stored in every encrypted file so a new one can be added later
+const encryptionAES256GCM = "aes-256-gcm"
+
+// A set of AES-256 keys for encrypting the JSON database at rest
+// The first key is the primary key, everything is encrypted with it. The others are only used to
+// decrypt files written before a key rotation
+type Keyring struct {
+	keys []encryptionKey
+}
+
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// The on-disk format of an encrypted database, using envelope encryption
+// The database is encrypted with a fresh random data key on every write, and that data key is
+// encrypted ("wrapped") with the primary key, so the key itself never encrypts much data
+type encryptedFile struct {
+	Encryption string `json:"encryption"`
+	// Identifies the key that wrapped the data key, see keyID
+	KeyID string `json:"key_id"`
+	// Nonce followed by the data key, sealed with the key named by KeyID
+	WrappedKey []byte `json:"wrapped_key"`
+	// Nonce followed by the database JSON, sealed with the data key
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Creates a keyring from raw 32 byte keys. The first key is the primary key
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, ErrInvalidEncryptionKey
+	}
+	keyring := &Keyring{}
+	for _, key := range keys {
+		if len(key) != 32 {
+			return nil, ErrInvalidEncryptionKey
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys = append(keyring.keys, encryptionKey{id: keyID(key), aead: aead})
+	}
+	return keyring, nil
+}
+
+// Parses a list of base64 encoded keys, separated by commas or whitespace, into a keyring
+// This is the format of DB_ENCRYPTION_KEY and of key files, which have one key per line
+func ParseKeyring(encoded string) (*Keyring, error) {
+	keys := [][]byte{}
+	for _, field := range strings.FieldsFunc(encoded, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		key, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, ErrInvalidEncryptionKey
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys...)
+}
+
+// Returns a new random key, base64 encoded so it can go straight into DB_ENCRYPTION_KEY or a key file
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Returns the ID of the primary key
+func (keyring *Keyring) PrimaryKeyID() string {
+	return keyring.keys[0].id
+}
+
+// Identifies a key without giving anything away about it: the first 8 bytes of its SHA-256, hex encoded
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts with a random nonce, and returns the nonce followed by the ciphertext
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Reverses seal
+func unseal(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// Encrypts the database JSON under the primary key and returns the encrypted file contents
+func (keyring *Keyring) encrypt(plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	primary := keyring.keys[0]
+	file := encryptedFile{Encryption: encryptionAES256GCM, KeyID: primary.id}
+	// The key ID is authenticated along with the data key, so it can't be swapped for another one
+	file.WrappedKey, err = seal(primary.aead, dataKey, []byte(primary.id))
+	if err != nil {
+		return nil, err
+	}
+	file.Ciphertext, err = seal(dataAEAD, plaintext, file.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(file)
+}
+
+// Decrypts an encrypted file with whichever key in the keyring it was written with
+// Returns the database JSON and the ID of the key that was used
+func (keyring *Keyring) decrypt(file encryptedFile) ([]byte, string, error) {
+	if file.Encryption != encryptionAES256GCM {
+		return nil, "", fmt.Errorf("%w: unknown encryption %q", ErrCorruptDatabase, file.Encryption)
+	}
+	if keyring == nil {
+		return nil, "", ErrEncryptionKeyRequired
+	}
+	for _, key := range keyring.keys {
+		if key.id != file.KeyID {
+			continue
+		}
+		dataKey, err := unseal(key.aead, file.WrappedKey, []byte(key.id))
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: data key could not be decrypted: %v", ErrCorruptDatabase, err)
+		}
+		dataAEAD, err := newAEAD(dataKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrCorruptDatabase, err)
+		}
+		plaintext, err := unseal(dataAEAD, file.Ciphertext, file.WrappedKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: data could not be decrypted: %v", ErrCorruptDatabase, err)
+		}
+		return plaintext, key.id, nil
+	}
+	return nil, "", fmt.Errorf("%w: key ID %s", ErrUnknownEncryptionKey, file.KeyID)
+}
+
+// Turns the contents of a database file into a DBStructure, decrypting it first if it is encrypted
+// Also returns the ID of the key it was encrypted with, or "" if it wasn't
+// name is only used in error messages
+func decodeDBFile(data []byte, keyring *Keyring, name string) (DBStructure, string, error) {
+	dbStructure := DBStructure{}
+	data, usedKeyID, err := decryptIfEncrypted(data, keyring)
+	if err != nil {
+		return DBStructure{}, "", fmt.Errorf("%s: %w", name, err)
+	}
+
+	err = json.Unmarshal(data, &dbStructure)
+	if err != nil {
+		return DBStructure{}, "", fmt.Errorf("%w: %s: %v", ErrCorruptDatabase, name, err)
+	}
+	return dbStructure, usedKeyID, nil
+}
+
+// Returns the JSON inside data, decrypting it if it was written by encodeDBFile with a keyring
+// Also returns the ID of the key it was encrypted with, or "" if it wasn't encrypted
+func decryptIfEncrypted(data []byte, keyring *Keyring) ([]byte, string, error) {
+	// Encrypted data is itself JSON, with an "encryption" field that plain data never has
+	file := encryptedFile{}
+	err := json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrCorruptDatabase, err)
+	}
+	if file.Encryption == "" {
+		return data, "", nil
+	}
+	return keyring.decrypt(file)
+}
+
+// Encrypts the database JSON if keyring is set, otherwise returns it unchanged
+func encodeDBFile(jsonData []byte, keyring *Keyring) ([]byte, error) {
+	if keyring == nil {
+		return jsonData, nil
+	}
+	return keyring.encrypt(jsonData)
+}
+
+// Rewrites the database file encrypted with the primary key of keys, and uses keys from then on
+// The .bak copy is rewritten too, so nothing is left on disk under the old key or unencrypted
+// Any changes that haven't been flushed yet are written as part of the rekey, and the event log is emptied
+func (db *DB) Rekey(keys *Keyring) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	jsonData, err := json.Marshal(db.data)
+	if err != nil {
+		return err
+	}
+	// Written twice, so the first write becomes the .bak copy. Each write uses a new data key
+	for range 2 {
+		fileData, err := encodeDBFile(jsonData, keys)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(db.path, fileData, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	// Everything in the event log is in the file now, and the log is still under the old key
+	err = db.truncateEventLog()
+	if err != nil {
+		return err
+	}
+	db.opts.Keys = keys
+	db.unflushed = 0
+	return nil
+}
@@ -0,0 +1,218 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var ErrInvalidTag = errors.New("Invalid tag, expected letters, digits and underscores")
+
+// Kinds of entity found in chirp bodies
+const (
+	EntityHashtag = "hashtag"
+	EntityMention = "mention"
+	EntityURL     = "url"
+)
+
+// A hashtag, mention or URL in a chirp's body
+type Entity struct {
+	Type string `json:"type"`
+	// The entity as it is written in the body, including the # or @
+	Text string `json:"text"`
+	// Where the entity is in the body, as byte offsets and as rune offsets. The ends are exclusive
+	Start     int `json:"start"`
+	End       int `json:"end"`
+	RuneStart int `json:"rune_start"`
+	RuneEnd   int `json:"rune_end"`
+	// Lower cased tag without the #, for hashtags
+	Tag string `json:"tag,omitempty"`
+	// Lower cased handle without the @, for mentions. A user's handle is the part of their email before the @
+	Handle string `json:"handle,omitempty"`
+	// The mentioned user, if exactly one user had the handle when the chirp was posted
+	UserID int `json:"user_id,omitempty"`
+}
+
+// Finds the hashtags, mentions and URLs in a chirp body, in the order they appear
+// Hashtags and mentions have to start a word, so emails and URL fragments aren't mistaken for them
+func extractEntities(body string) []Entity {
+	entities := []Entity{}
+	prev := ' '
+	for i := 0; i < len(body); {
+		if !isWordRune(prev) {
+			if entity, ok := entityAt(body, i); ok {
+				entity.RuneStart = utf8.RuneCountInString(body[:entity.Start])
+				entity.RuneEnd = entity.RuneStart + utf8.RuneCountInString(entity.Text)
+				entities = append(entities, entity)
+				i = entity.End
+				prev, _ = utf8.DecodeLastRuneInString(body[:i])
+				continue
+			}
+		}
+		r, size := utf8.DecodeRuneInString(body[i:])
+		prev = r
+		i += size
+	}
+	return entities
+}
+
+// Returns the entity starting at byte offset start of body, if there is one
+func entityAt(body string, start int) (Entity, bool) {
+	rest := body[start:]
+	switch {
+	case hasPrefixFold(rest, "https://") || hasPrefixFold(rest, "http://"):
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end == -1 {
+			end = len(rest)
+		}
+		text := trimURL(rest[:end])
+		if strings.HasSuffix(text, "://") {
+			return Entity{}, false
+		}
+		return Entity{Type: EntityURL, Text: text, Start: start, End: start + len(text)}, true
+	case rest[0] == '#':
+		name := leadingRunes(rest[1:], isWordRune)
+		// #1 is a number, not a tag
+		if !strings.ContainsFunc(name, unicode.IsLetter) {
+			return Entity{}, false
+		}
+		return Entity{Type: EntityHashtag, Text: "#" + name, Start: start, End: start + 1 + len(name), Tag: strings.ToLower(name)}, true
+	case rest[0] == '@':
+		// A dot or dash ending the handle is far more likely to end the sentence
+		name := strings.TrimRight(leadingRunes(rest[1:], isHandleRune), ".-")
+		if name == "" {
+			return Entity{}, false
+		}
+		return Entity{Type: EntityMention, Text: "@" + name, Start: start, End: start + 1 + len(name), Handle: strings.ToLower(name)}, true
+	}
+	return Entity{}, false
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isHandleRune(r rune) bool {
+	return isWordRune(r) || r == '.' || r == '-' || r == '+'
+}
+
+// Returns the longest prefix of s made of runes that match keep
+func leadingRunes(s string, keep func(rune) bool) string {
+	if end := strings.IndexFunc(s, func(r rune) bool { return !keep(r) }); end != -1 {
+		return s[:end]
+	}
+	return s
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// Closing brackets, and the opening bracket each one closes
+var urlBrackets = map[byte]string{')': "(", ']': "[", '}': "{", '>': "<"}
+
+// Takes punctuation that ends the sentence off the end of a URL, and a closing bracket that
+// closes a bracket around the URL rather than one inside it
+func trimURL(url string) string {
+	for url != "" {
+		last := url[len(url)-1]
+		opening, isBracket := urlBrackets[last]
+		switch {
+		case strings.IndexByte(`.,:;!?'"`, last) != -1:
+		case isBracket && strings.Count(url, string(last)) > strings.Count(url, opening):
+		default:
+			return url
+		}
+		url = url[:len(url)-1]
+	}
+	return url
+}
+
+// Returns the lower cased tag a hashtag is listed under, with or without its #
+// Chirps are stored in NFC, so the tag is too, or it wouldn't match a tag typed with decomposed accents
+func NormalizeTag(tag string) (string, error) {
+	tag = norm.NFC.String(strings.TrimPrefix(tag, "#"))
+	if tag == "" || strings.ContainsFunc(tag, func(r rune) bool { return !isWordRune(r) }) ||
+		!strings.ContainsFunc(tag, unicode.IsLetter) {
+		return "", ErrInvalidTag
+	}
+	return strings.ToLower(tag), nil
+}
+
+// Returns the handle mentions of a user are matched against: the lower cased part of their email before the @
+func userHandle(email string) string {
+	handle, _, _ := strings.Cut(email, "@")
+	return strings.ToLower(handle)
+}
+
+// Finds the entities in a chirp body, and resolves each mention to the one user with its handle
+// Mentions of a handle that no user or more than one user has are left unresolved
+func (dbStructure *DBStructure) findEntities(body string) []Entity {
+	entities := extractEntities(body)
+	for i, entity := range entities {
+		if userIDs := dbStructure.userIDsByHandle[entity.Handle]; entity.Type == EntityMention && len(userIDs) == 1 {
+			entities[i].UserID = userIDs[0]
+		}
+	}
+	return entities
+}
+
+// Returns the chirp's distinct hashtags
+func (chirp Chirp) tags() []string {
+	tags := []string{}
+	for _, entity := range chirp.Entities {
+		if entity.Type == EntityHashtag && !slices.Contains(tags, entity.Tag) {
+			tags = append(tags, entity.Tag)
+		}
+	}
+	return tags
+}
+
+// Returns the distinct users the chirp mentions
+func (chirp Chirp) mentionedUserIDs() []int {
+	userIDs := []int{}
+	for _, entity := range chirp.Entities {
+		if entity.UserID != 0 && !slices.Contains(userIDs, entity.UserID) {
+			userIDs = append(userIDs, entity.UserID)
+		}
+	}
+	return userIDs
+}
+
+// Adds a chirp to the tag and mention indexes
+func (dbStructure *DBStructure) indexEntities(chirp Chirp) {
+	for _, tag := range chirp.tags() {
+		dbStructure.chirpIDsByTag[tag] = insertID(dbStructure.chirpIDsByTag[tag], chirp.Id)
+	}
+	for _, userID := range chirp.mentionedUserIDs() {
+		dbStructure.chirpIDsByMention[userID] = insertID(dbStructure.chirpIDsByMention[userID], chirp.Id)
+	}
+}
+
+// Takes a chirp back out of the tag and mention indexes
+func (dbStructure *DBStructure) unindexEntities(chirp Chirp) {
+	for _, tag := range chirp.tags() {
+		removeIndexedID(dbStructure.chirpIDsByTag, tag, chirp.Id)
+	}
+	for _, userID := range chirp.mentionedUserIDs() {
+		removeIndexedID(dbStructure.chirpIDsByMention, userID, chirp.Id)
+	}
+}
+
+// Takes id out of the sorted slice under key, and drops the key once it is empty
+func removeIndexedID[K comparable](index map[K][]int, key K, id int) {
+	ids := index[key]
+	i, found := slices.BinarySearch(ids, id)
+	if !found {
+		return
+	}
+	if len(ids) == 1 {
+		delete(index, key)
+		return
+	}
+	index[key] = slices.Delete(ids, i, i+1)
+}
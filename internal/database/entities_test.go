@@ -0,0 +1,61 @@
+package database
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExtractEntities(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []string
+	}{
+		{"numbers aren't hashtags", "We're #1 and #2024", []string{}},
+		{"hashtags need a letter", "#1st and #go1, but not #_", []string{"hashtag #1st", "hashtag #go1"}},
+		{"hashtags start a word", "x#tag", []string{}},
+		{"emails aren't mentions", "Mail jane@example.com or @jane", []string{"mention @jane"}},
+		{"a lone @ isn't a mention", "Meet @ noon", []string{}},
+		{"sentence punctuation ends a handle", "Thanks @jane. Hi @bob, @eve! @max? @kim-", []string{
+			"mention @jane", "mention @bob", "mention @eve", "mention @max", "mention @kim",
+		}},
+		{"dots inside a handle", "cc @jane.doe's cat", []string{"mention @jane.doe"}},
+		{"URL in parentheses", "(see https://example.com/a).", []string{"url https://example.com/a"}},
+		{"parentheses inside a URL", "(https://en.wikipedia.org/wiki/Go_(game))", []string{"url https://en.wikipedia.org/wiki/Go_(game)"}},
+		{"URL in square brackets", "[https://example.com]", []string{"url https://example.com"}},
+		{"URL in angle brackets", "<http://example.com/path>", []string{"url http://example.com/path"}},
+		{"URL in quotes", `"https://example.com"`, []string{"url https://example.com"}},
+		{"scheme alone isn't a URL", "https:// is not a link", []string{}},
+		{"fragments in a URL aren't hashtags", "https://example.com/#top", []string{"url https://example.com/#top"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := []string{}
+			for _, entity := range extractEntities(test.body) {
+				got = append(got, entity.Type+" "+entity.Text)
+			}
+			if !slices.Equal(got, test.expected) {
+				t.Errorf("extractEntities(%q) = %q, expected %q", test.body, got, test.expected)
+			}
+		})
+	}
+}
+
+func TestExtractEntitiesOffsets(t *testing.T) {
+	body := "héllo #Café @Bob"
+	entities := extractEntities(body)
+	if len(entities) != 2 {
+		t.Fatalf("expected 2 entities, got %+v", entities)
+	}
+	for _, entity := range entities {
+		if body[entity.Start:entity.End] != entity.Text {
+			t.Errorf("byte offsets of %q point at %q", entity.Text, body[entity.Start:entity.End])
+		}
+		if runes := []rune(body); string(runes[entity.RuneStart:entity.RuneEnd]) != entity.Text {
+			t.Errorf("rune offsets of %q point at %q", entity.Text, string(runes[entity.RuneStart:entity.RuneEnd]))
+		}
+	}
+	if entities[0].Tag != "café" || entities[1].Handle != "bob" {
+		t.Errorf("expected tag café and handle bob, got %q and %q", entities[0].Tag, entities[1].Handle)
+	}
+}
@@ -0,0 +1,376 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Kinds of change recorded in the event log. Every change to a DBStructure outside of migrations
+// is made by applying one of these, so replaying the log rebuilds the same state
+const (
+	EventChirpCreated       = "ChirpCreated"
+	EventChirpEdited        = "ChirpEdited"
+	EventChirpDeleted       = "ChirpDeleted"
+	EventChirpRestored      = "ChirpRestored"
+	EventChirpLiked         = "ChirpLiked"
+	EventChirpUnliked       = "ChirpUnliked"
+	EventChirpsPurged       = "ChirpsPurged"
+	EventUserCreated        = "UserCreated"
+	EventUserUpdated        = "UserUpdated"
+	EventUserUpgraded       = "UserUpgraded"
+	EventTokenRevoked       = "TokenRevoked"
+	EventRevokedTokensSwept = "RevokedTokensSwept"
+	EventMediaCreated       = "MediaCreated"
+	EventMediaDeleted       = "MediaDeleted"
+	EventPollVoted          = "PollVoted"
+	EventDraftSaved         = "DraftSaved"
+	EventDraftDeleted       = "DraftDeleted"
+	EventDraftPublished     = "DraftPublished"
+	EventDatabaseWiped      = "DatabaseWiped"
+)
+
+// The event log lives next to the database file, as <path>.log
+const eventLogSuffix = ".log"
+
+// One change to the database, as stored on a line of the event log. Only the fields its Type needs are set
+type Event struct {
+	// Position in the log. The database file records the last one it includes, so replay can skip the rest
+	Seq  int64     `json:"seq"`
+	Type string    `json:"type"`
+	At   time.Time `json:"at"`
+
+	Chirp   *Chirp `json:"chirp,omitempty"`
+	ChirpID int    `json:"chirp_id,omitempty"`
+	User    *User  `json:"user,omitempty"`
+	Media   *Media `json:"media,omitempty"`
+	UserID  int    `json:"user_id,omitempty"`
+	// Indexes of the poll options voted for
+	Options []int  `json:"options,omitempty"`
+	Draft   *Draft `json:"draft,omitempty"`
+	DraftID int    `json:"draft_id,omitempty"`
+	// tokenKey of the revoked token, never the token itself
+	TokenHash    string        `json:"token_hash,omitempty"`
+	RevokedToken *RevokedToken `json:"revoked_token,omitempty"`
+	// Chirps deleted before this time are purged
+	Before *time.Time `json:"before,omitempty"`
+	// Media records removed because nothing refers to them anymore
+	MediaIDs []string `json:"media_ids,omitempty"`
+}
+
+// Makes the change described by event and records it, so the commit can append it to the event log
+// If the change fails nothing is recorded
+func (dbStructure *DBStructure) apply(event Event) error {
+	if event.At.IsZero() {
+		event.At = timestamp()
+	}
+
+	switch event.Type {
+	case EventChirpCreated:
+		dbStructure.putChirp(*event.Chirp)
+		dbStructure.countReply(*event.Chirp, 1)
+		dbStructure.Sequences.Chirps = max(dbStructure.Sequences.Chirps, event.Chirp.Id)
+	case EventChirpEdited:
+		old, ok := dbStructure.Chirps[event.Chirp.Id]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		revisions := dbStructure.ChirpRevisions[old.Id]
+		putEntry(dbStructure, dbStructure.ChirpRevisions, old.Id, append(revisions, ChirpRevision{
+			Revision:   len(revisions) + 1,
+			Body:       old.Body,
+			CreatedAt:  old.UpdatedAt,
+			ReplacedAt: event.At,
+		}))
+		dbStructure.putChirp(*event.Chirp)
+	case EventChirpDeleted:
+		chirp, ok := dbStructure.Chirps[event.ChirpID]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		deletedAt := event.At
+		chirp.DeletedAt = &deletedAt
+		dbStructure.putChirp(chirp)
+		dbStructure.countReply(chirp, -1)
+	case EventChirpRestored:
+		chirp, ok := dbStructure.Chirps[event.ChirpID]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		chirp.DeletedAt = nil
+		dbStructure.putChirp(chirp)
+		dbStructure.countReply(chirp, 1)
+	case EventChirpLiked:
+		if _, ok := dbStructure.Chirps[event.ChirpID]; !ok {
+			return ErrChirpNotFound
+		}
+		dbStructure.putLike(event.ChirpID, event.UserID, event.At)
+	case EventChirpUnliked:
+		if _, ok := dbStructure.Chirps[event.ChirpID]; !ok {
+			return ErrChirpNotFound
+		}
+		dbStructure.removeLike(event.ChirpID, event.UserID)
+	case EventChirpsPurged:
+		// Newest first, so replies are gone before their parent is looked at, and the result
+		// doesn't depend on map order when the log is replayed. Purging a chirp only moves the IDs after it
+		// in the index, which have already been looked at
+		chirpIDs := dbStructure.chirpIDs
+		for i := len(chirpIDs) - 1; i >= 0; i-- {
+			dbStructure.purgeChirp(dbStructure.Chirps[chirpIDs[i]], *event.Before)
+		}
+	case EventUserCreated, EventUserUpdated:
+		err := dbStructure.putUser(*event.User)
+		if err != nil {
+			return err
+		}
+		dbStructure.Sequences.Users = max(dbStructure.Sequences.Users, event.User.Id)
+	case EventUserUpgraded:
+		user, ok := dbStructure.Users[event.UserID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		user.IsChirpyRed = true
+		user.UpdatedAt = event.At
+		err := dbStructure.putUser(user)
+		if err != nil {
+			return err
+		}
+	case EventTokenRevoked:
+		putEntry(dbStructure, dbStructure.RevokedTokens, event.TokenHash, *event.RevokedToken)
+	case EventRevokedTokensSwept:
+		for key, revoked := range dbStructure.RevokedTokens {
+			if revoked.ExpiresAt.Before(event.At) {
+				deleteEntry(dbStructure, dbStructure.RevokedTokens, key)
+			}
+		}
+	case EventPollVoted:
+		if chirp, ok := dbStructure.Chirps[event.ChirpID]; !ok || chirp.Poll == nil {
+			return ErrNoPoll
+		}
+		err := dbStructure.putPollVote(event.ChirpID, event.UserID, PollVote{Options: event.Options, VotedAt: event.At})
+		if err != nil {
+			return err
+		}
+	case EventDraftSaved:
+		putEntry(dbStructure, dbStructure.Drafts, event.Draft.Id, *event.Draft)
+		dbStructure.Sequences.Drafts = max(dbStructure.Sequences.Drafts, event.Draft.Id)
+	case EventDraftDeleted:
+		if _, ok := dbStructure.Drafts[event.DraftID]; !ok {
+			return ErrDraftNotFound
+		}
+		deleteEntry(dbStructure, dbStructure.Drafts, event.DraftID)
+	case EventDraftPublished:
+		// Creates the chirp like EventChirpCreated, and removes the draft it was published from
+		if _, ok := dbStructure.Drafts[event.DraftID]; !ok {
+			return ErrDraftNotFound
+		}
+		deleteEntry(dbStructure, dbStructure.Drafts, event.DraftID)
+		dbStructure.putChirp(*event.Chirp)
+		dbStructure.countReply(*event.Chirp, 1)
+		dbStructure.Sequences.Chirps = max(dbStructure.Sequences.Chirps, event.Chirp.Id)
+	case EventMediaCreated:
+		putEntry(dbStructure, dbStructure.Media, event.Media.Id, *event.Media)
+	case EventMediaDeleted:
+		for _, mediaID := range event.MediaIDs {
+			deleteEntry(dbStructure, dbStructure.Media, mediaID)
+		}
+	case EventDatabaseWiped:
+		wiped := newDBStructure()
+		wiped.SchemaVersion = dbStructure.SchemaVersion
+		wiped.LogSequence = dbStructure.LogSequence
+		wiped.pendingEvents = dbStructure.pendingEvents
+		wiped.undo = dbStructure.undo
+		old := *dbStructure
+		dbStructure.onRollback(func() {
+			*dbStructure = old
+			dbStructure.undo = nil
+		})
+		*dbStructure = wiped
+	default:
+		return fmt.Errorf("unknown event type %q", event.Type)
+	}
+
+	dbStructure.pendingEvents = append(dbStructure.pendingEvents, event)
+	return nil
+}
+
+// Returns the path of the event log
+func (db *DB) eventLogPath() string {
+	return db.path + eventLogSuffix
+}
+
+// Applies every event in the log that the database file doesn't include yet
+// Returns how many were applied. A torn last line, left by a crash in the middle of an append, is ignored,
+// since that change was never acknowledged
+func (db *DB) replayEventLog(dbStructure *DBStructure) (int, error) {
+	logPath := db.eventLogPath()
+	f, err := os.Open(logPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	replayed := 0
+	reader := bufio.NewReader(f)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("Ignoring incomplete last line %d of %s", lineNumber, logPath)
+			}
+			break
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		plaintext, _, err := decryptIfEncrypted(line, db.opts.Keys)
+		if err != nil {
+			return replayed, fmt.Errorf("%s line %d: %w", logPath, lineNumber, err)
+		}
+		event := Event{}
+		err = json.Unmarshal(plaintext, &event)
+		if err != nil {
+			return replayed, fmt.Errorf("%w: %s line %d: %v", ErrCorruptDatabase, logPath, lineNumber, err)
+		}
+		// Already in the database file, the log just wasn't truncated after it was written
+		if event.Seq <= dbStructure.LogSequence {
+			continue
+		}
+
+		err = dbStructure.apply(event)
+		if err != nil {
+			return replayed, fmt.Errorf("%w: %s line %d: %s event can't be applied: %v", ErrCorruptDatabase, logPath, lineNumber, event.Type, err)
+		}
+		dbStructure.LogSequence = event.Seq
+		replayed++
+	}
+	dbStructure.pendingEvents = nil
+	return replayed, nil
+}
+
+// Appends the events recorded in dbStructure to the event log and fsyncs it, giving each the next sequence number
+// If the append fails the log is cut back to where it was, so a failed change can never be replayed
+// Callers must hold db.mu for writing
+func (db *DB) appendEvents(dbStructure *DBStructure) error {
+	if len(dbStructure.pendingEvents) == 0 {
+		return nil
+	}
+	if db.eventLog == nil {
+		f, err := os.OpenFile(db.eventLogPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		db.eventLog = f
+		db.eventLogSize = info.Size()
+	}
+
+	buf := bytes.Buffer{}
+	seq := dbStructure.LogSequence
+	for _, event := range dbStructure.pendingEvents {
+		seq++
+		event.Seq = seq
+		jsonData, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		line, err := encodeDBFile(jsonData, db.opts.Keys)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	_, err := db.eventLog.Write(buf.Bytes())
+	if err == nil {
+		err = db.eventLog.Sync()
+	}
+	if err != nil {
+		if truncateErr := db.eventLog.Truncate(db.eventLogSize); truncateErr != nil {
+			log.Printf("Error cutting failed append off %s: %s", db.eventLogPath(), truncateErr)
+		}
+		return err
+	}
+
+	db.eventLogSize += int64(buf.Len())
+	db.eventLogEvents += len(dbStructure.pendingEvents)
+	dbStructure.LogSequence = seq
+	dbStructure.pendingEvents = nil
+	if db.eventLogEvents >= db.opts.CompactEvery {
+		// Compact in the background, the caller is holding the write lock
+		select {
+		case db.compactNow <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Writes dbStructure to the database file and empties the event log, since every event in it is now in the file
+// Callers must hold db.flushMu and db.mu for writing
+func (db *DB) writeSnapshot(dbStructure DBStructure) error {
+	err := db.writeDB(dbStructure)
+	if err != nil {
+		return err
+	}
+	return db.truncateEventLog()
+}
+
+// Empties the event log, if there is one. Callers must hold db.mu for writing
+func (db *DB) truncateEventLog() error {
+	err := os.Truncate(db.eventLogPath(), 0)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	db.eventLogSize = 0
+	db.eventLogEvents = 0
+	return nil
+}
+
+// Writes the in-memory database to the database file and empties the event log
+// Writes are blocked while the file is written, which is why this only happens every CompactEvery changes
+func (db *DB) compact() error {
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.eventLogEvents == 0 {
+		return nil
+	}
+	return db.writeSnapshot(db.data)
+}
+
+// Compacts the event log whenever appendEvents asks for it, until the DB is closed
+func (db *DB) compactLoop() {
+	defer db.wg.Done()
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-db.compactNow:
+			err := db.compact()
+			if err != nil {
+				log.Printf("Error compacting event log: %s", err)
+			}
+		}
+	}
+}
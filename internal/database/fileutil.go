@@ -0,0 +1,106 @@
+package database
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Writes data to path without ever leaving a partially written file behind.
+// The data goes to a temp file in the same directory, is fsynced, and is then renamed over path.
+// If path already exists, its previous contents are kept as path.bak
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	// Clean up the temp file if anything below fails. After a successful rename this is a no-op
+	defer os.Remove(tmpPath)
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmpPath, perm)
+	if err != nil {
+		return err
+	}
+
+	err = backupFile(path, path+".bak")
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Replaces bak with the current contents of path. A missing path is not an error,
+// since there is nothing to back up yet
+func backupFile(path, bak string) error {
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Hard link the current file to a temp name and rename it over the old backup,
+	// so the backup is swapped in one step and nothing has to be copied
+	bakTmp := bak + ".tmp"
+	os.Remove(bakTmp)
+	err = os.Link(path, bakTmp)
+	if err != nil {
+		// Some filesystems don't support hard links, fall back to copying
+		err = copyFile(path, bakTmp)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(bakTmp, bak)
+}
+
+// Copies src to dst and fsyncs dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Fsyncs a directory so a rename inside it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
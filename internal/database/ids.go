@@ -0,0 +1,109 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Last ID handed out for each entity. IDs are never reused, even after the entity is deleted
+type Sequences struct {
+	Chirps int `json:"chirps"`
+	Users  int `json:"users"`
+	Drafts int `json:"drafts"`
+}
+
+var ErrInvalidID = errors.New("Invalid ID")
+
+// Crockford's base32 alphabet, as used by ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Returns the next chirp ID and advances the sequence
+func (dbStructure *DBStructure) nextChirpID() int {
+	dbStructure.Sequences.Chirps++
+	return dbStructure.Sequences.Chirps
+}
+
+// Returns the next user ID and advances the sequence
+func (dbStructure *DBStructure) nextUserID() int {
+	dbStructure.Sequences.Users++
+	return dbStructure.Sequences.Users
+}
+
+// Returns the next draft ID and advances the sequence
+func (dbStructure *DBStructure) nextDraftID() int {
+	dbStructure.Sequences.Drafts++
+	return dbStructure.Sequences.Drafts
+}
+
+// Generates a ULID style opaque ID: a 48 bit millisecond timestamp followed by 80 random bits,
+// encoded as 26 characters of Crockford base32. IDs created later sort after earlier ones
+func newOpaqueID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixMilli())<<16)
+	rand.Read(b[6:])
+
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	out := make([]byte, 26)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// Reports whether id looks like an ID made by newOpaqueID
+func isOpaqueID(id string) bool {
+	if len(id) != 26 {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if (c < '0' || c > '9') && (c < 'A' || c > 'Z') || c == 'I' || c == 'L' || c == 'O' || c == 'U' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the time an ID made by newOpaqueID was created, to the millisecond
+func opaqueIDTime(id string) (time.Time, bool) {
+	if !isOpaqueID(id) {
+		return time.Time{}, false
+	}
+	// The first 10 characters hold the 48 bit timestamp, the first one only its top 3 bits
+	ms := uint64(0)
+	for _, c := range []byte(id[:10]) {
+		ms = ms<<5 | uint64(strings.IndexByte(crockford, c))
+	}
+	return time.UnixMilli(int64(ms)).UTC(), true
+}
+
+// Parses a numeric ID, or returns ok=false if ref should be treated as an opaque ID instead
+func parseNumericID(ref string) (id int, ok bool, err error) {
+	id, err = strconv.Atoi(ref)
+	if err == nil {
+		return id, true, nil
+	}
+	if isOpaqueID(ref) {
+		return 0, false, nil
+	}
+	return 0, false, ErrInvalidID
+}
+
+// Sets the sequences from the IDs already in the database
+// Databases written before the sequences existed handed out len+1 as the next ID, so a create
+// after a delete could collide with an existing chirp. Chirps are stored under their own ID,
+// so starting the sequences after the highest one in use is all that is needed
+func fillSequences(dbStructure *DBStructure) {
+	for id, user := range dbStructure.Users {
+		dbStructure.Sequences.Users = max(dbStructure.Sequences.Users, id, user.Id)
+	}
+	for id, chirp := range dbStructure.Chirps {
+		dbStructure.Sequences.Chirps = max(dbStructure.Sequences.Chirps, id, chirp.Id)
+	}
+}
@@ -0,0 +1,226 @@
+package database
+
+import (
+	"log"
+	"slices"
+	"strings"
+)
+
+// Secondary indexes over a DBStructure. They are never saved, buildIndexes recreates them from the
+// collections whenever a database is loaded, and the put and remove helpers below keep them in step
+// with every change, so every change to Users or Chirps must go through those helpers
+type indexes struct {
+	// Lower cased email to user ID. Emails are unique ignoring case
+	userIDsByEmail map[string]int
+	// Handle to the IDs of the users with it, in ascending order, see userHandle
+	userIDsByHandle map[string][]int
+	// Every chirp ID, in ascending order, so listings can page through chirps without sorting them
+	chirpIDs []int
+	// Opaque uid to chirp ID, for the chirps that have one
+	chirpIDsByUid map[string]int
+	// Author ID to the IDs of their chirps, in ascending order
+	chirpIDsByAuthor map[int][]int
+	// Chirp ID to the IDs of its direct replies, deleted ones included, in ascending order
+	replyIDs map[int][]int
+	// User ID to the IDs of the chirps they liked, in ascending order
+	likedChirpIDs map[int][]int
+	// Hashtag, and mentioned user ID, to the IDs of the chirps with it, deleted ones included, in ascending order
+	chirpIDsByTag     map[string][]int
+	chirpIDsByMention map[int][]int
+	// Lower cased word to the chirps containing it, sorted by chirp ID, for full-text search
+	// Includes deleted chirps, searches skip them
+	searchTerms map[string][]posting
+}
+
+// Returns the key an email is stored under in the email index
+func emailKey(email string) string {
+	return strings.ToLower(email)
+}
+
+// Rebuilds every index from scratch
+func (dbStructure *DBStructure) buildIndexes() {
+	dbStructure.indexes = indexes{
+		userIDsByEmail:    make(map[string]int, len(dbStructure.Users)),
+		userIDsByHandle:   map[string][]int{},
+		chirpIDsByUid:     map[string]int{},
+		chirpIDsByAuthor:  map[int][]int{},
+		replyIDs:          map[int][]int{},
+		likedChirpIDs:     map[int][]int{},
+		chirpIDsByTag:     map[string][]int{},
+		chirpIDsByMention: map[int][]int{},
+		searchTerms:       map[string][]posting{},
+	}
+
+	// Go in ID order so the oldest user wins if two emails only differ in case
+	userIDs := make([]int, 0, len(dbStructure.Users))
+	for id := range dbStructure.Users {
+		userIDs = append(userIDs, id)
+	}
+	slices.Sort(userIDs)
+	for _, id := range userIDs {
+		handle := userHandle(dbStructure.Users[id].Email)
+		dbStructure.userIDsByHandle[handle] = append(dbStructure.userIDsByHandle[handle], id)
+		key := emailKey(dbStructure.Users[id].Email)
+		if otherID, ok := dbStructure.userIDsByEmail[key]; ok {
+			log.Printf("Users %d and %d have the same email ignoring case, only user %d can log in", otherID, id, otherID)
+			continue
+		}
+		dbStructure.userIDsByEmail[key] = id
+	}
+
+	chirpIDs := make([]int, 0, len(dbStructure.Chirps))
+	for id := range dbStructure.Chirps {
+		chirpIDs = append(chirpIDs, id)
+	}
+	slices.Sort(chirpIDs)
+	dbStructure.chirpIDs = chirpIDs
+	for _, id := range chirpIDs {
+		authorID := dbStructure.Chirps[id].AuthorId
+		if uid := dbStructure.Chirps[id].Uid; uid != "" {
+			dbStructure.chirpIDsByUid[uid] = id
+		}
+		dbStructure.chirpIDsByAuthor[authorID] = append(dbStructure.chirpIDsByAuthor[authorID], id)
+		if parentID := dbStructure.Chirps[id].InReplyTo; parentID != 0 {
+			dbStructure.replyIDs[parentID] = append(dbStructure.replyIDs[parentID], id)
+		}
+		for _, tag := range dbStructure.Chirps[id].tags() {
+			dbStructure.chirpIDsByTag[tag] = append(dbStructure.chirpIDsByTag[tag], id)
+		}
+		for _, userID := range dbStructure.Chirps[id].mentionedUserIDs() {
+			dbStructure.chirpIDsByMention[userID] = append(dbStructure.chirpIDsByMention[userID], id)
+		}
+		for userID := range dbStructure.Likes[id] {
+			dbStructure.likedChirpIDs[userID] = append(dbStructure.likedChirpIDs[userID], id)
+		}
+		// Going in ID order means postings can simply be appended
+		for term, positions := range termPositions(dbStructure.Chirps[id].Body) {
+			dbStructure.searchTerms[term] = append(dbStructure.searchTerms[term], posting{chirpID: id, positions: positions})
+		}
+	}
+}
+
+// Adds or replaces a user. Returns ErrUserTaken if another user already has the email, ignoring case
+func (dbStructure *DBStructure) putUser(user User) error {
+	if otherID, ok := dbStructure.userIDsByEmail[emailKey(user.Email)]; ok && otherID != user.Id {
+		return ErrUserTaken
+	}
+
+	old, ok := dbStructure.Users[user.Id]
+	dbStructure.onRollback(func() {
+		dbStructure.unindexUser(user)
+		delete(dbStructure.Users, user.Id)
+		if ok {
+			dbStructure.Users[old.Id] = old
+			dbStructure.indexUser(old)
+		}
+	})
+	if ok {
+		dbStructure.unindexUser(old)
+	}
+	dbStructure.Users[user.Id] = user
+	dbStructure.indexUser(user)
+	return nil
+}
+
+// Adds a user to the email and handle indexes. An email that another user already has, ignoring case, stays theirs
+func (dbStructure *DBStructure) indexUser(user User) {
+	handle := userHandle(user.Email)
+	dbStructure.userIDsByHandle[handle] = insertID(dbStructure.userIDsByHandle[handle], user.Id)
+	if _, ok := dbStructure.userIDsByEmail[emailKey(user.Email)]; !ok {
+		dbStructure.userIDsByEmail[emailKey(user.Email)] = user.Id
+	}
+}
+
+// Takes a user back out of the email and handle indexes
+func (dbStructure *DBStructure) unindexUser(user User) {
+	if dbStructure.userIDsByEmail[emailKey(user.Email)] == user.Id {
+		delete(dbStructure.userIDsByEmail, emailKey(user.Email))
+	}
+	removeIndexedID(dbStructure.userIDsByHandle, userHandle(user.Email), user.Id)
+}
+
+// Adds or replaces a chirp
+func (dbStructure *DBStructure) putChirp(chirp Chirp) {
+	old, ok := dbStructure.Chirps[chirp.Id]
+	dbStructure.onRollback(func() {
+		if ok {
+			dbStructure.putChirp(old)
+		} else {
+			dbStructure.removeChirp(chirp.Id)
+		}
+	})
+	if ok {
+		if old.Body != chirp.Body {
+			dbStructure.unindexChirp(old)
+			dbStructure.indexChirp(chirp)
+			dbStructure.unindexEntities(old)
+			dbStructure.indexEntities(chirp)
+		}
+		if old.AuthorId == chirp.AuthorId {
+			dbStructure.Chirps[chirp.Id] = chirp
+			return
+		}
+		dbStructure.removeChirpFromAuthor(old)
+	} else {
+		dbStructure.chirpIDs = insertID(dbStructure.chirpIDs, chirp.Id)
+		if chirp.Uid != "" {
+			dbStructure.chirpIDsByUid[chirp.Uid] = chirp.Id
+		}
+		dbStructure.indexChirp(chirp)
+		dbStructure.indexEntities(chirp)
+		if chirp.InReplyTo != 0 {
+			dbStructure.replyIDs[chirp.InReplyTo] = insertID(dbStructure.replyIDs[chirp.InReplyTo], chirp.Id)
+		}
+	}
+	dbStructure.Chirps[chirp.Id] = chirp
+	dbStructure.chirpIDsByAuthor[chirp.AuthorId] = insertID(dbStructure.chirpIDsByAuthor[chirp.AuthorId], chirp.Id)
+}
+
+// Returns the sorted ids with id inserted in order. New chirps and users have the highest ID,
+// so this is usually an append
+func insertID(ids []int, id int) []int {
+	if len(ids) == 0 || id > ids[len(ids)-1] {
+		return append(ids, id)
+	}
+	i, _ := slices.BinarySearch(ids, id)
+	return slices.Insert(ids, i, id)
+}
+
+// Deletes a chirp, if it exists
+func (dbStructure *DBStructure) removeChirp(chirpID int) {
+	chirp, ok := dbStructure.Chirps[chirpID]
+	if !ok {
+		return
+	}
+	dbStructure.onRollback(func() { dbStructure.putChirp(chirp) })
+	delete(dbStructure.Chirps, chirpID)
+	if i, found := slices.BinarySearch(dbStructure.chirpIDs, chirpID); found {
+		dbStructure.chirpIDs = slices.Delete(dbStructure.chirpIDs, i, i+1)
+	}
+	delete(dbStructure.chirpIDsByUid, chirp.Uid)
+	dbStructure.removeChirpFromAuthor(chirp)
+	dbStructure.unindexChirp(chirp)
+	dbStructure.unindexEntities(chirp)
+	if replies := dbStructure.replyIDs[chirp.InReplyTo]; chirp.InReplyTo != 0 {
+		if i, found := slices.BinarySearch(replies, chirp.Id); found {
+			dbStructure.replyIDs[chirp.InReplyTo] = slices.Delete(replies, i, i+1)
+		}
+		if len(dbStructure.replyIDs[chirp.InReplyTo]) == 0 {
+			delete(dbStructure.replyIDs, chirp.InReplyTo)
+		}
+	}
+}
+
+// Takes a chirp out of its author's index entry
+func (dbStructure *DBStructure) removeChirpFromAuthor(chirp Chirp) {
+	authorChirps := dbStructure.chirpIDsByAuthor[chirp.AuthorId]
+	i, found := slices.BinarySearch(authorChirps, chirp.Id)
+	if !found {
+		return
+	}
+	if len(authorChirps) == 1 {
+		delete(dbStructure.chirpIDsByAuthor, chirp.AuthorId)
+		return
+	}
+	dbStructure.chirpIDsByAuthor[chirp.AuthorId] = slices.Delete(authorChirps, i, i+1)
+}
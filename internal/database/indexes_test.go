@@ -0,0 +1,108 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Database sizes the index benchmarks run at. With the indexes, the time per lookup shouldn't grow with them
+var benchmarkSizes = []int{1_000, 10_000, 100_000}
+
+// Opens a database with users users, and chirps chirps spread over them round robin
+// Every user's password is "password", hashed at bcrypt's lowest cost so logins aren't all hashing
+func seedBenchmarkDB(b *testing.B, users, chirps int) *DB {
+	b.Helper()
+	db, err := NewDBConnection(filepath.Join(b.TempDir(), "database.json"), Options{FlushPolicy: FlushOnShutdown})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = db.Update(func(dbStructure *DBStructure) error {
+		now := timestamp()
+		for range users {
+			user := User{Id: dbStructure.nextUserID(), Password: string(hash), CreatedAt: now, UpdatedAt: now}
+			user.Email = fmt.Sprintf("user%d@example.com", user.Id)
+			err := dbStructure.apply(Event{Type: EventUserCreated, User: &user})
+			if err != nil {
+				return err
+			}
+		}
+		for i := range chirps {
+			chirp := Chirp{Id: dbStructure.nextChirpID(), Body: "Hello there", AuthorId: i%users + 1, CreatedAt: now, UpdatedAt: now}
+			err := dbStructure.apply(Event{Type: EventChirpCreated, Chirp: &chirp})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+// Logging in looks the user up in the email index, so it takes as long with 100 000 users as with 1 000
+func BenchmarkLoginUser(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("users=%d", size), func(b *testing.B) {
+			db := seedBenchmarkDB(b, size, 0)
+			email := fmt.Sprintf("USER%d@example.com", size/2)
+			b.ResetTimer()
+			for range b.N {
+				_, err := db.LoginUser(email, "password")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// An author's timeline walks their entry in the author index, so it costs the number of chirps they have,
+// 20 here, however many chirps there are in total
+func BenchmarkGetChirpsByAuthor(b *testing.B) {
+	const authorChirps = 20
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("chirps=%d", size), func(b *testing.B) {
+			db := seedBenchmarkDB(b, size/authorChirps, size)
+			b.ResetTimer()
+			for range b.N {
+				chirps, err := db.GetChirps(ChirpQuery{AuthorID: 1})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(chirps) != authorChirps {
+					b.Fatalf("expected %d chirps, got %d", authorChirps, len(chirps))
+				}
+			}
+		})
+	}
+}
+
+func TestInsertID(t *testing.T) {
+	tests := []struct {
+		ids      []int
+		id       int
+		expected []int
+	}{
+		{nil, 1, []int{1}},
+		{[]int{1, 2}, 3, []int{1, 2, 3}},
+		{[]int{1, 3}, 2, []int{1, 2, 3}},
+		{[]int{2, 3}, 1, []int{1, 2, 3}},
+	}
+	for _, test := range tests {
+		got := insertID(test.ids, test.id)
+		if fmt.Sprint(got) != fmt.Sprint(test.expected) {
+			t.Errorf("insertID(%v, %d) = %v, expected %v", test.ids, test.id, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"slices"
+	"time"
+)
+
+// Records that a user likes a chirp and updates its like count. Liking a chirp twice changes nothing
+func (dbStructure *DBStructure) putLike(chirpID, userID int, likedAt time.Time) {
+	if _, ok := dbStructure.Likes[chirpID][userID]; ok {
+		return
+	}
+	dbStructure.addLike(chirpID, userID, likedAt)
+	dbStructure.setLikeCount(chirpID)
+}
+
+// Takes back a user's like of a chirp and updates its like count, if they liked it
+func (dbStructure *DBStructure) removeLike(chirpID, userID int) {
+	if _, ok := dbStructure.Likes[chirpID][userID]; !ok {
+		return
+	}
+	dbStructure.deleteLike(chirpID, userID)
+	dbStructure.setLikeCount(chirpID)
+}
+
+// Drops every like of a chirp that is being purged. Its like count is left to the caller
+func (dbStructure *DBStructure) removeLikes(chirpID int) {
+	for userID := range dbStructure.Likes[chirpID] {
+		dbStructure.deleteLike(chirpID, userID)
+	}
+}
+
+// Adds a like and indexes it, leaving the like count alone
+func (dbStructure *DBStructure) addLike(chirpID, userID int, likedAt time.Time) {
+	likes := dbStructure.Likes[chirpID]
+	if likes == nil {
+		likes = map[int]time.Time{}
+		dbStructure.Likes[chirpID] = likes
+	}
+	likes[userID] = likedAt
+	dbStructure.likedChirpIDs[userID] = insertID(dbStructure.likedChirpIDs[userID], chirpID)
+	dbStructure.onRollback(func() { dbStructure.deleteLike(chirpID, userID) })
+}
+
+// Deletes a like and takes it out of the index, leaving the like count alone
+func (dbStructure *DBStructure) deleteLike(chirpID, userID int) {
+	likedAt, ok := dbStructure.Likes[chirpID][userID]
+	if !ok {
+		return
+	}
+	delete(dbStructure.Likes[chirpID], userID)
+	if len(dbStructure.Likes[chirpID]) == 0 {
+		delete(dbStructure.Likes, chirpID)
+	}
+	dbStructure.removeLikedChirpID(userID, chirpID)
+	dbStructure.onRollback(func() { dbStructure.addLike(chirpID, userID, likedAt) })
+}
+
+// Takes a chirp out of a user's liked chirps index entry
+func (dbStructure *DBStructure) removeLikedChirpID(userID, chirpID int) {
+	liked := dbStructure.likedChirpIDs[userID]
+	i, found := slices.BinarySearch(liked, chirpID)
+	if !found {
+		return
+	}
+	if len(liked) == 1 {
+		delete(dbStructure.likedChirpIDs, userID)
+		return
+	}
+	dbStructure.likedChirpIDs[userID] = slices.Delete(liked, i, i+1)
+}
+
+func (dbStructure *DBStructure) setLikeCount(chirpID int) {
+	chirp := dbStructure.Chirps[chirpID]
+	chirp.LikeCount = len(dbStructure.Likes[chirpID])
+	dbStructure.putChirp(chirp)
+}
+
+// Likes a chirp as the user. Liking a chirp that is already liked does nothing, so retries are safe
+// Returns the chirp with its new like count
+func (db *DB) LikeChirp(chirpID, userID int) (Chirp, error) {
+	return db.changeLike(EventChirpLiked, chirpID, userID)
+}
+
+// Takes back the user's like of a chirp. Unliking a chirp that isn't liked does nothing
+// Returns the chirp with its new like count
+func (db *DB) UnlikeChirp(chirpID, userID int) (Chirp, error) {
+	return db.changeLike(EventChirpUnliked, chirpID, userID)
+}
+
+// Applies a like or unlike event, skipping it when it wouldn't change anything
+// The check and the change happen in one transaction, so concurrent likes can't lose counts
+func (db *DB) changeLike(eventType string, chirpID, userID int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		found, ok := dbStructure.Chirps[chirpID]
+		if !ok || found.deleted() {
+			return ErrChirpNotFound
+		}
+		if _, ok := dbStructure.Users[userID]; !ok {
+			return ErrUserNotFound
+		}
+		_, liked := dbStructure.Likes[chirpID][userID]
+		if liked != (eventType == EventChirpLiked) {
+			err := dbStructure.apply(Event{Type: eventType, ChirpID: chirpID, UserID: userID})
+			if err != nil {
+				return err
+			}
+		}
+		chirp = dbStructure.Chirps[chirpID]
+		liked = eventType == EventChirpLiked
+		chirp.LikedByMe = &liked
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+// Returns the chirps a user has liked, most recently liked first, leaving out deleted ones
+func (db *DB) GetLikedChirps(userID int) ([]Chirp, error) {
+	chirps := []Chirp{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[userID]; !ok {
+			return ErrUserNotFound
+		}
+		chirpIDs := slices.Clone(dbStructure.likedChirpIDs[userID])
+		// Stable, so chirps liked at the same moment stay in ID order
+		slices.SortStableFunc(chirpIDs, func(a, b int) int {
+			return dbStructure.Likes[b][userID].Compare(dbStructure.Likes[a][userID])
+		})
+		for _, chirpID := range chirpIDs {
+			if chirp := dbStructure.Chirps[chirpID]; !chirp.deleted() {
+				chirps = append(chirps, dbStructure.expand(chirp, 0))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chirps, nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package database
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Takes an exclusive lock on the file at path, creating it if it doesn't exist, without waiting for it
+// Returns ErrDatabaseLocked if another process holds the lock. It is released when the returned file is closed,
+// or when the process exits, so a crashed server never leaves the database locked
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrDatabaseLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
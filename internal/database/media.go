@@ -0,0 +1,143 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+var ErrMediaNotFound = errors.New("Media not found")
+var ErrTooManyMedia = errors.New("Chirps can have at most 4 media attachments")
+var ErrDuplicateMedia = errors.New("Media attached more than once")
+
+// The most media a chirp can have attached
+const MaxChirpMedia = 4
+
+// An uploaded image, which its owner can attach to their chirps. The file itself is kept in a blob store
+type Media struct {
+	Id          string `json:"id"`
+	OwnerID     int    `json:"owner_id"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	// Key of the file in the blob store, and the URL it is served at
+	BlobKey string `json:"blob_key"`
+	URL     string `json:"url"`
+	// Smaller copies of the image, and a BlurHash of it for clients to show until it loads
+	Renditions  []Rendition `json:"renditions,omitempty"`
+	Placeholder string      `json:"placeholder,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// A smaller copy of an uploaded image, like its thumbnail
+type Rendition struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	BlobKey     string `json:"blob_key"`
+	URL         string `json:"url"`
+}
+
+// Saves a new media record for a file that is already in the blob store, giving it an ID
+func (db *DB) CreateMedia(media Media) (Media, error) {
+	media.Id = newOpaqueID()
+	media.CreatedAt = timestamp()
+	err := db.Update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[media.OwnerID]; !ok {
+			return ErrUserNotFound
+		}
+		created := media
+		return dbStructure.apply(Event{Type: EventMediaCreated, At: media.CreatedAt, Media: &created})
+	})
+	if err != nil {
+		return Media{}, err
+	}
+	return media, nil
+}
+
+// Saves a new media record for a file that is already in the blob store and makes it its owner's avatar
+// Both happen in one write, so a failed avatar never leaves a media record behind
+func (db *DB) CreateAvatar(media Media) (User, error) {
+	media.Id = newOpaqueID()
+	media.CreatedAt = timestamp()
+	user := User{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		found, ok := dbStructure.Users[media.OwnerID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		created := media
+		err := dbStructure.apply(Event{Type: EventMediaCreated, At: media.CreatedAt, Media: &created})
+		if err != nil {
+			return err
+		}
+		user = found
+		user.Avatar = &media
+		user.UpdatedAt = media.CreatedAt
+		updated := user
+		return dbStructure.apply(Event{Type: EventUserUpdated, User: &updated})
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// Checks that the media IDs can be attached to one chirp
+func checkMediaIDs(mediaIDs []string) error {
+	if len(mediaIDs) > MaxChirpMedia {
+		return ErrTooManyMedia
+	}
+	for i, id := range mediaIDs {
+		if slices.Contains(mediaIDs[:i], id) {
+			return ErrDuplicateMedia
+		}
+	}
+	return nil
+}
+
+// Returns the media to attach to a new chirp by ownerID. Only the owner of a media can attach it
+func (dbStructure *DBStructure) attachableMedia(mediaIDs []string, ownerID int) ([]Media, error) {
+	var attached []Media
+	for _, id := range mediaIDs {
+		media, ok := dbStructure.Media[id]
+		if !ok || media.OwnerID != ownerID {
+			return nil, ErrMediaNotFound
+		}
+		attached = append(attached, media)
+	}
+	return attached, nil
+}
+
+// Returns the IDs of media uploaded before uploadedBefore that no chirp, draft or avatar refers to, sorted
+// Chirps in the trash still count, they can be restored with their media
+func (dbStructure *DBStructure) unusedMedia(uploadedBefore time.Time) []string {
+	used := map[string]bool{}
+	for _, chirp := range dbStructure.Chirps {
+		for _, media := range chirp.Media {
+			used[media.Id] = true
+		}
+	}
+	for _, draft := range dbStructure.Drafts {
+		for _, mediaID := range draft.MediaIDs {
+			used[mediaID] = true
+		}
+	}
+	for _, user := range dbStructure.Users {
+		if user.Avatar != nil {
+			used[user.Avatar.Id] = true
+		}
+	}
+
+	unused := []string{}
+	for mediaID, media := range dbStructure.Media {
+		if !used[mediaID] && media.CreatedAt.Before(uploadedBefore) {
+			unused = append(unused, mediaID)
+		}
+	}
+	slices.Sort(unused)
+	return unused
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Describes a single schema migration
+type MigrationInfo struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+}
+
+// Result of a Migrate call. With DryRun set, Applied lists the migrations that would have run
+type MigrationReport struct {
+	FromVersion int
+	ToVersion   int
+	Applied     []MigrationInfo
+	DryRun      bool
+}
+
+var ErrSchemaTooNew = errors.New("Database schema is newer than this version of chirpy supports")
+
+// A migration of the JSON database, run against the whole DBStructure
+type jsonMigration struct {
+	MigrationInfo
+	migrate func(dbStructure *DBStructure) error
+}
+
+// Every JSON database migration, in the order they run. Versions must be consecutive starting at 1
+// Never change or remove a migration once it has shipped, add a new one instead
+// A feature that only adds new fields still gets a migration, even with no existing data to convert, with
+// bumpVersion as its migrate. Older builds drop fields they don't know about on their next write, and the
+// version bump is what stops them opening the database
+var jsonMigrations = []jsonMigration{
+	{
+		MigrationInfo: MigrationInfo{Version: 1, Name: "Add ID sequences"},
+		migrate: func(dbStructure *DBStructure) error {
+			fillSequences(dbStructure)
+			return nil
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 2, Name: "Store revoked refresh tokens by hash, with their expiry"},
+		migrate: func(dbStructure *DBStructure) error {
+			for token, revokedAt := range dbStructure.LegacyRevokedTokens {
+				dbStructure.RevokedTokens[tokenKey(token)] = RevokedToken{
+					RevokedAt: revokedAt,
+					ExpiresAt: tokenExpiry(token, revokedAt.Add(refreshTokenLifetime)),
+				}
+			}
+			dbStructure.LegacyRevokedTokens = nil
+			return nil
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 3, Name: "Backfill created and updated timestamps on chirps and users"},
+		migrate: func(dbStructure *DBStructure) error {
+			backfilledAt := timestamp()
+			for id, chirp := range dbStructure.Chirps {
+				if chirp.CreatedAt.IsZero() {
+					chirp.CreatedAt = backfillCreatedAt(chirp.Uid, backfilledAt)
+					chirp.UpdatedAt = chirp.CreatedAt
+					dbStructure.Chirps[id] = chirp
+				}
+			}
+			for id, user := range dbStructure.Users {
+				if user.CreatedAt.IsZero() {
+					user.CreatedAt = backfillCreatedAt(user.Uid, backfilledAt)
+					user.UpdatedAt = user.CreatedAt
+					dbStructure.Users[id] = user
+				}
+			}
+			return nil
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 4, Name: "Soft delete chirps into a trash"},
+		// Older builds would also show deleted chirps to everyone
+		migrate: bumpVersion,
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 5, Name: "Keep the earlier bodies of edited chirps"},
+		migrate:       bumpVersion,
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 6, Name: "Add replies and tombstones for deleted parents"},
+		migrate:       bumpVersion,
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 7, Name: "Add likes"},
+		migrate:       bumpVersion,
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 8, Name: "Add rechirps and quote-chirps"},
+		// Older builds would also turn rechirps into empty chirps
+		migrate: bumpVersion,
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 9, Name: "Find hashtags, mentions and URLs in existing chirps"},
+		migrate: func(dbStructure *DBStructure) error {
+			// Mentions resolve to whoever has the handle now, which is as close to posting time as it gets
+			for id, chirp := range dbStructure.Chirps {
+				if chirp.Body != "" {
+					chirp.Entities = dbStructure.findEntities(chirp.Body)
+					dbStructure.Chirps[id] = chirp
+				}
+			}
+			return nil
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 10, Name: "Add media attachments"},
+		migrate:       bumpVersion,
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 11, Name: "Add image renditions and avatars"},
+		// Media uploaded before this has no renditions
+		migrate: bumpVersion,
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 12, Name: "Add polls"},
+		// loadDB makes the empty poll_votes map
+		migrate: bumpVersion,
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 13, Name: "Add drafts and scheduled chirps"},
+		// Older builds would also never publish the scheduled drafts
+		migrate: bumpVersion,
+	},
+}
+
+// The migrate of a migration that has nothing to convert, see jsonMigrations
+func bumpVersion(dbStructure *DBStructure) error {
+	return nil
+}
+
+// Returns the best guess at when a record created before timestamps existed was created:
+// the time in its opaque uid if it has one, or else fallback
+func backfillCreatedAt(uid string, fallback time.Time) time.Time {
+	if createdAt, ok := opaqueIDTime(uid); ok {
+		return createdAt
+	}
+	return fallback
+}
+
+// The schema version a newly created JSON database starts at
+func latestJSONSchemaVersion() int {
+	return jsonMigrations[len(jsonMigrations)-1].Version
+}
+
+// Returns an error if a database at version can't be opened safely by this build
+func checkSchemaVersion(version, latest int) error {
+	if version > latest {
+		return fmt.Errorf("%w: database is at version %d, the latest known version is %d", ErrSchemaTooNew, version, latest)
+	}
+	return nil
+}
+
+// Runs every migration newer than dbStructure.SchemaVersion, in order, bumping the version after each
+// Returns the migrations that ran. On error, dbStructure is left part way through and should be thrown away
+func migrateDBStructure(dbStructure *DBStructure) ([]MigrationInfo, error) {
+	applied := []MigrationInfo{}
+	for _, migration := range jsonMigrations {
+		if migration.Version <= dbStructure.SchemaVersion {
+			continue
+		}
+		err := migration.migrate(dbStructure)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+		dbStructure.SchemaVersion = migration.Version
+		applied = append(applied, migration.MigrationInfo)
+	}
+
+	// Migrations work on the collections directly, so the indexes have to catch up afterwards
+	if len(applied) > 0 {
+		dbStructure.buildIndexes()
+	}
+	return applied, nil
+}
+
+// Runs any pending migrations against the database. With dryRun, the migrations run against a copy
+// so failures are still reported, but nothing is saved. A read only database can only be dry run
+func (db *DB) Migrate(dryRun bool) (MigrationReport, error) {
+	if db.opts.ReadOnly && !dryRun {
+		return MigrationReport{}, ErrReadOnly
+	}
+	// Take the flush lock too, so a background flush can't overwrite the migrated file with older data
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	dbStructure := db.data.clone()
+	report := MigrationReport{FromVersion: dbStructure.SchemaVersion, DryRun: dryRun}
+	applied, err := migrateDBStructure(&dbStructure)
+	report.Applied = applied
+	report.ToVersion = dbStructure.SchemaVersion
+	if err != nil || dryRun || len(applied) == 0 {
+		return report, err
+	}
+
+	// Migrations are always written straight away, whatever the flush policy
+	// The version before the migration is kept as the .bak file
+	err = db.writeSnapshot(dbStructure)
+	if err != nil {
+		return report, err
+	}
+	db.data = dbStructure
+	db.unflushed = 0
+	return report, nil
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// FlushPolicy controls when the JSON database writes its in-memory state to disk
+type FlushPolicy int
+
+const (
+	// Write the file before every change is acknowledged. Slowest, but nothing is ever lost
+	FlushSync FlushPolicy = iota
+	// Write pending changes every FlushInterval. A crash loses at most one interval of changes
+	FlushBatched
+	// Only write the file when the database is closed on shutdown
+	FlushOnShutdown
+	// Append every change to an event log next to the file before it is acknowledged, and only rewrite
+	// the file when the log is compacted, in the background every CompactEvery changes. Acknowledging a write
+	// costs the size of the change instead of the whole database
+	FlushLog
+)
+
+const DefaultFlushInterval = 1000 * time.Millisecond
+
+// How long deleted chirps can be restored from the trash before they are purged
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// How long an upload that no chirp, draft or avatar refers to is kept before it is deleted
+const DefaultMediaRetention = 24 * time.Hour
+
+// How long after posting a chirp its author can edit it, unless they are a Chirpy Red member
+const DefaultEditWindow = 15 * time.Minute
+
+// With FlushLog, how many changes the event log collects before it is compacted into the database file
+const DefaultCompactEvery = 1000
+
+var ErrUnknownFlushPolicy = errors.New("Unknown flush policy")
+
+// Options for the JSON file database. The zero value writes synchronously and only uses numeric IDs
+type Options struct {
+	FlushPolicy   FlushPolicy
+	FlushInterval time.Duration
+	CompactEvery  int
+	// Give new chirps and users an opaque ULID style uid next to their numeric ID
+	// This one also applies to the SQLite database
+	OpaqueIDs bool
+	// Don't run pending schema migrations when the database is opened. Only the migrate command
+	// should set this, the rest of the package expects the latest schema. Applies to both backends
+	ManualMigrations bool
+	// Only read the database, along with its event log, so it can be opened while the server is running
+	// Every write returns ErrReadOnly. Without this the database is locked for the process that opens it,
+	// and opening it fails with ErrDatabaseLocked while another process has it open. Applies to both backends,
+	// though SQLite only skips the lock, it keeps readers and writers in other processes consistent itself
+	ReadOnly bool
+	// How long deleted chirps stay restorable. Applies to both backends
+	TrashRetention time.Duration
+	// How long uploads that nothing refers to are kept, so they can still be attached. They are deleted
+	// along with purged chirps. Applies to both backends
+	MediaRetention time.Duration
+	// How long after posting a chirp its author can edit it. Chirpy Red members can edit their chirps
+	// at any time. Applies to both backends
+	EditWindow time.Duration
+	// Encrypt the JSON database file with these keys. nil leaves it unencrypted
+	// Files encrypted with any key in the keyring can be read, new writes always use the primary key
+	Keys *Keyring
+}
+
+// Parses a flush policy name as used by the DB_FLUSH environment variable
+// An empty string is the default, FlushSync
+func ParseFlushPolicy(policy string) (FlushPolicy, error) {
+	switch policy {
+	case "", "sync":
+		return FlushSync, nil
+	case "batched":
+		return FlushBatched, nil
+	case "shutdown":
+		return FlushOnShutdown, nil
+	case "log":
+		return FlushLog, nil
+	default:
+		return FlushSync, ErrUnknownFlushPolicy
+	}
+}
@@ -0,0 +1,213 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rivo/uniseg"
+)
+
+// Limits on the polls chirps can carry
+const (
+	MinPollOptions      = 2
+	MaxPollOptions      = 4
+	MaxPollOptionLength = 25
+	MinPollDuration     = 5 * time.Minute
+	MaxPollDuration     = 7 * 24 * time.Hour
+)
+
+var ErrPollOptionCount = fmt.Errorf("Polls need %d to %d options", MinPollOptions, MaxPollOptions)
+var ErrPollOptionLength = fmt.Errorf("Poll options can't be empty or longer than %d characters", MaxPollOptionLength)
+var ErrDuplicatePollOption = errors.New("Poll options have to be different")
+var ErrPollClosingTime = errors.New("Polls have to close between 5 minutes and 7 days from now")
+var ErrNoPoll = errors.New("Chirp has no poll")
+var ErrPollClosed = errors.New("Poll is closed")
+var ErrAlreadyVoted = errors.New("Already voted in this poll")
+var ErrInvalidVote = errors.New("Expected one option, or for a multiple choice poll one or more different options")
+
+// A poll carried by a chirp. Its options, closing time and choice are fixed once the chirp is posted
+type Poll struct {
+	Options []string `json:"options"`
+	// Whether voters can pick more than one option
+	MultipleChoice bool      `json:"multiple_choice"`
+	ClosesAt       time.Time `json:"closes_at"`
+	// The rest is filled in when chirps are read, never stored
+	Closed bool `json:"closed,omitempty"`
+	// Only shown to viewers who have voted, or to everyone once the poll is closed
+	Results *PollResults `json:"results,omitempty"`
+	// Indexes of the options the viewer voted for, if they have voted
+	MyVotes []int `json:"my_votes,omitempty"`
+}
+
+type PollResults struct {
+	// Votes for each option, in the order of the options
+	Votes []int `json:"votes"`
+	// How many users voted. With multiple choice each of them can have voted for more than one option
+	VoterCount int `json:"voter_count"`
+}
+
+// A user's vote in a poll: the indexes of the options they picked, in order
+type PollVote struct {
+	Options []int     `json:"options"`
+	VotedAt time.Time `json:"voted_at"`
+}
+
+// Checks the options and closing time of a new poll, relative to now
+func (poll Poll) check(now time.Time) error {
+	if len(poll.Options) < MinPollOptions || len(poll.Options) > MaxPollOptions {
+		return ErrPollOptionCount
+	}
+	for i, option := range poll.Options {
+		if strings.TrimSpace(option) == "" || uniseg.GraphemeClusterCount(option) > MaxPollOptionLength {
+			return ErrPollOptionLength
+		}
+		for _, earlier := range poll.Options[:i] {
+			if strings.EqualFold(strings.TrimSpace(earlier), strings.TrimSpace(option)) {
+				return ErrDuplicatePollOption
+			}
+		}
+	}
+	if poll.ClosesAt.Before(now.Add(MinPollDuration)) || poll.ClosesAt.After(now.Add(MaxPollDuration)) {
+		return ErrPollClosingTime
+	}
+	return nil
+}
+
+// Returns the poll as it is stored with a new chirp: trimmed options and a UTC closing time
+func (poll Poll) stored() *Poll {
+	options := make([]string, len(poll.Options))
+	for i, option := range poll.Options {
+		options[i] = strings.TrimSpace(option)
+	}
+	return &Poll{Options: options, MultipleChoice: poll.MultipleChoice, ClosesAt: poll.ClosesAt.UTC()}
+}
+
+// Checks a vote's option indexes against the poll, and returns them sorted
+func (poll Poll) checkVote(options []int) ([]int, error) {
+	if len(options) == 0 || (!poll.MultipleChoice && len(options) > 1) {
+		return nil, ErrInvalidVote
+	}
+	sorted := slices.Clone(options)
+	slices.Sort(sorted)
+	for i, option := range sorted {
+		if option < 0 || option >= len(poll.Options) || (i > 0 && sorted[i-1] == option) {
+			return nil, ErrInvalidVote
+		}
+	}
+	return sorted, nil
+}
+
+func (poll Poll) closed(now time.Time) bool {
+	return !now.Before(poll.ClosesAt)
+}
+
+// Returns a copy of the poll as a viewer sees it at now, given the results and the viewer's own vote
+// The results are left out until the viewer has voted or the poll has closed
+func (poll Poll) view(results PollResults, myVote *PollVote, now time.Time) *Poll {
+	viewed := Poll{Options: poll.Options, MultipleChoice: poll.MultipleChoice, ClosesAt: poll.ClosesAt, Closed: poll.closed(now)}
+	if myVote != nil {
+		viewed.MyVotes = myVote.Options
+	}
+	if viewed.Closed || myVote != nil {
+		viewed.Results = &results
+	}
+	return &viewed
+}
+
+// Counts the votes in a poll
+func (dbStructure *DBStructure) pollResults(chirpID int, poll Poll) PollResults {
+	results := PollResults{Votes: make([]int, len(poll.Options))}
+	for _, vote := range dbStructure.PollVotes[chirpID] {
+		for _, option := range vote.Options {
+			results.Votes[option]++
+		}
+		results.VoterCount++
+	}
+	return results
+}
+
+// Returns the chirp's poll as viewerID sees it at now, or nil if it doesn't have one
+// viewerID is 0 for someone who isn't logged in
+func (dbStructure *DBStructure) pollView(chirp Chirp, viewerID int, now time.Time) *Poll {
+	if chirp.Poll == nil {
+		return nil
+	}
+	var myVote *PollVote
+	if vote, ok := dbStructure.PollVotes[chirp.Id][viewerID]; ok && viewerID != 0 {
+		myVote = &vote
+	}
+	return chirp.Poll.view(dbStructure.pollResults(chirp.Id, *chirp.Poll), myVote, now)
+}
+
+// Records a user's vote. Each user votes once, so a second vote fails with ErrAlreadyVoted
+func (dbStructure *DBStructure) putPollVote(chirpID, userID int, vote PollVote) error {
+	if _, ok := dbStructure.PollVotes[chirpID][userID]; ok {
+		return ErrAlreadyVoted
+	}
+	votes := dbStructure.PollVotes[chirpID]
+	if votes == nil {
+		votes = map[int]PollVote{}
+		putEntry(dbStructure, dbStructure.PollVotes, chirpID, votes)
+	}
+	putEntry(dbStructure, votes, userID, vote)
+	return nil
+}
+
+// Votes in a chirp's poll as the user, for the options at the given indexes
+// Returns the poll with its results, which the user can see now that they have voted
+func (db *DB) VotePoll(chirpID, userID int, options []int) (Poll, error) {
+	poll := &Poll{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		chirp, ok := dbStructure.Chirps[chirpID]
+		if !ok || chirp.deleted() {
+			return ErrChirpNotFound
+		}
+		if chirp.Poll == nil {
+			return ErrNoPoll
+		}
+		if _, ok := dbStructure.Users[userID]; !ok {
+			return ErrUserNotFound
+		}
+		now := timestamp()
+		if chirp.Poll.closed(now) {
+			return ErrPollClosed
+		}
+		options, err := chirp.Poll.checkVote(options)
+		if err != nil {
+			return err
+		}
+		err = dbStructure.apply(Event{Type: EventPollVoted, At: now, ChirpID: chirpID, UserID: userID, Options: options})
+		if err != nil {
+			return err
+		}
+		poll = dbStructure.pollView(chirp, userID, now)
+		return nil
+	})
+	if err != nil {
+		return Poll{}, err
+	}
+	return *poll, nil
+}
+
+// Returns a chirp's poll as viewerID sees it. viewerID is 0 for someone who isn't logged in
+func (db *DB) GetPoll(chirpID, viewerID int) (Poll, error) {
+	poll := &Poll{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		chirp, ok := dbStructure.Chirps[chirpID]
+		if !ok || chirp.deleted() {
+			return ErrChirpNotFound
+		}
+		if chirp.Poll == nil {
+			return ErrNoPoll
+		}
+		poll = dbStructure.pollView(chirp, viewerID, timestamp())
+		return nil
+	})
+	if err != nil {
+		return Poll{}, err
+	}
+	return *poll, nil
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"slices"
+	"time"
+)
+
+// Filters, order and page of a chirp listing. The zero value lists every chirp, oldest first
+type ChirpQuery struct {
+	// Only chirps by this author, if not 0
+	AuthorID int
+	// Only chirps with this hashtag, lower cased and without the #, if not ""
+	Tag string
+	// Only chirps that mention this user, if not 0
+	MentionedUserID int
+	// Set liked_by_me on each chirp for this user, if not 0
+	ViewerID int
+	// Only chirps created at or after Since, and before Until, when they are set
+	Since time.Time
+	Until time.Time
+	// Newest first instead of oldest first
+	Descending bool
+	// Only chirps that come after this ID in the listing's order, if not 0. Paging by ID instead of by
+	// offset keeps pages stable while chirps are created and deleted
+	AfterID int
+	// At most this many chirps, if not 0
+	Limit int
+}
+
+// Reports whether a chirp passes the query's filters
+func (query ChirpQuery) matches(chirp Chirp) bool {
+	if query.AuthorID != 0 && chirp.AuthorId != query.AuthorID {
+		return false
+	}
+	if query.Tag != "" && !slices.Contains(chirp.tags(), query.Tag) {
+		return false
+	}
+	if query.MentionedUserID != 0 && !slices.Contains(chirp.mentionedUserIDs(), query.MentionedUserID) {
+		return false
+	}
+	if !query.Since.IsZero() && chirp.CreatedAt.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !chirp.CreatedAt.Before(query.Until) {
+		return false
+	}
+	return true
+}
+
+// Walks the ascending chirpIDs in the query's order, starting after AfterID, and returns up to Limit
+// chirps that lookup finds and that match the query
+func (query ChirpQuery) page(chirpIDs []int, lookup func(chirpID int) (Chirp, bool)) []Chirp {
+	capacity := len(chirpIDs)
+	if query.Limit > 0 {
+		capacity = min(capacity, query.Limit)
+	}
+	chirps := make([]Chirp, 0, capacity)
+
+	// Index of the first ID to look at, and the step towards the end of the listing
+	i, step := 0, 1
+	if query.Descending {
+		i, step = len(chirpIDs)-1, -1
+	}
+	if query.AfterID != 0 {
+		pos, found := slices.BinarySearch(chirpIDs, query.AfterID)
+		if query.Descending {
+			i = pos - 1
+		} else if found {
+			i = pos + 1
+		} else {
+			i = pos
+		}
+	}
+
+	for ; i >= 0 && i < len(chirpIDs); i += step {
+		if query.Limit > 0 && len(chirps) == query.Limit {
+			break
+		}
+		chirp, ok := lookup(chirpIDs[i])
+		if ok && query.matches(chirp) {
+			chirps = append(chirps, chirp)
+		}
+	}
+	return chirps
+}
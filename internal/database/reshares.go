@@ -0,0 +1,99 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrOriginalNotFound = errors.New("Chirp being reshared not found")
+var ErrInvalidRechirp = errors.New("Rechirps can't have a body, media or a poll, and can't be replies or quotes")
+var ErrEmptyQuote = errors.New("Quote-chirps need a body")
+var ErrAlreadyRechirped = errors.New("Chirp already rechirped")
+
+// Optional links from a new chirp to other chirps. Each is a chirp ID, or 0 for none
+type ChirpParams struct {
+	// The chirp this one replies to
+	InReplyTo int
+	// The chirp this one reshares as is. Rechirps have no body of their own
+	RechirpOf int
+	// The chirp this one quotes, under a body of its own
+	QuoteOf int
+	// IDs of media to attach, which the author has to have uploaded. At most MaxChirpMedia
+	MediaIDs []string
+	// A poll for the chirp to carry, if not nil. Only its options, choice and closing time are used
+	Poll *Poll
+}
+
+// Checks that the links make sense together with the body, for a chirp posted at now
+func (params ChirpParams) check(body string, now time.Time) error {
+	if params.RechirpOf != 0 && (body != "" || params.InReplyTo != 0 || params.QuoteOf != 0 || len(params.MediaIDs) > 0 || params.Poll != nil) {
+		return ErrInvalidRechirp
+	}
+	if params.QuoteOf != 0 && body == "" {
+		return ErrEmptyQuote
+	}
+	if params.Poll != nil {
+		err := params.Poll.check(now)
+		if err != nil {
+			return err
+		}
+	}
+	return checkMediaIDs(params.MediaIDs)
+}
+
+// Reports whether err is one of the errors a new chirp is rejected with for its body or params,
+// rather than the database failing
+func IsInvalidChirpParams(err error) bool {
+	for _, invalid := range []error{
+		ErrParentNotFound, ErrOriginalNotFound, ErrInvalidRechirp, ErrEmptyQuote, ErrAlreadyRechirped,
+		ErrMediaNotFound, ErrTooManyMedia, ErrDuplicateMedia,
+		ErrPollOptionCount, ErrPollOptionLength, ErrDuplicatePollOption, ErrPollClosingTime,
+	} {
+		if errors.Is(err, invalid) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the ID of the chirp this one reshares, by rechirping or quoting it, or 0 if it doesn't
+func (chirp Chirp) originalID() int {
+	if chirp.RechirpOf != 0 {
+		return chirp.RechirpOf
+	}
+	return chirp.QuoteOf
+}
+
+// Returns what a reshare shows of its original: the chirp itself, or a tombstone once it is deleted
+// found is false once the original has been purged, then only its ID is left
+func embeddedOriginal(original Chirp, found bool, originalID int) *Chirp {
+	if !found {
+		return &Chirp{Id: originalID, Tombstone: true}
+	}
+	if original.deleted() {
+		original = original.tombstone()
+	}
+	return &original
+}
+
+// Returns the chirp a new reshare should point at. Resharing a rechirp reshares what it rechirped,
+// so rechirps never have to be followed more than once
+func (dbStructure *DBStructure) resolveOriginal(originalID int) (int, error) {
+	original, ok := dbStructure.Chirps[originalID]
+	if !ok || original.deleted() {
+		return 0, ErrOriginalNotFound
+	}
+	if original.RechirpOf == 0 {
+		return originalID, nil
+	}
+	return dbStructure.resolveOriginal(original.RechirpOf)
+}
+
+// Returns the chirp with its original embedded, if it is a reshare
+func (dbStructure *DBStructure) withOriginal(chirp Chirp) Chirp {
+	if originalID := chirp.originalID(); originalID != 0 {
+		original, ok := dbStructure.Chirps[originalID]
+		chirp.Original = embeddedOriginal(original, ok, originalID)
+	}
+	return chirp
+}
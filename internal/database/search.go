@@ -0,0 +1,264 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+var ErrEmptySearch = errors.New("Search query has no words in it")
+
+// A page of a full-text search. Results come best match first, ties newest first
+type SearchQuery struct {
+	// Words to look for. Every word has to match. "Quoted words" match as a phrase,
+	// and a word ending in * matches any word starting with it
+	Text string
+	// Only results that come after this score and chirp ID in the ranking, if AfterID is not 0
+	AfterScore float64
+	AfterID    int
+	// At most this many results, if not 0
+	Limit int
+}
+
+// A chirp that matched a search, with how well it matched. Higher scores are better matches
+type SearchResult struct {
+	Chirp
+	Score float64 `json:"score"`
+}
+
+// The positions of a search term in one chirp, as word offsets into its body
+type posting struct {
+	chirpID   int
+	positions []int32
+}
+
+// One part of a parsed search: a single word, a word prefix, or a phrase of several words
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+// Splits text into lower cased words. Anything that isn't a letter or a digit separates words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Parses the search syntax described on SearchQuery.Text
+func parseSearchQuery(text string) []searchClause {
+	clauses := []searchClause{}
+	// Splitting on quotes leaves the phrases at the odd indexes
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			if terms := tokenize(part); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			terms := tokenize(word)
+			if len(terms) == 0 {
+				continue
+			}
+			// Words like "don't" tokenize into more than one term, which have to match as a phrase
+			clauses = append(clauses, searchClause{terms: terms, prefix: strings.HasSuffix(word, "*") && len(terms) == 1})
+		}
+	}
+	return clauses
+}
+
+// Returns where each word of a chirp's body occurs in it
+func termPositions(body string) map[string][]int32 {
+	positions := map[string][]int32{}
+	for i, term := range tokenize(body) {
+		positions[term] = append(positions[term], int32(i))
+	}
+	return positions
+}
+
+// Adds a chirp's words to the search index. New chirps have the highest ID, so their postings are appended
+func (dbStructure *DBStructure) indexChirp(chirp Chirp) {
+	for term, positions := range termPositions(chirp.Body) {
+		postings := dbStructure.searchTerms[term]
+		added := posting{chirpID: chirp.Id, positions: positions}
+		if len(postings) == 0 || chirp.Id > postings[len(postings)-1].chirpID {
+			dbStructure.searchTerms[term] = append(postings, added)
+			continue
+		}
+		i, _ := slices.BinarySearchFunc(postings, chirp.Id, comparePosting)
+		dbStructure.searchTerms[term] = slices.Insert(postings, i, added)
+	}
+}
+
+// Takes a chirp's words back out of the search index
+func (dbStructure *DBStructure) unindexChirp(chirp Chirp) {
+	for _, term := range tokenize(chirp.Body) {
+		postings := dbStructure.searchTerms[term]
+		i, found := slices.BinarySearchFunc(postings, chirp.Id, comparePosting)
+		if !found {
+			// Already removed, the term appears more than once in the body
+			continue
+		}
+		if len(postings) == 1 {
+			delete(dbStructure.searchTerms, term)
+			continue
+		}
+		dbStructure.searchTerms[term] = slices.Delete(postings, i, i+1)
+	}
+}
+
+func comparePosting(p posting, chirpID int) int {
+	return p.chirpID - chirpID
+}
+
+// Returns how often the clause occurs in each chirp that contains it
+func (dbStructure *DBStructure) matchClause(clause searchClause) map[int]int {
+	matches := map[int]int{}
+	if clause.prefix {
+		for term, postings := range dbStructure.searchTerms {
+			if strings.HasPrefix(term, clause.terms[0]) {
+				for _, p := range postings {
+					matches[p.chirpID] += len(p.positions)
+				}
+			}
+		}
+		return matches
+	}
+
+	// Start from the first word of the phrase, and check the next words follow it at each position
+	for _, first := range dbStructure.searchTerms[clause.terms[0]] {
+		occurrences := 0
+		for _, start := range first.positions {
+			if dbStructure.phraseAt(first.chirpID, clause.terms[1:], start+1) {
+				occurrences++
+			}
+		}
+		if occurrences > 0 {
+			matches[first.chirpID] = occurrences
+		}
+	}
+	return matches
+}
+
+// Reports whether terms appear one after another in a chirp, starting at word position pos
+func (dbStructure *DBStructure) phraseAt(chirpID int, terms []string, pos int32) bool {
+	for _, term := range terms {
+		postings := dbStructure.searchTerms[term]
+		i, found := slices.BinarySearchFunc(postings, chirpID, comparePosting)
+		if !found {
+			return false
+		}
+		if _, found := slices.BinarySearch(postings[i].positions, pos); !found {
+			return false
+		}
+		pos++
+	}
+	return true
+}
+
+// Returns how often the clause occurs in one body, given where each of its words is, as from termPositions
+func (clause searchClause) occurrences(positions map[string][]int32) int {
+	if clause.prefix {
+		count := 0
+		for term, at := range positions {
+			if strings.HasPrefix(term, clause.terms[0]) {
+				count += len(at)
+			}
+		}
+		return count
+	}
+	count := 0
+	for _, start := range positions[clause.terms[0]] {
+		matched := true
+		for i, term := range clause.terms[1:] {
+			if _, found := slices.BinarySearch(positions[term], start+int32(i)+1); !found {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			count++
+		}
+	}
+	return count
+}
+
+// Scores one clause of a search by how often it occurs in a chirp, with diminishing returns like BM25
+// Only the chirp itself goes into its score, not how rare the words are across every chirp, so chirps
+// created or deleted between two pages don't move the others and a cursor keeps its place
+func clauseScore(occurrences int) float64 {
+	tf := float64(occurrences)
+	return tf * 2.2 / (tf + 1.2)
+}
+
+// Returns a page of the chirps matching every clause of the search, best match first
+// Only the chirps on the page are expanded, once the matches are ranked
+func (db *DB) SearchChirps(query SearchQuery) ([]SearchResult, error) {
+	clauses := parseSearchQuery(query.Text)
+	if len(clauses) == 0 {
+		return nil, ErrEmptySearch
+	}
+
+	results := []SearchResult{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		scores := map[int]float64{}
+		for i, clause := range clauses {
+			next := map[int]float64{}
+			for chirpID, count := range dbStructure.matchClause(clause) {
+				// Every clause has to match, so only chirps that matched all the earlier ones are kept
+				score, ok := scores[chirpID]
+				if !ok && i > 0 {
+					continue
+				}
+				next[chirpID] = score + clauseScore(count)
+			}
+			scores = next
+		}
+
+		for chirpID, score := range scores {
+			if dbStructure.Chirps[chirpID].deleted() || !query.after(score, chirpID) {
+				continue
+			}
+			results = append(results, SearchResult{Chirp: Chirp{Id: chirpID}, Score: score})
+		}
+		results = rankSearchResults(results, query.Limit)
+		for i, result := range results {
+			results[i].Chirp = dbStructure.expand(dbStructure.Chirps[result.Id], 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Sorts search results best match first and cuts them to limit, if it is not 0
+func rankSearchResults(results []SearchResult, limit int) []SearchResult {
+	slices.SortFunc(results, compareSearchResults)
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// Reports whether a result with this score and chirp ID comes after the query's cursor in the ranking
+func (query SearchQuery) after(score float64, chirpID int) bool {
+	if query.AfterID == 0 {
+		return true
+	}
+	return score < query.AfterScore || score == query.AfterScore && chirpID < query.AfterID
+}
+
+// Orders search results best match first, and newest first between equal matches
+func compareSearchResults(a, b SearchResult) int {
+	if a.Score != b.Score {
+		if a.Score > b.Score {
+			return -1
+		}
+		return 1
+	}
+	return b.Id - a.Id
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Chirps created between two pages must not make the next page skip or repeat results
+func TestSearchPagingWhileChirpsChange(t *testing.T) {
+	for _, store := range testStores() {
+		t.Run(store.name, func(t *testing.T) {
+			db, _ := openTestStore(t, store)
+			user, err := db.CreateUser("writer@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			authorID := strconv.Itoa(user.Id)
+			// Chirps that say "go" more often rank higher, several of them tie
+			original := map[int]bool{}
+			for i := range 12 {
+				chirp, err := db.CreateChirp(strings.Repeat("go ", i%4+1)+"fun", authorID, ChirpParams{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				original[chirp.Id] = true
+			}
+
+			seen := map[int]bool{}
+			query := SearchQuery{Text: "go", Limit: 3}
+			for page := 0; ; page++ {
+				results, err := db.SearchChirps(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(results) == 0 {
+					break
+				}
+				for _, result := range results {
+					if seen[result.Id] {
+						t.Fatalf("chirp %d was returned on two pages", result.Id)
+					}
+					seen[result.Id] = true
+					if result.Body == "" {
+						t.Errorf("chirp %d wasn't read in full", result.Id)
+					}
+				}
+				last := results[len(results)-1]
+				query.AfterScore, query.AfterID = last.Score, last.Id
+
+				// Rarer and more common words, and more chirps, between every page
+				for _, body := range []string{"go", "fun fun fun", "go go go go go go"} {
+					_, err := db.CreateChirp(body, authorID, ChirpParams{})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for id := range original {
+				if !seen[id] {
+					t.Errorf("chirp %d was skipped", id)
+				}
+			}
+		})
+	}
+}
+
+// Both backends score a search the same way
+func TestSearchScores(t *testing.T) {
+	for _, store := range testStores() {
+		t.Run(store.name, func(t *testing.T) {
+			db, _ := openTestStore(t, store)
+			user, err := db.CreateUser("writer@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, body := range []string{"go is fun", "go go go", "going places", "fun is fun"} {
+				_, err := db.CreateChirp(body, strconv.Itoa(user.Id), ChirpParams{})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			results, err := db.SearchChirps(SearchQuery{Text: `go* "is fun"`})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 || results[0].Body != "go is fun" {
+				t.Fatalf("expected only \"go is fun\" to match, got %+v", results)
+			}
+			if expected := clauseScore(1) + clauseScore(1); results[0].Score != expected {
+				t.Errorf("expected a score of %v, got %v", expected, results[0].Score)
+			}
+
+			results, err = db.SearchChirps(SearchQuery{Text: "go*"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			bodies := []string{}
+			for _, result := range results {
+				bodies = append(bodies, result.Body)
+			}
+			// Ties go newest first
+			if strings.Join(bodies, "|") != "go go go|going places|go is fun" {
+				t.Errorf("unexpected ranking %q", bodies)
+			}
+		})
+	}
+}
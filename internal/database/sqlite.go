@@ -0,0 +1,102 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteDB is a Store backed by a SQLite database file, using the pure Go modernc.org/sqlite driver
+type SQLiteDB struct {
+	conn *sql.DB
+	opts Options
+	// Exclusive lock on <path>.lock, so restore can't replace the file while the server has it open. nil when read only
+	lock *os.File
+}
+
+// Opens (and creates if needed) the SQLite database file and returns a pointer for access
+// The schema is created and kept up to date by the migrations in sqlite_migrations.go
+// AUTOINCREMENT keys mean IDs are never reused, even after a row is deleted
+func NewSQLiteConnection(path string, opts Options) (*SQLiteDB, error) {
+	if opts.TrashRetention <= 0 {
+		opts.TrashRetention = DefaultTrashRetention
+	}
+	if opts.MediaRetention <= 0 {
+		opts.MediaRetention = DefaultMediaRetention
+	}
+	if opts.EditWindow <= 0 {
+		opts.EditWindow = DefaultEditWindow
+	}
+	db := &SQLiteDB{opts: opts}
+	if !opts.ReadOnly {
+		lock, err := lockFile(path + lockSuffix)
+		if err != nil {
+			return nil, err
+		}
+		db.lock = lock
+	}
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		db.unlock()
+		return nil, err
+	}
+	// SQLite only allows a single writer, so share one connection to avoid SQLITE_BUSY errors
+	conn.SetMaxOpenConns(1)
+	db.conn = conn
+
+	version, err := db.schemaVersion()
+	if err == nil {
+		// Refuse to open a database written by a newer version, rather than silently dropping what it added
+		err = checkSchemaVersion(version, latestSQLiteSchemaVersion())
+	}
+	if err == nil && !opts.ManualMigrations {
+		var report MigrationReport
+		report, err = db.Migrate(false)
+		for _, migration := range report.Applied {
+			log.Printf("Applied database migration %d: %s", migration.Version, migration.Name)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		db.unlock()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Removes every row from the database and resets the ID counters
+func (db *SQLiteDB) DebugWipeTestDatabase() {
+	db.conn.Exec(`
+		DELETE FROM chirps;
+		DELETE FROM drafts;
+		DELETE FROM users;
+		DELETE FROM media;
+		DELETE FROM revoked_token_hashes;
+		DELETE FROM sqlite_sequence;
+	`)
+}
+
+// Closes the underlying database connection
+func (db *SQLiteDB) Close() error {
+	err := db.conn.Close()
+	db.unlock()
+	return err
+}
+
+// Lets another process open the database for writing
+func (db *SQLiteDB) unlock() {
+	if db.lock != nil {
+		db.lock.Close()
+		db.lock = nil
+	}
+}
+
+// Reports whether err is a UNIQUE constraint violation
+func isUniqueViolation(err error) bool {
+	sqliteErr := &sqlite.Error{}
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
@@ -0,0 +1,375 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sqliteChirpColumns = "id, uid, body, author_id, in_reply_to, reply_count, like_count, created_at, updated_at, edited, deleted_at, tombstone, rechirp_of, quote_of, entities, media, poll"
+
+// Creates a new chirp and saves it to the chirps table. Any chirps params links to have to exist and not be deleted
+func (db *SQLiteDB) CreateChirp(body, id string, params ChirpParams) (Chirp, error) {
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := db.insertChirp(tx, body, userID, params)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return db.expandOne(chirp, 0)
+}
+
+// Checks a chirp userID would post at now against the rest of the database
+// Returns the params it would be posted with, which reshare the original rather than a rechirp of it,
+// and the media they attach
+func checkSQLiteChirp(tx *sql.Tx, body string, userID int, params ChirpParams, now time.Time) (ChirpParams, []Media, error) {
+	err := params.check(body, now)
+	if err != nil {
+		return ChirpParams{}, nil, err
+	}
+	if params.InReplyTo != 0 {
+		var found int
+		err = tx.QueryRow("SELECT COUNT(*) FROM chirps WHERE id = ? AND deleted_at IS NULL", params.InReplyTo).Scan(&found)
+		if err != nil {
+			return ChirpParams{}, nil, err
+		}
+		if found == 0 {
+			return ChirpParams{}, nil, ErrParentNotFound
+		}
+	}
+	if params.RechirpOf != 0 {
+		params.RechirpOf, err = resolveSQLiteOriginal(tx, params.RechirpOf)
+		if err != nil {
+			return ChirpParams{}, nil, err
+		}
+		var found int
+		err = tx.QueryRow("SELECT COUNT(*) FROM chirps WHERE author_id = ? AND rechirp_of = ? AND deleted_at IS NULL",
+			userID, params.RechirpOf).Scan(&found)
+		if err != nil {
+			return ChirpParams{}, nil, err
+		}
+		if found > 0 {
+			return ChirpParams{}, nil, ErrAlreadyRechirped
+		}
+	}
+	if params.QuoteOf != 0 {
+		params.QuoteOf, err = resolveSQLiteOriginal(tx, params.QuoteOf)
+		if err != nil {
+			return ChirpParams{}, nil, err
+		}
+	}
+	media, err := attachableSQLiteMedia(tx, params.MediaIDs, userID)
+	if err != nil {
+		return ChirpParams{}, nil, err
+	}
+	return params, media, nil
+}
+
+// Inserts a new chirp by userID, posted now, once checkSQLiteChirp has passed it
+// Returns the chirp as it was inserted, without what expand fills in
+func (db *SQLiteDB) insertChirp(tx *sql.Tx, body string, userID int, params ChirpParams) (Chirp, error) {
+	createdAt := timestamp()
+	params, media, err := checkSQLiteChirp(tx, body, userID, params, createdAt)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	uid := sql.NullString{}
+	if db.opts.OpaqueIDs {
+		uid = sql.NullString{String: newOpaqueID(), Valid: true}
+	}
+	entities, err := findSQLiteEntities(tx, body)
+	if err != nil {
+		return Chirp{}, err
+	}
+	encodedEntities, err := encodeSQLiteList(entities)
+	if err != nil {
+		return Chirp{}, err
+	}
+	encodedMedia, err := encodeSQLiteList(media)
+	if err != nil {
+		return Chirp{}, err
+	}
+	var poll *Poll
+	encodedPoll := sql.NullString{}
+	if params.Poll != nil {
+		poll = params.Poll.stored()
+		encodedPoll, err = encodeSQLiteJSON(poll)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+	result, err := tx.Exec(`INSERT INTO chirps (uid, body, author_id, in_reply_to, rechirp_of, quote_of, entities, media, poll, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		uid, body, userID, nullID(params.InReplyTo), nullID(params.RechirpOf), nullID(params.QuoteOf), encodedEntities, encodedMedia,
+		encodedPoll, createdAt.UnixNano(), createdAt.UnixNano())
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirpID, err := result.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp := Chirp{
+		Id:        int(chirpID),
+		Uid:       uid.String,
+		Body:      body,
+		AuthorId:  userID,
+		Entities:  entities,
+		Media:     media,
+		Poll:      poll,
+		InReplyTo: params.InReplyTo,
+		RechirpOf: params.RechirpOf,
+		QuoteOf:   params.QuoteOf,
+		CreatedAt: createdAt,
+		UpdatedAt: createdAt,
+	}
+	return chirp, saveSQLiteEntities(tx, chirp)
+}
+
+// Returns a chirp ID for an optional column, NULL for 0
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// Returns the chirps matching query, in ID order, leaving out deleted ones
+// The filters, order and limit all go into the SQL query, so only the requested page is read
+func (db *SQLiteDB) GetChirps(query ChirpQuery) ([]Chirp, error) {
+	where := []string{"deleted_at IS NULL"}
+	args := []any{}
+	if query.AuthorID != 0 {
+		where = append(where, "author_id = ?")
+		args = append(args, query.AuthorID)
+	}
+	if query.Tag != "" {
+		where = append(where, "id IN (SELECT chirp_id FROM chirp_tags WHERE tag = ?)")
+		args = append(args, query.Tag)
+	}
+	if query.MentionedUserID != 0 {
+		where = append(where, "id IN (SELECT chirp_id FROM chirp_mentions WHERE user_id = ?)")
+		args = append(args, query.MentionedUserID)
+	}
+	if !query.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, query.Since.UnixNano())
+	}
+	if !query.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, query.Until.UnixNano())
+	}
+	order := "ASC"
+	if query.AfterID != 0 {
+		if query.Descending {
+			where = append(where, "id < ?")
+		} else {
+			where = append(where, "id > ?")
+		}
+		args = append(args, query.AfterID)
+	}
+	if query.Descending {
+		order = "DESC"
+	}
+	limit := -1
+	if query.Limit > 0 {
+		limit = query.Limit
+	}
+	args = append(args, limit)
+	// Whether the viewer liked each chirp comes back as one more column
+	columns := sqliteChirpColumns
+	if query.ViewerID != 0 {
+		columns += ", EXISTS (SELECT 1 FROM chirp_likes WHERE chirp_id = chirps.id AND user_id = ?)"
+		args = append([]any{query.ViewerID}, args...)
+	}
+
+	rows, err := db.conn.Query("SELECT "+columns+" FROM chirps WHERE "+strings.Join(where, " AND ")+
+		" ORDER BY id "+order+" LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirpSlice := []Chirp{}
+	for rows.Next() {
+		row := interface{ Scan(...any) error }(rows)
+		liked := false
+		if query.ViewerID != 0 {
+			row = extraColumnsRow{row: rows, extra: []any{&liked}}
+		}
+		chirp, err := scanSQLiteChirp(row)
+		if err != nil {
+			return nil, err
+		}
+		if query.ViewerID != 0 {
+			chirp.LikedByMe = &liked
+		}
+		chirpSlice = append(chirpSlice, chirp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return chirpSlice, db.expand(chirpSlice, query.ViewerID)
+}
+
+// Get a specific Chirp from the database. Deleted chirps are not found
+func (db *SQLiteDB) GetChirp(chirpID int) (Chirp, error) {
+	chirp, err := scanSQLiteChirp(db.conn.QueryRow("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ? AND deleted_at IS NULL", chirpID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	return db.expandOne(chirp, 0)
+}
+
+// Fills in what chirps show when they are read but isn't stored with them: the originals they reshare,
+// and their polls as viewerID sees them, or as someone who isn't logged in does if viewerID is 0
+// It reads through db.conn, so it can't be called with a transaction open
+func (db *SQLiteDB) expand(chirps []Chirp, viewerID int) error {
+	err := db.embedOriginals(chirps)
+	if err != nil {
+		return err
+	}
+	now := timestamp()
+	for i := range chirps {
+		chirps[i].Poll, err = db.pollView(chirps[i], viewerID, now)
+		if err != nil {
+			return err
+		}
+		if original := chirps[i].Original; original != nil {
+			original.Poll, err = db.pollView(*original, viewerID, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Expands a single chirp, see expand
+func (db *SQLiteDB) expandOne(chirp Chirp, viewerID int) (Chirp, error) {
+	chirps := []Chirp{chirp}
+	err := db.expand(chirps, viewerID)
+	return chirps[0], err
+}
+
+// Moves a chirp to its author's trash. It can be restored until it is purged
+func (db *SQLiteDB) DeleteChirp(chirpID, authorID int) error {
+	chirp, err := db.GetChirp(chirpID)
+	if err != nil {
+		return err
+	}
+
+	// User must be the owner of the chirp to delete it
+	if chirp.AuthorId != authorID {
+		return ErrUnauthorized
+	}
+
+	_, err = db.conn.Exec("UPDATE chirps SET deleted_at = ? WHERE id = ? AND author_id = ? AND deleted_at IS NULL",
+		timestamp().UnixNano(), chirpID, authorID)
+	return err
+}
+
+// Turns a chirp ID from a URL into a numeric chirp ID. ref can be the numeric ID or the chirp's opaque uid
+// Deleted chirps still resolve, so they can be restored
+func (db *SQLiteDB) ResolveChirpID(ref string) (int, error) {
+	chirpID, ok, err := parseNumericID(ref)
+	if ok || err != nil {
+		return chirpID, err
+	}
+
+	err = db.conn.QueryRow("SELECT id FROM chirps WHERE uid = ?", ref).Scan(&chirpID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrChirpNotFound
+	}
+	return chirpID, err
+}
+
+// Scans a single chirps row selected with sqliteChirpColumns
+func scanSQLiteChirp(row interface{ Scan(...any) error }) (Chirp, error) {
+	chirp := Chirp{}
+	uid := sql.NullString{}
+	var createdAt, updatedAt int64
+	var inReplyTo, rechirpOf, quoteOf sql.NullInt64
+	deletedAt := sql.NullInt64{}
+	var entities, media, poll sql.NullString
+	err := row.Scan(&chirp.Id, &uid, &chirp.Body, &chirp.AuthorId, &inReplyTo, &chirp.ReplyCount, &chirp.LikeCount, &createdAt, &updatedAt,
+		&chirp.Edited, &deletedAt, &chirp.Tombstone, &rechirpOf, &quoteOf, &entities, &media, &poll)
+	chirp.Uid = uid.String
+	chirp.InReplyTo = int(inReplyTo.Int64)
+	chirp.RechirpOf = int(rechirpOf.Int64)
+	chirp.QuoteOf = int(quoteOf.Int64)
+	chirp.CreatedAt = sqliteTime(createdAt)
+	chirp.UpdatedAt = sqliteTime(updatedAt)
+	if deletedAt.Valid {
+		deleted := sqliteTime(deletedAt.Int64)
+		chirp.DeletedAt = &deleted
+	}
+	if err == nil && entities.Valid {
+		err = json.Unmarshal([]byte(entities.String), &chirp.Entities)
+	}
+	if err == nil && media.Valid {
+		err = json.Unmarshal([]byte(media.String), &chirp.Media)
+	}
+	if err == nil && poll.Valid {
+		err = json.Unmarshal([]byte(poll.String), &chirp.Poll)
+	}
+	return chirp, err
+}
+
+// Returns a list as it is stored in a JSON column like entities, NULL for an empty list
+func encodeSQLiteList[T any](list []T) (sql.NullString, error) {
+	if len(list) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// Returns a value as it is stored in a JSON column like poll, NULL for nil
+func encodeSQLiteJSON[T any](value *T) (sql.NullString, error) {
+	if value == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// Lets scanSQLiteChirp read a row that has more columns after the chirp columns, scanning them into extra
+type extraColumnsRow struct {
+	row   interface{ Scan(...any) error }
+	extra []any
+}
+
+func (row extraColumnsRow) Scan(dest ...any) error {
+	return row.row.Scan(append(dest, row.extra...)...)
+}
+
+// Turns a timestamp column, stored as Unix nanoseconds, back into a time
+func sqliteTime(unixNano int64) time.Time {
+	return time.Unix(0, unixNano).UTC()
+}
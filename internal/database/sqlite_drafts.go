@@ -0,0 +1,297 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const sqliteDraftColumns = "id, author_id, body, in_reply_to, rechirp_of, quote_of, media_ids, poll, publish_at, publish_error, created_at, updated_at"
+
+// Saves a new draft by authorID, scheduled for publishAt unless it is zero
+// It has to pass the same checks as a new chirp, as if it were posted at publishAt
+func (db *SQLiteDB) CreateDraft(authorID int, body string, params ChirpParams, publishAt time.Time) (Draft, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Draft{}, err
+	}
+	defer tx.Rollback()
+
+	now := timestamp()
+	draft := Draft{AuthorId: authorID, Body: body, CreatedAt: now, UpdatedAt: now}
+	err = checkSQLiteDraft(tx, &draft, params, publishAt, now)
+	if err != nil {
+		return Draft{}, err
+	}
+	values, err := sqliteDraftValues(draft)
+	if err != nil {
+		return Draft{}, err
+	}
+	result, err := tx.Exec(`INSERT INTO drafts (author_id, body, in_reply_to, rechirp_of, quote_of, media_ids, poll, publish_at, publish_error, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, append([]any{authorID}, values...)...)
+	if err != nil {
+		return Draft{}, err
+	}
+	draftID, err := result.LastInsertId()
+	if err != nil {
+		return Draft{}, err
+	}
+	draft.Id = int(draftID)
+	return draft, tx.Commit()
+}
+
+// Returns the author's drafts, scheduled or not, oldest first
+func (db *SQLiteDB) GetDrafts(authorID int) ([]Draft, error) {
+	rows, err := db.conn.Query("SELECT "+sqliteDraftColumns+" FROM drafts WHERE author_id = ? ORDER BY id", authorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drafts := []Draft{}
+	for rows.Next() {
+		draft, err := scanSQLiteDraft(rows)
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, draft)
+	}
+	return drafts, rows.Err()
+}
+
+// Replaces the body, params and publish time of one of the author's drafts, checking them like CreateDraft does
+// Other users' drafts are not found
+func (db *SQLiteDB) UpdateDraft(draftID, authorID int, body string, params ChirpParams, publishAt time.Time) (Draft, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Draft{}, err
+	}
+	defer tx.Rollback()
+
+	draft, err := getSQLiteDraft(tx, draftID, authorID)
+	if err != nil {
+		return Draft{}, err
+	}
+	now := timestamp()
+	draft.Body = body
+	draft.UpdatedAt = now
+	err = checkSQLiteDraft(tx, &draft, params, publishAt, now)
+	if err != nil {
+		return Draft{}, err
+	}
+	err = updateSQLiteDraft(tx, draft)
+	if err != nil {
+		return Draft{}, err
+	}
+	return draft, tx.Commit()
+}
+
+// Deletes one of the author's drafts. Other users' drafts are not found
+func (db *SQLiteDB) DeleteDraft(draftID, authorID int) error {
+	result, err := db.conn.Exec("DELETE FROM drafts WHERE id = ? AND author_id = ?", draftID, authorID)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrDraftNotFound
+	}
+	return nil
+}
+
+// Publishes one of the author's drafts as a new chirp right away, whether it is scheduled or not
+// It is checked again as a new chirp, since the chirps it links to may have been deleted since it was saved
+func (db *SQLiteDB) PublishDraft(draftID, authorID int) (Chirp, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	draft, err := getSQLiteDraft(tx, draftID, authorID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp, err := db.publishSQLiteDraft(tx, draft)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
+	return db.expandOne(chirp, 0)
+}
+
+// Publishes every scheduled draft that is due at now, in the order they were scheduled for
+// A draft that no longer passes the checks for a new chirp is unscheduled instead, with the reason as its
+// PublishError, rather than tried again on every call
+// Each draft is published in a transaction of its own, so on an error the counts are of the drafts handled before it
+func (db *SQLiteDB) PublishDueDrafts(now time.Time) (published int, failed int, err error) {
+	rows, err := db.conn.Query("SELECT id FROM drafts WHERE publish_at <= ? ORDER BY publish_at, id", now.UnixNano())
+	if err != nil {
+		return 0, 0, err
+	}
+	due := []int{}
+	for rows.Next() {
+		var draftID int
+		err = rows.Scan(&draftID)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		due = append(due, draftID)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, draftID := range due {
+		err = db.publishDueDraft(draftID, now)
+		switch {
+		case err == nil:
+			published++
+		case IsInvalidChirpParams(err):
+			failed++
+		case errors.Is(err, ErrDraftNotFound):
+			// Published, unscheduled or deleted since it was listed
+		default:
+			return published, failed, err
+		}
+	}
+	return published, failed, nil
+}
+
+// Publishes one scheduled draft if it is still due at now. Returns ErrDraftNotFound if it isn't anymore,
+// or the error it failed the checks with, once it has been unscheduled with that as its PublishError
+func (db *SQLiteDB) publishDueDraft(draftID int, now time.Time) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	draft, err := scanSQLiteDraft(tx.QueryRow("SELECT "+sqliteDraftColumns+" FROM drafts WHERE id = ? AND publish_at <= ?",
+		draftID, now.UnixNano()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrDraftNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = db.publishSQLiteDraft(tx, draft)
+	if IsInvalidChirpParams(err) {
+		failure := err
+		draft.PublishAt = nil
+		draft.PublishError = failure.Error()
+		err = updateSQLiteDraft(tx, draft)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			return err
+		}
+		return failure
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Inserts the chirp a draft is published as, and deletes the draft, in the same transaction
+// so a draft can never be published twice
+func (db *SQLiteDB) publishSQLiteDraft(tx *sql.Tx, draft Draft) (Chirp, error) {
+	chirp, err := db.insertChirp(tx, draft.Body, draft.AuthorId, draft.params())
+	if err != nil {
+		return Chirp{}, err
+	}
+	_, err = tx.Exec("DELETE FROM drafts WHERE id = ?", draft.Id)
+	return chirp, err
+}
+
+// Checks a draft's body and params as a chirp posted when it would be published, and sets them on the draft
+func checkSQLiteDraft(tx *sql.Tx, draft *Draft, params ChirpParams, publishAt, now time.Time) error {
+	postedAt, err := publishTime(publishAt, now)
+	if err != nil {
+		return err
+	}
+	params, _, err = checkSQLiteChirp(tx, draft.Body, draft.AuthorId, params, postedAt)
+	if err != nil {
+		return err
+	}
+	draft.set(params, publishAt)
+	return nil
+}
+
+// Returns one of the author's drafts. Other users' drafts are not found
+func getSQLiteDraft(tx *sql.Tx, draftID, authorID int) (Draft, error) {
+	draft, err := scanSQLiteDraft(tx.QueryRow("SELECT "+sqliteDraftColumns+" FROM drafts WHERE id = ? AND author_id = ?", draftID, authorID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Draft{}, ErrDraftNotFound
+	}
+	return draft, err
+}
+
+// Writes every column of an existing draft
+func updateSQLiteDraft(tx *sql.Tx, draft Draft) error {
+	values, err := sqliteDraftValues(draft)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE drafts SET body = ?, in_reply_to = ?, rechirp_of = ?, quote_of = ?, media_ids = ?, poll = ?,
+		publish_at = ?, publish_error = ?, created_at = ?, updated_at = ? WHERE id = ?`, append(values, draft.Id)...)
+	return err
+}
+
+// Returns the values of a draft's columns in the order of sqliteDraftColumns, leaving out id and author_id
+func sqliteDraftValues(draft Draft) ([]any, error) {
+	mediaIDs, err := encodeSQLiteList(draft.MediaIDs)
+	if err != nil {
+		return nil, err
+	}
+	poll, err := encodeSQLiteJSON(draft.Poll)
+	if err != nil {
+		return nil, err
+	}
+	publishAt := sql.NullInt64{}
+	if draft.PublishAt != nil {
+		publishAt = sql.NullInt64{Int64: draft.PublishAt.UnixNano(), Valid: true}
+	}
+	publishError := sql.NullString{String: draft.PublishError, Valid: draft.PublishError != ""}
+	return []any{draft.Body, nullID(draft.InReplyTo), nullID(draft.RechirpOf), nullID(draft.QuoteOf), mediaIDs, poll,
+		publishAt, publishError, draft.CreatedAt.UnixNano(), draft.UpdatedAt.UnixNano()}, nil
+}
+
+// Scans a single drafts row selected with sqliteDraftColumns
+func scanSQLiteDraft(row interface{ Scan(...any) error }) (Draft, error) {
+	draft := Draft{}
+	var inReplyTo, rechirpOf, quoteOf, publishAt sql.NullInt64
+	var mediaIDs, poll, publishError sql.NullString
+	var createdAt, updatedAt int64
+	err := row.Scan(&draft.Id, &draft.AuthorId, &draft.Body, &inReplyTo, &rechirpOf, &quoteOf, &mediaIDs, &poll,
+		&publishAt, &publishError, &createdAt, &updatedAt)
+	draft.InReplyTo = int(inReplyTo.Int64)
+	draft.RechirpOf = int(rechirpOf.Int64)
+	draft.QuoteOf = int(quoteOf.Int64)
+	draft.PublishError = publishError.String
+	draft.CreatedAt = sqliteTime(createdAt)
+	draft.UpdatedAt = sqliteTime(updatedAt)
+	if publishAt.Valid {
+		at := sqliteTime(publishAt.Int64)
+		draft.PublishAt = &at
+	}
+	if err == nil && mediaIDs.Valid {
+		err = json.Unmarshal([]byte(mediaIDs.String), &draft.MediaIDs)
+	}
+	if err == nil && poll.Valid {
+		err = json.Unmarshal([]byte(poll.String), &draft.Poll)
+	}
+	return draft, err
+}
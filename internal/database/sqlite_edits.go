@@ -0,0 +1,106 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Replaces the body of a chirp, keeping the old body as a revision. Only the author can edit a chirp
+// An edit that doesn't change the body returns the chirp as it is, without adding a revision
+func (db *SQLiteDB) EditChirp(chirpID, authorID int, body string) (Chirp, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanSQLiteChirp(tx.QueryRow("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ? AND deleted_at IS NULL", chirpID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.AuthorId != authorID {
+		return Chirp{}, ErrUnauthorized
+	}
+	if chirp.RechirpOf != 0 {
+		return Chirp{}, ErrRechirpNotEditable
+	}
+	if chirp.QuoteOf != 0 && body == "" {
+		return Chirp{}, ErrEmptyQuote
+	}
+	isChirpyRed := false
+	err = tx.QueryRow("SELECT is_chirpy_red FROM users WHERE id = ?", authorID).Scan(&isChirpyRed)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, err
+	}
+	now := timestamp()
+	if !db.opts.canEdit(chirp, isChirpyRed, now) {
+		return Chirp{}, ErrEditWindowClosed
+	}
+	if chirp.Body == body {
+		tx.Rollback()
+		return db.expandOne(chirp, 0)
+	}
+
+	_, err = tx.Exec(`INSERT INTO chirp_revisions (chirp_id, revision, body, created_at, replaced_at)
+		SELECT ?, COUNT(*) + 1, ?, ?, ? FROM chirp_revisions WHERE chirp_id = ?`,
+		chirpID, chirp.Body, chirp.UpdatedAt.UnixNano(), now.UnixNano(), chirpID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.Body = body
+	chirp.UpdatedAt = now
+	chirp.Edited = true
+	chirp.Entities, err = findSQLiteEntities(tx, body)
+	if err != nil {
+		return Chirp{}, err
+	}
+	entities, err := encodeSQLiteList(chirp.Entities)
+	if err != nil {
+		return Chirp{}, err
+	}
+	_, err = tx.Exec("UPDATE chirps SET body = ?, entities = ?, updated_at = ?, edited = 1 WHERE id = ?", body, entities, now.UnixNano(), chirpID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = saveSQLiteEntities(tx, chirp)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return db.expandOne(chirp, 0)
+}
+
+// Returns the earlier bodies of a chirp, oldest first. Deleted chirps are not found
+func (db *SQLiteDB) GetChirpHistory(chirpID int) ([]ChirpRevision, error) {
+	_, err := db.GetChirp(chirpID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query("SELECT revision, body, created_at, replaced_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY revision", chirpID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []ChirpRevision{}
+	for rows.Next() {
+		revision := ChirpRevision{}
+		var createdAt, replacedAt int64
+		err = rows.Scan(&revision.Revision, &revision.Body, &createdAt, &replacedAt)
+		if err != nil {
+			return nil, err
+		}
+		revision.CreatedAt = sqliteTime(createdAt)
+		revision.ReplacedAt = sqliteTime(replacedAt)
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
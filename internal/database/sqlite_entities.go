@@ -0,0 +1,63 @@
+package database
+
+import "database/sql"
+
+// The handle of a user in the users table, computed the same way as userHandle
+// users_handle indexes this exact expression, so queries have to use it as it is
+const sqliteUserHandle = "lower(CASE WHEN instr(email, '@') > 0 THEN substr(email, 1, instr(email, '@') - 1) ELSE email END)"
+
+// Finds the entities in a chirp body, and resolves each mention to the one user with its handle
+// Mentions of a handle that no user or more than one user has are left unresolved
+func findSQLiteEntities(tx *sql.Tx, body string) ([]Entity, error) {
+	entities := extractEntities(body)
+	for i, entity := range entities {
+		if entity.Type != EntityMention {
+			continue
+		}
+		userIDs := []int{}
+		rows, err := tx.Query("SELECT id FROM users WHERE "+sqliteUserHandle+" = ? LIMIT 2", entity.Handle)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var userID int
+			err = rows.Scan(&userID)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			userIDs = append(userIDs, userID)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return nil, rows.Err()
+		}
+		if len(userIDs) == 1 {
+			entities[i].UserID = userIDs[0]
+		}
+	}
+	return entities, nil
+}
+
+// Replaces the rows chirp_tags and chirp_mentions have for a chirp with the ones for its entities
+func saveSQLiteEntities(tx *sql.Tx, chirp Chirp) error {
+	for _, table := range []string{"chirp_tags", "chirp_mentions"} {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE chirp_id = ?", chirp.Id)
+		if err != nil {
+			return err
+		}
+	}
+	for _, tag := range chirp.tags() {
+		_, err := tx.Exec("INSERT INTO chirp_tags (tag, chirp_id) VALUES (?, ?)", tag, chirp.Id)
+		if err != nil {
+			return err
+		}
+	}
+	for _, userID := range chirp.mentionedUserIDs() {
+		_, err := tx.Exec("INSERT INTO chirp_mentions (user_id, chirp_id) VALUES (?, ?)", userID, chirp.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package database
+
+// Likes a chirp as the user. Liking a chirp that is already liked does nothing, so retries are safe
+// Returns the chirp with its new like count
+func (db *SQLiteDB) LikeChirp(chirpID, userID int) (Chirp, error) {
+	return db.changeLike(chirpID, userID, "INSERT OR IGNORE INTO chirp_likes (chirp_id, user_id, liked_at) VALUES (?, ?, ?)",
+		chirpID, userID, timestamp().UnixNano())
+}
+
+// Takes back the user's like of a chirp. Unliking a chirp that isn't liked does nothing
+// Returns the chirp with its new like count
+func (db *SQLiteDB) UnlikeChirp(chirpID, userID int) (Chirp, error) {
+	return db.changeLike(chirpID, userID, "DELETE FROM chirp_likes WHERE chirp_id = ? AND user_id = ?", chirpID, userID)
+}
+
+// Runs the statement that adds or removes a like, and reads the chirp back, in one transaction
+func (db *SQLiteDB) changeLike(chirpID, userID int, statement string, args ...any) (Chirp, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	var found int
+	err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", userID).Scan(&found)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if found == 0 {
+		return Chirp{}, ErrUserNotFound
+	}
+	err = tx.QueryRow("SELECT COUNT(*) FROM chirps WHERE id = ? AND deleted_at IS NULL", chirpID).Scan(&found)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if found == 0 {
+		return Chirp{}, ErrChirpNotFound
+	}
+
+	_, err = tx.Exec(statement, args...)
+	if err != nil {
+		return Chirp{}, err
+	}
+	liked := false
+	chirp, err := scanSQLiteChirp(extraColumnsRow{
+		row: tx.QueryRow("SELECT "+sqliteChirpColumns+", EXISTS (SELECT 1 FROM chirp_likes WHERE chirp_id = chirps.id AND user_id = ?) FROM chirps WHERE id = ?",
+			userID, chirpID),
+		extra: []any{&liked},
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.LikedByMe = &liked
+	return chirp, tx.Commit()
+}
+
+// Returns the chirps a user has liked, most recently liked first, leaving out deleted ones
+func (db *SQLiteDB) GetLikedChirps(userID int) ([]Chirp, error) {
+	var found int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", userID).Scan(&found)
+	if err != nil {
+		return nil, err
+	}
+	if found == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	chirps, err := db.queryChirps("SELECT "+sqliteChirpColumns+" FROM chirps JOIN chirp_likes ON chirp_id = id "+
+		"WHERE user_id = ? AND deleted_at IS NULL ORDER BY liked_at DESC, id", userID)
+	if err != nil {
+		return nil, err
+	}
+	return chirps, db.expand(chirps, 0)
+}
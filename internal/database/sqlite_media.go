@@ -0,0 +1,203 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+)
+
+const sqliteMediaColumns = "id, owner_id, content_type, size, width, height, blob_key, url, renditions, placeholder, created_at"
+
+// Saves a new media record for a file that is already in the blob store, giving it an ID
+func (db *SQLiteDB) CreateMedia(media Media) (Media, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Media{}, err
+	}
+	defer tx.Rollback()
+
+	media, err = insertSQLiteMedia(tx, media)
+	if err != nil {
+		return Media{}, err
+	}
+	return media, tx.Commit()
+}
+
+// Inserts a new media record, giving it an ID. Its owner has to exist
+func insertSQLiteMedia(tx *sql.Tx, media Media) (Media, error) {
+	media.Id = newOpaqueID()
+	media.CreatedAt = timestamp()
+
+	var found int
+	err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", media.OwnerID).Scan(&found)
+	if err != nil {
+		return Media{}, err
+	}
+	if found == 0 {
+		return Media{}, ErrUserNotFound
+	}
+	renditions, err := encodeSQLiteList(media.Renditions)
+	if err != nil {
+		return Media{}, err
+	}
+	_, err = tx.Exec("INSERT INTO media ("+sqliteMediaColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		media.Id, media.OwnerID, media.ContentType, media.Size, media.Width, media.Height, media.BlobKey, media.URL,
+		renditions, media.Placeholder, media.CreatedAt.UnixNano())
+	if err != nil {
+		return Media{}, err
+	}
+	return media, nil
+}
+
+// Returns the media to attach to a new chirp by ownerID. Only the owner of a media can attach it
+func attachableSQLiteMedia(tx *sql.Tx, mediaIDs []string, ownerID int) ([]Media, error) {
+	var attached []Media
+	for _, id := range mediaIDs {
+		media, err := scanSQLiteMedia(tx.QueryRow("SELECT "+sqliteMediaColumns+" FROM media WHERE id = ?", id))
+		if err != nil {
+			return nil, err
+		}
+		if media.OwnerID != ownerID {
+			return nil, ErrMediaNotFound
+		}
+		attached = append(attached, media)
+	}
+	return attached, nil
+}
+
+// Saves a new media record for a file that is already in the blob store and makes it its owner's avatar
+// Both happen in one transaction, so a failed avatar never leaves a media record behind
+func (db *SQLiteDB) CreateAvatar(media Media) (User, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	avatar, err := insertSQLiteMedia(tx, media)
+	if err != nil {
+		return User{}, err
+	}
+	user, err := scanSQLiteUser(tx.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", avatar.OwnerID))
+	if err != nil {
+		return User{}, err
+	}
+	user.Avatar = &avatar
+	user.UpdatedAt = avatar.CreatedAt
+
+	encoded, err := json.Marshal(user.Avatar)
+	if err != nil {
+		return User{}, err
+	}
+	_, err = tx.Exec("UPDATE users SET avatar = ?, updated_at = ? WHERE id = ?", string(encoded), user.UpdatedAt.UnixNano(), user.Id)
+	if err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+// Scans a single media row, returning ErrMediaNotFound when there is no match
+func scanSQLiteMedia(row interface{ Scan(...any) error }) (Media, error) {
+	media := Media{}
+	renditions := sql.NullString{}
+	var createdAt int64
+	err := row.Scan(&media.Id, &media.OwnerID, &media.ContentType, &media.Size, &media.Width, &media.Height,
+		&media.BlobKey, &media.URL, &renditions, &media.Placeholder, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Media{}, ErrMediaNotFound
+	}
+	if err != nil {
+		return Media{}, err
+	}
+	if renditions.Valid {
+		err = json.Unmarshal([]byte(renditions.String), &media.Renditions)
+		if err != nil {
+			return Media{}, err
+		}
+	}
+	media.CreatedAt = sqliteTime(createdAt)
+	return media, nil
+}
+
+// Removes the media uploaded before uploadedBefore that no chirp, draft or avatar refers to, and returns it
+// Chirps in the trash still count, they can be restored with their media
+func deleteUnusedSQLiteMedia(tx *sql.Tx, uploadedBefore time.Time) ([]Media, error) {
+	used := map[string]bool{}
+	chirpMedia, err := querySQLiteJSON[[]Media](tx, "SELECT media FROM chirps WHERE media IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	for _, media := range slices.Concat(chirpMedia...) {
+		used[media.Id] = true
+	}
+	draftMediaIDs, err := querySQLiteJSON[[]string](tx, "SELECT media_ids FROM drafts WHERE media_ids IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	for _, mediaID := range slices.Concat(draftMediaIDs...) {
+		used[mediaID] = true
+	}
+	avatars, err := querySQLiteJSON[Media](tx, "SELECT avatar FROM users WHERE avatar IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	for _, avatar := range avatars {
+		used[avatar.Id] = true
+	}
+
+	rows, err := tx.Query("SELECT "+sqliteMediaColumns+" FROM media WHERE created_at < ? ORDER BY id", uploadedBefore.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	removed := []Media{}
+	for rows.Next() {
+		media, err := scanSQLiteMedia(rows)
+		if err != nil {
+			return nil, err
+		}
+		if !used[media.Id] {
+			removed = append(removed, media)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, media := range removed {
+		_, err = tx.Exec("DELETE FROM media WHERE id = ?", media.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+// Decodes the JSON column returned by every row of query
+func querySQLiteJSON[T any](tx *sql.Tx, query string) ([]T, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []T{}
+	for rows.Next() {
+		var column string
+		err = rows.Scan(&column)
+		if err != nil {
+			return nil, err
+		}
+		var value T
+		err = json.Unmarshal([]byte(column), &value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,515 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A migration of the SQLite database, run inside the same transaction as every other pending migration
+type sqliteMigration struct {
+	MigrationInfo
+	migrate func(tx *sql.Tx) error
+}
+
+// Every SQLite migration, in the order they run. Versions must be consecutive starting at 1
+// The current version is stored in PRAGMA user_version
+// Never change or remove a migration once it has shipped, add a new one instead
+var sqliteMigrations = []sqliteMigration{
+	{
+		MigrationInfo: MigrationInfo{Version: 1, Name: "Create users, chirps and revoked_tokens tables"},
+		migrate: func(tx *sql.Tx) error {
+			// IF NOT EXISTS, since databases created before migrations existed already have these tables
+			_, err := tx.Exec(`
+				CREATE TABLE IF NOT EXISTS users (
+					id            INTEGER PRIMARY KEY AUTOINCREMENT,
+					email         TEXT NOT NULL UNIQUE,
+					password      TEXT NOT NULL,
+					is_chirpy_red INTEGER NOT NULL DEFAULT 0
+				);
+				CREATE TABLE IF NOT EXISTS chirps (
+					id        INTEGER PRIMARY KEY AUTOINCREMENT,
+					body      TEXT NOT NULL,
+					author_id INTEGER NOT NULL
+				);
+				CREATE INDEX IF NOT EXISTS chirps_author_id ON chirps (author_id);
+				CREATE TABLE IF NOT EXISTS revoked_tokens (
+					token      TEXT PRIMARY KEY,
+					revoked_at TIMESTAMP NOT NULL
+				);
+			`)
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 2, Name: "Add opaque uid columns to users and chirps"},
+		migrate: func(tx *sql.Tx) error {
+			err := addSQLiteColumn(tx, "users", "uid", "TEXT")
+			if err != nil {
+				return err
+			}
+			return addSQLiteColumn(tx, "chirps", "uid", "TEXT")
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 3, Name: "Make user emails unique ignoring case"},
+		migrate: func(tx *sql.Tx) error {
+			// Creating the index would fail on existing duplicates anyway, but with a less helpful error
+			var email string
+			err := tx.QueryRow("SELECT email FROM users GROUP BY email COLLATE NOCASE HAVING COUNT(*) > 1 LIMIT 1").Scan(&email)
+			if err == nil {
+				return fmt.Errorf("more than one user has the email %q ignoring case, change all but one of them first", email)
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_email_nocase ON users (email COLLATE NOCASE)")
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 4, Name: "Store revoked refresh tokens by hash, with their expiry"},
+		migrate: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				CREATE TABLE revoked_token_hashes (
+					token_hash TEXT PRIMARY KEY,
+					revoked_at TIMESTAMP NOT NULL,
+					expires_at INTEGER NOT NULL
+				);
+				CREATE INDEX revoked_token_hashes_expires_at ON revoked_token_hashes (expires_at);
+			`)
+			if err != nil {
+				return err
+			}
+
+			// Hashing and reading the expiry happens in Go, so copy the old rows over one by one
+			rows, err := tx.Query("SELECT token, revoked_at FROM revoked_tokens")
+			if err != nil {
+				return err
+			}
+			type legacyToken struct {
+				token     string
+				revokedAt time.Time
+			}
+			legacyTokens := []legacyToken{}
+			for rows.Next() {
+				legacy := legacyToken{}
+				err = rows.Scan(&legacy.token, &legacy.revokedAt)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				legacyTokens = append(legacyTokens, legacy)
+			}
+			rows.Close()
+			if rows.Err() != nil {
+				return rows.Err()
+			}
+
+			for _, legacy := range legacyTokens {
+				expiresAt := tokenExpiry(legacy.token, legacy.revokedAt.Add(refreshTokenLifetime))
+				_, err = tx.Exec("INSERT OR REPLACE INTO revoked_token_hashes (token_hash, revoked_at, expires_at) VALUES (?, ?, ?)",
+					tokenKey(legacy.token), legacy.revokedAt, expiresAt.Unix())
+				if err != nil {
+					return err
+				}
+			}
+			_, err = tx.Exec("DROP TABLE revoked_tokens")
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 5, Name: "Backfill created and updated timestamps on chirps and users"},
+		migrate: func(tx *sql.Tx) error {
+			// Timestamps are stored as Unix nanoseconds, so they sort and compare as plain integers
+			_, err := tx.Exec(`
+				ALTER TABLE users ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+				ALTER TABLE users ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+				ALTER TABLE chirps ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+				ALTER TABLE chirps ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+				CREATE INDEX chirps_created_at ON chirps (created_at);
+			`)
+			if err != nil {
+				return err
+			}
+
+			// Rows with an opaque uid get the time it holds, which needs Go, the rest get the time of the migration
+			backfilledAt := timestamp()
+			for _, table := range []string{"users", "chirps"} {
+				rows, err := tx.Query("SELECT id, uid FROM " + table + " WHERE uid IS NOT NULL")
+				if err != nil {
+					return err
+				}
+				createdAt := map[int]time.Time{}
+				for rows.Next() {
+					var id int
+					var uid string
+					err = rows.Scan(&id, &uid)
+					if err != nil {
+						rows.Close()
+						return err
+					}
+					createdAt[id] = backfillCreatedAt(uid, backfilledAt)
+				}
+				rows.Close()
+				if rows.Err() != nil {
+					return rows.Err()
+				}
+
+				for id, at := range createdAt {
+					_, err = tx.Exec("UPDATE "+table+" SET created_at = ?, updated_at = ? WHERE id = ?", at.UnixNano(), at.UnixNano(), id)
+					if err != nil {
+						return err
+					}
+				}
+				_, err = tx.Exec("UPDATE "+table+" SET created_at = ?, updated_at = ? WHERE created_at = 0", backfilledAt.UnixNano(), backfilledAt.UnixNano())
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 6, Name: "Soft delete chirps into a trash"},
+		migrate: func(tx *sql.Tx) error {
+			// NULL for chirps that aren't deleted, otherwise Unix nanoseconds like the other timestamps
+			_, err := tx.Exec(`
+				ALTER TABLE chirps ADD COLUMN deleted_at INTEGER;
+				CREATE INDEX chirps_deleted_at ON chirps (deleted_at) WHERE deleted_at IS NOT NULL;
+			`)
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 7, Name: "Add a full-text search index over chirp bodies"},
+		migrate: func(tx *sql.Tx) error {
+			// An external content table only stores the index, the triggers keep it in step with chirps
+			// Diacritics are kept so words match the same way they do in the JSON database
+			_, err := tx.Exec(`
+				CREATE VIRTUAL TABLE chirps_fts USING fts5(
+					body,
+					content = 'chirps',
+					content_rowid = 'id',
+					tokenize = 'unicode61 remove_diacritics 0'
+				);
+				CREATE TRIGGER chirps_fts_insert AFTER INSERT ON chirps BEGIN
+					INSERT INTO chirps_fts (rowid, body) VALUES (new.id, new.body);
+				END;
+				CREATE TRIGGER chirps_fts_delete AFTER DELETE ON chirps BEGIN
+					INSERT INTO chirps_fts (chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+				END;
+				CREATE TRIGGER chirps_fts_update AFTER UPDATE OF body ON chirps BEGIN
+					INSERT INTO chirps_fts (chirps_fts, rowid, body) VALUES ('delete', old.id, old.body);
+					INSERT INTO chirps_fts (rowid, body) VALUES (new.id, new.body);
+				END;
+				INSERT INTO chirps_fts (chirps_fts) VALUES ('rebuild');
+			`)
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 8, Name: "Keep the earlier bodies of edited chirps"},
+		migrate: func(tx *sql.Tx) error {
+			// Revisions go when their chirp is purged, like the search index entries
+			_, err := tx.Exec(`
+				ALTER TABLE chirps ADD COLUMN edited INTEGER NOT NULL DEFAULT 0;
+				CREATE TABLE chirp_revisions (
+					chirp_id    INTEGER NOT NULL,
+					revision    INTEGER NOT NULL,
+					body        TEXT NOT NULL,
+					created_at  INTEGER NOT NULL,
+					replaced_at INTEGER NOT NULL,
+					PRIMARY KEY (chirp_id, revision)
+				);
+				CREATE TRIGGER chirp_revisions_delete AFTER DELETE ON chirps BEGIN
+					DELETE FROM chirp_revisions WHERE chirp_id = old.id;
+				END;
+			`)
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 9, Name: "Add replies and tombstones for deleted parents"},
+		migrate: func(tx *sql.Tx) error {
+			// reply_count only counts replies that aren't deleted, the triggers keep it up to date
+			// as replies are created, deleted and restored
+			_, err := tx.Exec(`
+				ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER;
+				ALTER TABLE chirps ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0;
+				ALTER TABLE chirps ADD COLUMN tombstone INTEGER NOT NULL DEFAULT 0;
+				CREATE INDEX chirps_in_reply_to ON chirps (in_reply_to) WHERE in_reply_to IS NOT NULL;
+				CREATE TRIGGER chirps_reply_insert AFTER INSERT ON chirps
+				WHEN new.in_reply_to IS NOT NULL AND new.deleted_at IS NULL BEGIN
+					UPDATE chirps SET reply_count = reply_count + 1 WHERE id = new.in_reply_to;
+				END;
+				CREATE TRIGGER chirps_reply_delete AFTER UPDATE OF deleted_at ON chirps
+				WHEN new.in_reply_to IS NOT NULL AND old.deleted_at IS NULL AND new.deleted_at IS NOT NULL BEGIN
+					UPDATE chirps SET reply_count = reply_count - 1 WHERE id = new.in_reply_to;
+				END;
+				CREATE TRIGGER chirps_reply_restore AFTER UPDATE OF deleted_at ON chirps
+				WHEN new.in_reply_to IS NOT NULL AND old.deleted_at IS NOT NULL AND new.deleted_at IS NULL BEGIN
+					UPDATE chirps SET reply_count = reply_count + 1 WHERE id = new.in_reply_to;
+				END;
+			`)
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 10, Name: "Add likes"},
+		migrate: func(tx *sql.Tx) error {
+			// like_count is kept up to date by the triggers, inside the same transaction as the like itself,
+			// so concurrent likes can't lose counts
+			_, err := tx.Exec(`
+				ALTER TABLE chirps ADD COLUMN like_count INTEGER NOT NULL DEFAULT 0;
+				CREATE TABLE chirp_likes (
+					chirp_id   INTEGER NOT NULL,
+					user_id    INTEGER NOT NULL,
+					liked_at   INTEGER NOT NULL,
+					PRIMARY KEY (chirp_id, user_id)
+				);
+				CREATE INDEX chirp_likes_user_id ON chirp_likes (user_id, liked_at);
+				CREATE TRIGGER chirp_likes_insert AFTER INSERT ON chirp_likes BEGIN
+					UPDATE chirps SET like_count = like_count + 1 WHERE id = new.chirp_id;
+				END;
+				CREATE TRIGGER chirp_likes_delete AFTER DELETE ON chirp_likes BEGIN
+					UPDATE chirps SET like_count = like_count - 1 WHERE id = old.chirp_id;
+				END;
+				CREATE TRIGGER chirps_likes_purge AFTER DELETE ON chirps BEGIN
+					DELETE FROM chirp_likes WHERE chirp_id = old.id;
+				END;
+			`)
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 11, Name: "Add rechirps and quote-chirps"},
+		migrate: func(tx *sql.Tx) error {
+			// No foreign keys, a reshare outlives its original being purged and shows a tombstone instead
+			_, err := tx.Exec(`
+				ALTER TABLE chirps ADD COLUMN rechirp_of INTEGER;
+				ALTER TABLE chirps ADD COLUMN quote_of INTEGER;
+				CREATE INDEX chirps_rechirp_of ON chirps (author_id, rechirp_of) WHERE rechirp_of IS NOT NULL;
+			`)
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 12, Name: "Find hashtags, mentions and URLs in chirps"},
+		migrate: func(tx *sql.Tx) error {
+			// The entities are shown as they are stored, the tag and mention tables are only there to look chirps up
+			_, err := tx.Exec(`
+				ALTER TABLE chirps ADD COLUMN entities TEXT;
+				CREATE TABLE chirp_tags (
+					tag      TEXT NOT NULL,
+					chirp_id INTEGER NOT NULL,
+					PRIMARY KEY (tag, chirp_id)
+				);
+				CREATE TABLE chirp_mentions (
+					user_id  INTEGER NOT NULL,
+					chirp_id INTEGER NOT NULL,
+					PRIMARY KEY (user_id, chirp_id)
+				);
+				CREATE INDEX users_handle ON users (` + sqliteUserHandle + `);
+				CREATE TRIGGER chirps_entities_purge AFTER DELETE ON chirps BEGIN
+					DELETE FROM chirp_tags WHERE chirp_id = old.id;
+					DELETE FROM chirp_mentions WHERE chirp_id = old.id;
+				END;
+			`)
+			if err != nil {
+				return err
+			}
+
+			// Finding the entities needs Go. Mentions resolve to whoever has the handle now,
+			// which is as close to posting time as it gets
+			rows, err := tx.Query("SELECT id, body FROM chirps WHERE body != ''")
+			if err != nil {
+				return err
+			}
+			bodies := map[int]string{}
+			for rows.Next() {
+				var id int
+				var body string
+				err = rows.Scan(&id, &body)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				bodies[id] = body
+			}
+			rows.Close()
+			if rows.Err() != nil {
+				return rows.Err()
+			}
+
+			for id, body := range bodies {
+				chirp := Chirp{Id: id}
+				chirp.Entities, err = findSQLiteEntities(tx, body)
+				if err != nil {
+					return err
+				}
+				entities, err := encodeSQLiteList(chirp.Entities)
+				if err != nil {
+					return err
+				}
+				_, err = tx.Exec("UPDATE chirps SET entities = ? WHERE id = ?", entities, id)
+				if err != nil {
+					return err
+				}
+				err = saveSQLiteEntities(tx, chirp)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 13, Name: "Add media attachments"},
+		migrate: func(tx *sql.Tx) error {
+			// Media never changes once it is uploaded, so chirps keep a copy of what they have attached in the media column
+			_, err := tx.Exec(`
+				CREATE TABLE media (
+					id           TEXT PRIMARY KEY,
+					owner_id     INTEGER NOT NULL,
+					content_type TEXT NOT NULL,
+					size         INTEGER NOT NULL,
+					width        INTEGER NOT NULL,
+					height       INTEGER NOT NULL,
+					blob_key     TEXT NOT NULL,
+					url          TEXT NOT NULL,
+					created_at   INTEGER NOT NULL
+				);
+				ALTER TABLE chirps ADD COLUMN media TEXT;
+			`)
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 14, Name: "Add image renditions and avatars"},
+		migrate: func(tx *sql.Tx) error {
+			// Renditions are a JSON list. Users keep a copy of their avatar's media, like chirps do of theirs
+			_, err := tx.Exec(`
+				ALTER TABLE media ADD COLUMN renditions TEXT;
+				ALTER TABLE media ADD COLUMN placeholder TEXT NOT NULL DEFAULT '';
+				ALTER TABLE users ADD COLUMN avatar TEXT;
+			`)
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 15, Name: "Add polls"},
+		migrate: func(tx *sql.Tx) error {
+			// The primary key is what limits each user to one vote. A vote lists every option it picked,
+			// so multiple choice votes are still one row
+			_, err := tx.Exec(`
+				ALTER TABLE chirps ADD COLUMN poll TEXT;
+				CREATE TABLE poll_votes (
+					chirp_id INTEGER NOT NULL,
+					user_id  INTEGER NOT NULL,
+					options  TEXT NOT NULL,
+					voted_at INTEGER NOT NULL,
+					PRIMARY KEY (chirp_id, user_id)
+				);
+				CREATE TRIGGER chirps_poll_votes_purge AFTER DELETE ON chirps BEGIN
+					DELETE FROM poll_votes WHERE chirp_id = old.id;
+				END;
+			`)
+			return err
+		},
+	},
+	{
+		MigrationInfo: MigrationInfo{Version: 16, Name: "Add drafts and scheduled chirps"},
+		migrate: func(tx *sql.Tx) error {
+			// Drafts are checked again when they are published, so the chirps they link to and their media
+			// are plain IDs rather than foreign keys. The partial index is what the scheduler reads due drafts from
+			_, err := tx.Exec(`
+				CREATE TABLE drafts (
+					id            INTEGER PRIMARY KEY AUTOINCREMENT,
+					author_id     INTEGER NOT NULL,
+					body          TEXT NOT NULL,
+					in_reply_to   INTEGER,
+					rechirp_of    INTEGER,
+					quote_of      INTEGER,
+					media_ids     TEXT,
+					poll          TEXT,
+					publish_at    INTEGER,
+					publish_error TEXT,
+					created_at    INTEGER NOT NULL,
+					updated_at    INTEGER NOT NULL
+				);
+				CREATE INDEX drafts_author_id ON drafts (author_id);
+				CREATE INDEX drafts_publish_at ON drafts (publish_at) WHERE publish_at IS NOT NULL;
+			`)
+			return err
+		},
+	},
+}
+
+// The schema version a fully migrated SQLite database is at
+func latestSQLiteSchemaVersion() int {
+	return sqliteMigrations[len(sqliteMigrations)-1].Version
+}
+
+// Returns the schema version stored in the database file
+func (db *SQLiteDB) schemaVersion() (int, error) {
+	version := 0
+	err := db.conn.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// Runs any pending migrations in a single transaction. With dryRun, the transaction is rolled back
+// at the end, so failures are still reported but nothing is saved
+func (db *SQLiteDB) Migrate(dryRun bool) (MigrationReport, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return MigrationReport{}, err
+	}
+	defer tx.Rollback()
+
+	version := 0
+	err = tx.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return MigrationReport{}, err
+	}
+	report := MigrationReport{FromVersion: version, ToVersion: version, DryRun: dryRun, Applied: []MigrationInfo{}}
+
+	for _, migration := range sqliteMigrations {
+		if migration.Version <= version {
+			continue
+		}
+		err = migration.migrate(tx)
+		if err != nil {
+			return report, fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+		// PRAGMA doesn't take bound parameters, the version is always an int from the list above
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", migration.Version))
+		if err != nil {
+			return report, err
+		}
+		report.ToVersion = migration.Version
+		report.Applied = append(report.Applied, migration.MigrationInfo)
+	}
+
+	if dryRun || len(report.Applied) == 0 {
+		return report, nil
+	}
+	return report, tx.Commit()
+}
+
+// Adds a column to a table created before the column existed. Does nothing if it is already there
+// SQLite can't add a UNIQUE column, so uniqueness is enforced with an index instead
+func addSQLiteColumn(tx *sql.Tx, table, column, columnType string) error {
+	var found int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&found)
+	if err != nil || found > 0 {
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + columnType)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + table + "_" + column + " ON " + table + " (" + column + ")")
+	return err
+}
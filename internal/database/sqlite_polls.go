@@ -0,0 +1,158 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Returns the chirp's poll as viewerID sees it at now, or nil if it doesn't have one
+// viewerID is 0 for someone who isn't logged in
+func (db *SQLiteDB) pollView(chirp Chirp, viewerID int, now time.Time) (*Poll, error) {
+	if chirp.Poll == nil {
+		return nil, nil
+	}
+	results := PollResults{Votes: make([]int, len(chirp.Poll.Options))}
+	rows, err := db.conn.Query(`SELECT option.value, COUNT(*) FROM poll_votes, json_each(poll_votes.options) AS option
+		WHERE chirp_id = ? GROUP BY option.value`, chirp.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var option, votes int
+		err = rows.Scan(&option, &votes)
+		if err != nil {
+			return nil, err
+		}
+		if option >= 0 && option < len(results.Votes) {
+			results.Votes[option] = votes
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	err = db.conn.QueryRow("SELECT COUNT(*) FROM poll_votes WHERE chirp_id = ?", chirp.Id).Scan(&results.VoterCount)
+	if err != nil {
+		return nil, err
+	}
+
+	var myVote *PollVote
+	if viewerID != 0 {
+		vote := PollVote{}
+		var options string
+		var votedAt int64
+		err = db.conn.QueryRow("SELECT options, voted_at FROM poll_votes WHERE chirp_id = ? AND user_id = ?", chirp.Id, viewerID).
+			Scan(&options, &votedAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		if err == nil {
+			err = json.Unmarshal([]byte(options), &vote.Options)
+			if err != nil {
+				return nil, err
+			}
+			vote.VotedAt = sqliteTime(votedAt)
+			myVote = &vote
+		}
+	}
+	return chirp.Poll.view(results, myVote, now), nil
+}
+
+// Votes in a chirp's poll as the user, for the options at the given indexes
+// Returns the poll with its results, which the user can see now that they have voted
+func (db *SQLiteDB) VotePoll(chirpID, userID int, options []int) (Poll, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Poll{}, err
+	}
+	defer tx.Rollback()
+
+	chirp := Chirp{Id: chirpID}
+	encodedPoll := sql.NullString{}
+	err = tx.QueryRow("SELECT poll FROM chirps WHERE id = ? AND deleted_at IS NULL", chirpID).Scan(&encodedPoll)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Poll{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Poll{}, err
+	}
+	if !encodedPoll.Valid {
+		return Poll{}, ErrNoPoll
+	}
+	err = json.Unmarshal([]byte(encodedPoll.String), &chirp.Poll)
+	if err != nil {
+		return Poll{}, err
+	}
+	var found int
+	err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", userID).Scan(&found)
+	if err != nil {
+		return Poll{}, err
+	}
+	if found == 0 {
+		return Poll{}, ErrUserNotFound
+	}
+	now := timestamp()
+	if chirp.Poll.closed(now) {
+		return Poll{}, ErrPollClosed
+	}
+	options, err = chirp.Poll.checkVote(options)
+	if err != nil {
+		return Poll{}, err
+	}
+	encodedOptions, err := json.Marshal(options)
+	if err != nil {
+		return Poll{}, err
+	}
+
+	// The primary key turns a second vote by the same user into a no-op, even if two race each other
+	result, err := tx.Exec("INSERT OR IGNORE INTO poll_votes (chirp_id, user_id, options, voted_at) VALUES (?, ?, ?, ?)",
+		chirpID, userID, string(encodedOptions), now.UnixNano())
+	if err != nil {
+		return Poll{}, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return Poll{}, err
+	}
+	if inserted == 0 {
+		return Poll{}, ErrAlreadyVoted
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Poll{}, err
+	}
+
+	poll, err := db.pollView(chirp, userID, now)
+	if err != nil {
+		return Poll{}, err
+	}
+	return *poll, nil
+}
+
+// Returns a chirp's poll as viewerID sees it. viewerID is 0 for someone who isn't logged in
+func (db *SQLiteDB) GetPoll(chirpID, viewerID int) (Poll, error) {
+	chirp := Chirp{Id: chirpID}
+	encodedPoll := sql.NullString{}
+	err := db.conn.QueryRow("SELECT poll FROM chirps WHERE id = ? AND deleted_at IS NULL", chirpID).Scan(&encodedPoll)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Poll{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Poll{}, err
+	}
+	if !encodedPoll.Valid {
+		return Poll{}, ErrNoPoll
+	}
+	err = json.Unmarshal([]byte(encodedPoll.String), &chirp.Poll)
+	if err != nil {
+		return Poll{}, err
+	}
+	poll, err := db.pollView(chirp, viewerID, timestamp())
+	if err != nil {
+		return Poll{}, err
+	}
+	return *poll, nil
+}
@@ -0,0 +1,54 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// Returns the chirp a new reshare should point at, following a rechirp to what it rechirped
+// Rechirps always point at a chirp that isn't one, so this never has to go more than one step
+func resolveSQLiteOriginal(tx *sql.Tx, originalID int) (int, error) {
+	rechirpOf := sql.NullInt64{}
+	err := tx.QueryRow("SELECT rechirp_of FROM chirps WHERE id = ? AND deleted_at IS NULL", originalID).Scan(&rechirpOf)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrOriginalNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !rechirpOf.Valid {
+		return originalID, nil
+	}
+	return resolveSQLiteOriginal(tx, int(rechirpOf.Int64))
+}
+
+// Fills in the original of every reshare in chirps, reading all of them in one query
+func (db *SQLiteDB) embedOriginals(chirps []Chirp) error {
+	originalIDs := []any{}
+	for _, chirp := range chirps {
+		if originalID := chirp.originalID(); originalID != 0 {
+			originalIDs = append(originalIDs, originalID)
+		}
+	}
+	if len(originalIDs) == 0 {
+		return nil
+	}
+
+	placeholders := strings.Repeat(", ?", len(originalIDs))[2:]
+	originals, err := db.queryChirps("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id IN ("+placeholders+")", originalIDs...)
+	if err != nil {
+		return err
+	}
+	byID := make(map[int]Chirp, len(originals))
+	for _, original := range originals {
+		byID[original.Id] = original
+	}
+	for i, chirp := range chirps {
+		if originalID := chirp.originalID(); originalID != 0 {
+			original, ok := byID[originalID]
+			chirps[i].Original = embeddedOriginal(original, ok, originalID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package database
+
+import "strings"
+
+// Returns a page of the chirps matching every clause of the search, best match first
+// FTS5 finds the matches, and they are scored the same way as in the JSON database rather than with bm25(),
+// which weighs words by how rare they are across every chirp and would move results between pages
+func (db *SQLiteDB) SearchChirps(query SearchQuery) ([]SearchResult, error) {
+	clauses := parseSearchQuery(query.Text)
+	if len(clauses) == 0 {
+		return nil, ErrEmptySearch
+	}
+
+	rows, err := db.conn.Query("SELECT id, body FROM chirps WHERE deleted_at IS NULL AND "+
+		"id IN (SELECT rowid FROM chirps_fts WHERE chirps_fts MATCH ?)", ftsMatchExpression(clauses))
+	if err != nil {
+		return nil, err
+	}
+	results := []SearchResult{}
+	for rows.Next() {
+		var chirpID int
+		var body string
+		err = rows.Scan(&chirpID, &body)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		positions := termPositions(body)
+		score := 0.0
+		for _, clause := range clauses {
+			score += clauseScore(clause.occurrences(positions))
+		}
+		if query.after(score, chirpID) {
+			results = append(results, SearchResult{Chirp: Chirp{Id: chirpID}, Score: score})
+		}
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	results = rankSearchResults(results, query.Limit)
+	if len(results) == 0 {
+		return results, nil
+	}
+
+	// Only the chirps on the page are read in full
+	ids := make([]any, len(results))
+	for i, result := range results {
+		ids[i] = result.Id
+	}
+	chirpRows, err := db.conn.Query("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id IN (?"+
+		strings.Repeat(", ?", len(ids)-1)+")", ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer chirpRows.Close()
+	byID := map[int]Chirp{}
+	for chirpRows.Next() {
+		chirp, err := scanSQLiteChirp(chirpRows)
+		if err != nil {
+			return nil, err
+		}
+		byID[chirp.Id] = chirp
+	}
+	err = chirpRows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	chirps := make([]Chirp, len(results))
+	for i, result := range results {
+		chirps[i] = byID[result.Id]
+	}
+	err = db.expand(chirps, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Chirp = chirps[i]
+	}
+	return results, nil
+}
+
+// Turns parsed search clauses into an FTS5 query. Every term is quoted, so nothing the user
+// typed can be read as FTS5 syntax. Terms only hold letters and digits, so they never contain a quote
+func ftsMatchExpression(clauses []searchClause) string {
+	parts := make([]string, 0, len(clauses))
+	for _, clause := range clauses {
+		part := `"` + strings.Join(clause.terms, " ") + `"`
+		if clause.prefix {
+			part += "*"
+		}
+		parts = append(parts, part)
+	}
+	// Clauses separated by spaces all have to match
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,58 @@
+package database
+
+// Returns the thread around a chirp, going up to depth levels up to its ancestors and down into its replies
+// Deleted chirps are not found
+func (db *SQLiteDB) GetThread(chirpID, depth int) (Thread, error) {
+	chirp, err := db.GetChirp(chirpID)
+	if err != nil {
+		return Thread{}, err
+	}
+
+	// Both directions are walked with recursive queries, which stop at the depth limit
+	ancestors, err := db.queryChirps(`
+		WITH RECURSIVE ancestors (ancestor_id, level) AS (
+			SELECT in_reply_to, 1 FROM chirps WHERE id = ?
+			UNION ALL
+			SELECT chirps.in_reply_to, level + 1 FROM chirps JOIN ancestors ON chirps.id = ancestor_id WHERE level < ?
+		)
+		SELECT `+sqliteChirpColumns+` FROM chirps JOIN ancestors ON id = ancestor_id ORDER BY level`, chirpID, depth)
+	if err != nil {
+		return Thread{}, err
+	}
+	descendants, err := db.queryChirps(`
+		WITH RECURSIVE descendants (descendant_id, level) AS (
+			SELECT id, 1 FROM chirps WHERE in_reply_to = ?
+			UNION ALL
+			SELECT chirps.id, level + 1 FROM chirps JOIN descendants ON chirps.in_reply_to = descendant_id WHERE level < ?
+		)
+		SELECT `+sqliteChirpColumns+` FROM chirps JOIN descendants ON id = descendant_id ORDER BY id`, chirpID, depth)
+	if err != nil {
+		return Thread{}, err
+	}
+	for _, chirps := range [][]Chirp{ancestors, descendants} {
+		err = db.expand(chirps, 0)
+		if err != nil {
+			return Thread{}, err
+		}
+	}
+	return buildThread(chirp, ancestors, descendants), nil
+}
+
+// Runs a query that selects sqliteChirpColumns and returns the chirps
+func (db *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanSQLiteChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	auth "github.com/ellielle/chirpy/internal/auth"
+)
+
+// Takes a stringified version of a refresh token and adds it to the database as revoked, along with a timestamp
+func (db *SQLiteDB) RevokeToken(token string) error {
+	return revokeSQLiteToken(db.conn, token)
+}
+
+// Deletes revoked tokens that expired before now, since they can't be used anymore either way
+// Returns how many were deleted and how many are left
+func (db *SQLiteDB) SweepRevokedTokens(now time.Time) (int, int, error) {
+	result, err := db.conn.Exec("DELETE FROM revoked_token_hashes WHERE expires_at < ?", now.Unix())
+	if err != nil {
+		return 0, 0, err
+	}
+	swept, err := result.RowsAffected()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	remaining := 0
+	err = db.conn.QueryRow("SELECT COUNT(*) FROM revoked_token_hashes").Scan(&remaining)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(swept), remaining, nil
+}
+
+// Adds a refresh token to revoked_token_hashes, keyed by its hash and with its expiry
+// Works with either the connection or a transaction
+func revokeSQLiteToken(conn interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}, token string) error {
+	now := time.Now()
+	expiresAt := tokenExpiry(token, now.Add(refreshTokenLifetime))
+	_, err := conn.Exec("INSERT OR REPLACE INTO revoked_token_hashes (token_hash, revoked_at, expires_at) VALUES (?, ?, ?)",
+		tokenKey(token), now, expiresAt.Unix())
+	return err
+}
+
+// Takes a refresh token, finds the user by ID lookup, generates and returns a new access token
+// The old refresh token is revoked in the same transaction as the revoked check
+func (db *SQLiteDB) RefreshToken(token *jwt.Token, stringToken, jwtSecret string) (string, error) {
+	id, err := token.Claims.GetSubject()
+	if err != nil {
+		return "", ErrUserNotFound
+	}
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		return "", ErrUserNotFound
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Check for revoked status on the token before proceeding
+	var revoked int
+	err = tx.QueryRow("SELECT COUNT(*) FROM revoked_token_hashes WHERE token_hash = ?", tokenKey(stringToken)).Scan(&revoked)
+	if err != nil {
+		return "", err
+	}
+	if revoked > 0 {
+		return "", ErrTokenRevoked
+	}
+
+	var exists int
+	err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", userID).Scan(&exists)
+	if err != nil {
+		return "", err
+	}
+	if exists == 0 {
+		return "", ErrUserNotFound
+	}
+
+	accessToken, err := auth.CreateJWT(auth.User{Id: userID}, jwtSecret, true)
+	if err != nil {
+		return "", err
+	}
+
+	// Revoke old refresh token and save it with a timestamp
+	err = revokeSQLiteToken(tx, stringToken)
+	if err != nil {
+		return "", err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	return accessToken, nil
+}
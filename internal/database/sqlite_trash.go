@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Returns the deleted chirps of an author that are still within the trash retention, in ascending order based on ID
+func (db *SQLiteDB) GetTrash(authorID int) ([]Chirp, error) {
+	cutoff := time.Now().Add(-db.opts.TrashRetention)
+	rows, err := db.conn.Query("SELECT "+sqliteChirpColumns+" FROM chirps WHERE author_id = ? AND deleted_at >= ? ORDER BY id",
+		authorID, cutoff.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trash := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanSQLiteChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		trash = append(trash, chirp)
+	}
+	return trash, rows.Err()
+}
+
+// Takes a chirp back out of its author's trash. Chirps deleted longer ago than the trash retention
+// can't be restored, even if they haven't been purged yet
+func (db *SQLiteDB) RestoreChirp(chirpID, authorID int) (Chirp, error) {
+	cutoff := time.Now().Add(-db.opts.TrashRetention)
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanSQLiteChirp(tx.QueryRow("SELECT "+sqliteChirpColumns+" FROM chirps WHERE id = ? AND deleted_at >= ?",
+		chirpID, cutoff.UnixNano()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrChirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	// Only the author can restore their chirp
+	if chirp.AuthorId != authorID {
+		return Chirp{}, ErrUnauthorized
+	}
+
+	_, err = tx.Exec("UPDATE chirps SET deleted_at = NULL WHERE id = ?", chirpID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.DeletedAt = nil
+	return chirp, nil
+}
+
+// Permanently removes chirps that were deleted longer than the trash retention before now
+// Chirps with replies are kept as tombstones so the replies aren't orphaned. Media that nothing refers to
+// anymore, once purged chirps are gone, is removed too if it was uploaded longer than the media retention
+// before now. Returns how many chirps were purged and the media removed, whose files can be deleted
+func (db *SQLiteDB) PurgeDeletedChirps(now time.Time) (int, []Media, error) {
+	cutoff := now.Add(-db.opts.TrashRetention)
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	purged := 0
+	err = tx.QueryRow("SELECT COUNT(*) FROM chirps WHERE deleted_at < ? AND tombstone = 0", cutoff.UnixNano()).Scan(&purged)
+	if err != nil {
+		return 0, nil, err
+	}
+	if purged > 0 {
+		err = purgeSQLiteChirps(tx, cutoff)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	// Purged chirps may have been the last to refer to their media, so only look once they are gone
+	removed, err := deleteUnusedSQLiteMedia(tx, now.Add(-db.opts.MediaRetention))
+	if err != nil {
+		return 0, nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, nil, err
+	}
+	return purged, removed, nil
+}
+
+// Removes the chirps deleted before cutoff, leaving tombstones for those that still have replies
+func purgeSQLiteChirps(tx *sql.Tx, cutoff time.Time) error {
+	// Removing a reply can leave its parent without replies, so keep going until nothing else can be removed
+	// Tombstones whose replies have all been purged go too
+	for {
+		result, err := tx.Exec(`DELETE FROM chirps WHERE deleted_at < ?
+			AND id NOT IN (SELECT in_reply_to FROM chirps WHERE in_reply_to IS NOT NULL)`, cutoff.UnixNano())
+		if err != nil {
+			return err
+		}
+		removed, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			break
+		}
+	}
+	_, err := tx.Exec("UPDATE chirps SET body = '', entities = NULL, media = NULL, poll = NULL, tombstone = 1 WHERE deleted_at < ? AND tombstone = 0", cutoff.UnixNano())
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"chirp_revisions", "chirp_likes", "chirp_tags", "chirp_mentions", "poll_votes"} {
+		_, err = tx.Exec("DELETE FROM " + table + " WHERE chirp_id IN (SELECT id FROM chirps WHERE tombstone = 1)")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	auth "github.com/ellielle/chirpy/internal/auth"
+)
+
+const sqliteUserColumns = "id, uid, email, password, is_chirpy_red, avatar, created_at, updated_at"
+
+// Creates a new User and saves it to the users table
+func (db *SQLiteDB) CreateUser(email, password string) (User, error) {
+	_, err := db.getUserByEmail(email)
+	if err == nil {
+		return User{}, ErrUserTaken
+	}
+
+	// hash password with bcrypt
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	uid := sql.NullString{}
+	if db.opts.OpaqueIDs {
+		uid = sql.NullString{String: newOpaqueID(), Valid: true}
+	}
+
+	createdAt := timestamp()
+	result, err := db.conn.Exec("INSERT INTO users (uid, email, password, is_chirpy_red, created_at, updated_at) VALUES (?, ?, ?, 0, ?, ?)",
+		uid, email, hash, createdAt.UnixNano(), createdAt.UnixNano())
+	if isUniqueViolation(err) {
+		// Someone else registered the email between the check above and the insert
+		return User{}, ErrUserTaken
+	}
+	if err != nil {
+		return User{}, err
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{
+		Id:          int(userID),
+		Uid:         uid.String,
+		Email:       email,
+		Password:    hash,
+		IsChirpyRed: false,
+		CreatedAt:   createdAt,
+		UpdatedAt:   createdAt,
+	}, nil
+}
+
+// Logs user in by email and password by matching hashed
+// passwords
+func (db *SQLiteDB) LoginUser(email, password string) (User, error) {
+	foundUser, err := db.getUserByEmail(email)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = auth.CheckPasswordHash(foundUser.Password, password)
+	if err != nil {
+		return User{}, ErrInvalidLogin
+	}
+
+	return foundUser, nil
+}
+
+// Update user email/password using an authentication token
+// Both email and password are optional parameters to the
+// PUT endpoint api/users
+func (db *SQLiteDB) UpdateUser(id string, updates ...string) (User, error) {
+	if len(updates) == 0 {
+		return User{}, ErrNoUpdates
+	}
+
+	intID, err := strconv.Atoi(id)
+	if err != nil {
+		return User{}, err
+	}
+
+	user, err := db.getUserById(intID)
+	if err != nil {
+		return User{}, err
+	}
+
+	if len(updates) > 0 && updates[0] != "" {
+		user.Email = updates[0]
+	}
+	if len(updates) > 1 && updates[1] != "" {
+		user.Password, err = auth.HashPassword(updates[1])
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	user.UpdatedAt = timestamp()
+	_, err = db.conn.Exec("UPDATE users SET email = ?, password = ?, updated_at = ? WHERE id = ?",
+		user.Email, user.Password, user.UpdatedAt.UnixNano(), user.Id)
+	if isUniqueViolation(err) {
+		return User{}, ErrUserTaken
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *SQLiteDB) UpgradeUser(id int) error {
+	result, err := db.conn.Exec("UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ?", timestamp().UnixNano(), id)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Find User by ID when user supplies an auth token
+func (db *SQLiteDB) getUserById(id int) (User, error) {
+	return scanSQLiteUser(db.conn.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", id))
+}
+
+// Find User in database by email, ignoring case, using the users_email_nocase index
+// Will return an error if the user does not exist
+func (db *SQLiteDB) getUserByEmail(email string) (User, error) {
+	return scanSQLiteUser(db.conn.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE email = ? COLLATE NOCASE", email))
+}
+
+// Scans a single users row, returning ErrInvalidLogin when there is no match
+func scanSQLiteUser(row *sql.Row) (User, error) {
+	user := User{}
+	uid := sql.NullString{}
+	avatar := sql.NullString{}
+	var createdAt, updatedAt int64
+	err := row.Scan(&user.Id, &uid, &user.Email, &user.Password, &user.IsChirpyRed, &avatar, &createdAt, &updatedAt)
+	user.Uid = uid.String
+	user.CreatedAt = sqliteTime(createdAt)
+	user.UpdatedAt = sqliteTime(updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrInvalidLogin
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if avatar.Valid {
+		err = json.Unmarshal([]byte(avatar.String), &user.Avatar)
+		if err != nil {
+			return User{}, err
+		}
+	}
+	return user, nil
+}
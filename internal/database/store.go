@@ -0,0 +1,105 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Store is the storage interface the handlers talk to. The JSON file database (DB)
+// and the SQLite database (SQLiteDB) both implement it
+type Store interface {
+	// Creates a chirp, linked to the chirps it replies to, rechirps or quotes by params
+	CreateChirp(body, id string, params ChirpParams) (Chirp, error)
+	GetChirps(query ChirpQuery) ([]Chirp, error)
+	GetChirp(chirpID int) (Chirp, error)
+	DeleteChirp(chirpID, authorID int) error
+	// Replaces a chirp's body, keeping the old one as a revision. Returns ErrEditWindowClosed once the author can't edit it anymore
+	EditChirp(chirpID, authorID int, body string) (Chirp, error)
+	// Lists the earlier bodies of an edited chirp, oldest first
+	GetChirpHistory(chirpID int) ([]ChirpRevision, error)
+	// Returns the ancestors and replies of a chirp, depth levels up and down from it
+	GetThread(chirpID, depth int) (Thread, error)
+	// Likes and unlikes are idempotent, and return the chirp with its new like count
+	LikeChirp(chirpID, userID int) (Chirp, error)
+	UnlikeChirp(chirpID, userID int) (Chirp, error)
+	// Lists the chirps a user has liked, most recently liked first
+	GetLikedChirps(userID int) ([]Chirp, error)
+	// Votes in a chirp's poll, once per user, returning the poll with its results
+	VotePoll(chirpID, userID int, options []int) (Poll, error)
+	// Returns a chirp's poll, with its results if the viewer has voted or it has closed
+	GetPoll(chirpID, viewerID int) (Poll, error)
+	// Saves a draft, checked like a new chirp posted at publishAt. A non-zero publishAt schedules it
+	CreateDraft(authorID int, body string, params ChirpParams, publishAt time.Time) (Draft, error)
+	// Lists the author's drafts, scheduled ones included
+	GetDrafts(authorID int) ([]Draft, error)
+	UpdateDraft(draftID, authorID int, body string, params ChirpParams, publishAt time.Time) (Draft, error)
+	DeleteDraft(draftID, authorID int) error
+	// Publishes a draft as a chirp now, checking it again. The draft is gone once the chirp exists
+	PublishDraft(draftID, authorID int) (Chirp, error)
+	// Publishes the scheduled drafts due at now, each exactly once, returning how many were published
+	// and how many were unscheduled for failing the checks
+	PublishDueDrafts(now time.Time) (published int, failed int, err error)
+	// Saves the record of an uploaded file that is already in the blob store
+	CreateMedia(media Media) (Media, error)
+	ResolveChirpID(ref string) (int, error)
+	// Full-text search over chirp bodies, leaving out deleted chirps
+	SearchChirps(query SearchQuery) ([]SearchResult, error)
+	// Lists an author's deleted chirps that can still be restored
+	GetTrash(authorID int) ([]Chirp, error)
+	RestoreChirp(chirpID, authorID int) (Chirp, error)
+	// Permanently removes chirps deleted longer than the trash retention before now, returning how many,
+	// along with the media nothing refers to anymore, whose files can be deleted
+	PurgeDeletedChirps(now time.Time) (int, []Media, error)
+
+	CreateUser(email, password string) (User, error)
+	LoginUser(email, password string) (User, error)
+	UpdateUser(id string, updates ...string) (User, error)
+	UpgradeUser(id int) error
+	// Saves the record of an uploaded file that is already in the blob store and makes it its owner's avatar,
+	// returning the updated user
+	CreateAvatar(media Media) (User, error)
+
+	RevokeToken(token string) error
+	RefreshToken(token *jwt.Token, stringToken, jwtSecret string) (string, error)
+	// Deletes revoked tokens that have expired, returning how many were deleted and how many are left
+	SweepRevokedTokens(now time.Time) (swept int, remaining int, err error)
+
+	// Runs pending schema migrations, or with dryRun only reports what would run
+	Migrate(dryRun bool) (MigrationReport, error)
+	// Returns a consistent point-in-time copy of the database in its on-disk format
+	Snapshot() ([]byte, error)
+
+	DebugWipeTestDatabase()
+	// Flushes anything still pending and releases the database
+	Close() error
+}
+
+// Backends that can be chosen with the DB_BACKEND environment variable
+const (
+	BackendJSON   = "json"
+	BackendSQLite = "sqlite"
+)
+
+var ErrUnknownBackend = errors.New("Unknown database backend")
+
+// Opens the Store for the given backend. An empty backend defaults to the JSON file database
+// Only opts.OpaqueIDs applies to the SQLite database, and it refuses opts.Keys rather than storing data unencrypted
+func NewStore(backend, path string, opts Options) (Store, error) {
+	switch backend {
+	case "", BackendJSON:
+		return NewDBConnection(path, opts)
+	case BackendSQLite:
+		if opts.Keys != nil {
+			return nil, ErrEncryptionUnsupported
+		}
+		db, err := NewSQLiteConnection(path, opts)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	default:
+		return nil, ErrUnknownBackend
+	}
+}
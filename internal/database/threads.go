@@ -0,0 +1,154 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+var ErrParentNotFound = errors.New("Chirp being replied to not found")
+
+// A chirp with the replies below it, as far down as the thread was asked for
+type ThreadNode struct {
+	Chirp
+	Replies []ThreadNode `json:"replies"`
+}
+
+// A conversation around one chirp: the chain of chirps it replies to, and the tree of replies to it
+// Deleted chirps that still have replies are shown as tombstones, keeping their place in the thread
+type Thread struct {
+	// From the start of the conversation down to the chirp's parent
+	Ancestors []Chirp    `json:"ancestors"`
+	Chirp     ThreadNode `json:"chirp"`
+}
+
+// Adds delta to the reply count of the chirp's parent, if it has one that still exists
+func (dbStructure *DBStructure) countReply(chirp Chirp, delta int) {
+	parent, ok := dbStructure.Chirps[chirp.InReplyTo]
+	if chirp.InReplyTo == 0 || !ok {
+		return
+	}
+	parent.ReplyCount += delta
+	dbStructure.putChirp(parent)
+}
+
+// Reports whether a chirp has been in the trash for longer than the retention, given the cutoff
+// that retention works out to. Tombstones have already been purged
+func (chirp Chirp) expired(cutoff time.Time) bool {
+	return chirp.deleted() && !chirp.Tombstone && chirp.DeletedAt.Before(cutoff)
+}
+
+// Purges a chirp if it expired before cutoff. A chirp with replies is turned into a tombstone instead of
+// being removed, so the replies aren't orphaned. Tombstones are removed once their replies are gone
+func (dbStructure *DBStructure) purgeChirp(chirp Chirp, cutoff time.Time) {
+	hasReplies := len(dbStructure.replyIDs[chirp.Id]) > 0
+	if !chirp.expired(cutoff) && !(chirp.Tombstone && !hasReplies) {
+		return
+	}
+	deleteEntry(dbStructure, dbStructure.ChirpRevisions, chirp.Id)
+	deleteEntry(dbStructure, dbStructure.PollVotes, chirp.Id)
+	dbStructure.removeLikes(chirp.Id)
+	if !hasReplies {
+		dbStructure.removeChirp(chirp.Id)
+		return
+	}
+	chirp.Body = ""
+	chirp.Entities = nil
+	chirp.Media = nil
+	chirp.Poll = nil
+	chirp.LikeCount = 0
+	chirp.Tombstone = true
+	dbStructure.putChirp(chirp)
+}
+
+// Returns what a deleted chirp shows in a thread: only where it was, not what it said or who said it
+func (chirp Chirp) tombstone() Chirp {
+	return Chirp{
+		Id:         chirp.Id,
+		Uid:        chirp.Uid,
+		InReplyTo:  chirp.InReplyTo,
+		ReplyCount: chirp.ReplyCount,
+		CreatedAt:  chirp.CreatedAt,
+		UpdatedAt:  chirp.UpdatedAt,
+		DeletedAt:  chirp.DeletedAt,
+		Tombstone:  true,
+	}
+}
+
+// Puts a thread together from a chirp, its ancestors nearest first, and its descendants in ID order
+// Deleted ancestors become tombstones. Deleted descendants do too if they have replies, and are left out otherwise
+func buildThread(chirp Chirp, ancestors []Chirp, descendants []Chirp) Thread {
+	thread := Thread{Ancestors: make([]Chirp, 0, len(ancestors))}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		ancestor := ancestors[i]
+		if ancestor.deleted() {
+			ancestor = ancestor.tombstone()
+		}
+		thread.Ancestors = append(thread.Ancestors, ancestor)
+	}
+
+	children := map[int][]Chirp{}
+	for _, descendant := range descendants {
+		children[descendant.InReplyTo] = append(children[descendant.InReplyTo], descendant)
+	}
+	var build func(chirp Chirp) (ThreadNode, bool)
+	build = func(chirp Chirp) (ThreadNode, bool) {
+		node := ThreadNode{Chirp: chirp, Replies: []ThreadNode{}}
+		for _, child := range children[chirp.Id] {
+			if reply, ok := build(child); ok {
+				node.Replies = append(node.Replies, reply)
+			}
+		}
+		if !chirp.deleted() {
+			return node, true
+		}
+		// Below the depth limit there may be replies that weren't loaded, which the reply count still shows
+		node.Chirp = chirp.tombstone()
+		return node, len(node.Replies) > 0 || chirp.ReplyCount > 0
+	}
+	thread.Chirp, _ = build(chirp)
+	return thread
+}
+
+// Returns the thread around a chirp, going up to depth levels up to its ancestors and down into its replies
+// Deleted chirps are not found
+func (db *DB) GetThread(chirpID, depth int) (Thread, error) {
+	thread := Thread{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		chirp, ok := dbStructure.Chirps[chirpID]
+		if !ok || chirp.deleted() {
+			return ErrChirpNotFound
+		}
+
+		ancestors := []Chirp{}
+		for parentID := chirp.InReplyTo; parentID != 0 && len(ancestors) < depth; {
+			parent, ok := dbStructure.Chirps[parentID]
+			if !ok {
+				break
+			}
+			ancestors = append(ancestors, dbStructure.expand(parent, 0))
+			parentID = parent.InReplyTo
+		}
+
+		descendants := []Chirp{}
+		level := []int{chirpID}
+		for range depth {
+			next := []int{}
+			for _, id := range level {
+				for _, replyID := range dbStructure.replyIDs[id] {
+					descendants = append(descendants, dbStructure.expand(dbStructure.Chirps[replyID], 0))
+					next = append(next, replyID)
+				}
+			}
+			level = next
+		}
+		slices.SortFunc(descendants, func(a, b Chirp) int { return a.Id - b.Id })
+
+		thread = buildThread(dbStructure.expand(chirp, 0), ancestors, descendants)
+		return nil
+	})
+	if err != nil {
+		return Thread{}, err
+	}
+	return thread, nil
+}
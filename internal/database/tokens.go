@@ -1,6 +1,8 @@
 package database
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"strconv"
 	"time"
@@ -14,68 +16,95 @@ var ErrUserNotFound = errors.New("User not found")
 var ErrTokenRevoked = errors.New("Refresh token is revoked")
 var ErrNoUserFound = errors.New("No user found")
 
-// Takes a stringified version of a refresh token and adds it to the database as revoked, along with a timestamp
-func (db *DB) RevokeToken(token string) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
+// Refresh tokens expire 60 days after they are issued, see auth.CreateJWT
+// Used as the expiry of a revoked token whose own expiry can't be read
+const refreshTokenLifetime = 60 * 24 * time.Hour
 
-	err = tokenRevoker(token, &dbStructure)
-	if err != nil {
-		return err
-	}
+// A revoked refresh token. Once the token has expired it would be rejected anyway,
+// so the entry can be swept from the database
+type RevokedToken struct {
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
 
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
-	}
-	return nil
+// Takes a stringified version of a refresh token and adds it to the database as revoked, along with a timestamp
+func (db *DB) RevokeToken(token string) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		return tokenRevoker(token, dbStructure)
+	})
 }
 
 // Revoke old refresh token and save it with a timestamp
 // Takes a refresh token, finds the user by ID lookup, generates and returns a new access token
 func (db *DB) RefreshToken(token *jwt.Token, stringToken, jwtSecret string) (string, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return "", err
-	}
+	accessToken := ""
+	err := db.Update(func(dbStructure *DBStructure) error {
+		// Check for revoked status on the token before proceeding
+		err := tokenRevokedStatus(stringToken, dbStructure)
+		if err != nil {
+			return err
+		}
 
-	// Check for revoked status on the token before proceeding
-	err = tokenRevokedStatus(stringToken, &dbStructure)
-	if err != nil {
-		return "", err
-	}
+		user, err := getUserBySubjectID(token, dbStructure)
+		if err != nil {
+			return ErrUserNotFound
+		}
 
-	user, err := getUserBySubjectID(token, &dbStructure)
-	if err != nil {
-		return "", ErrUserNotFound
-	}
+		accessToken, err = auth.CreateJWT(auth.User{Id: user.Id}, jwtSecret, true)
+		if err != nil {
+			return err
+		}
 
-	accessToken, err := auth.CreateJWT(auth.User{Id: user.Id}, jwtSecret, true)
+		// Revoke old refresh token and save it with a timestamp
+		return tokenRevoker(stringToken, dbStructure)
+	})
 	if err != nil {
 		return "", err
 	}
 
-	// Revoke old refresh token and save it with a timestamp
-	err = tokenRevoker(stringToken, &dbStructure)
-	if err != nil {
-		return "", err
+	return accessToken, nil
+}
+
+// Deletes revoked tokens that expired before now, since they can't be used anymore either way
+// Returns how many were deleted and how many are left
+func (db *DB) SweepRevokedTokens(now time.Time) (int, int, error) {
+	expired := 0
+	remaining := 0
+	db.View(func(dbStructure *DBStructure) error {
+		for _, revoked := range dbStructure.RevokedTokens {
+			if revoked.ExpiresAt.Before(now) {
+				expired++
+			}
+		}
+		remaining = len(dbStructure.RevokedTokens)
+		return nil
+	})
+	// Don't rewrite the database when there is nothing to sweep
+	if expired == 0 {
+		return 0, remaining, nil
 	}
-	err = db.writeDB(dbStructure)
+
+	swept := 0
+	err := db.Update(func(dbStructure *DBStructure) error {
+		before := len(dbStructure.RevokedTokens)
+		err := dbStructure.apply(Event{Type: EventRevokedTokensSwept, At: now})
+		if err != nil {
+			return err
+		}
+		remaining = len(dbStructure.RevokedTokens)
+		swept = before - remaining
+		return nil
+	})
 	if err != nil {
-		return "", err
+		return 0, 0, err
 	}
-
-	return accessToken, nil
+	return swept, remaining, nil
 }
 
 // Returns an error if a refresh token has been revoked
 func tokenRevokedStatus(token string, dbStructure *DBStructure) error {
-	for revToken := range dbStructure.RevokedTokens {
-		if token == revToken {
-			return ErrTokenRevoked
-		}
+	if _, ok := dbStructure.RevokedTokens[tokenKey(token)]; ok {
+		return ErrTokenRevoked
 	}
 	return nil
 }
@@ -83,8 +112,37 @@ func tokenRevokedStatus(token string, dbStructure *DBStructure) error {
 // Revokes a refresh token and adds it to the database with a timestamp
 // A nil return is successful
 func tokenRevoker(token string, dbStructure *DBStructure) error {
-	dbStructure.RevokedTokens[token] = time.Now()
-	return nil
+	now := time.Now()
+	return dbStructure.apply(Event{
+		Type:      EventTokenRevoked,
+		At:        now,
+		TokenHash: tokenKey(token),
+		RevokedToken: &RevokedToken{
+			RevokedAt: now,
+			ExpiresAt: tokenExpiry(token, now.Add(refreshTokenLifetime)),
+		},
+	})
+}
+
+// Returns the key a revoked token is stored under: the hex SHA-256 of the token
+// Storing the hash keeps the database small, and a leaked database doesn't hand out usable tokens
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the expiry of a JWT, or fallback if it can't be read
+// The signature isn't checked, the token was validated before it was revoked
+func tokenExpiry(token string, fallback time.Time) time.Time {
+	jwtToken, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+	if err != nil {
+		return fallback
+	}
+	expiresAt, err := jwtToken.Claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		return fallback
+	}
+	return expiresAt.Time
 }
 
 // Gets a User's ID from a validated JWT's Claims' Subject and returns the User
@@ -98,11 +156,9 @@ func getUserBySubjectID(token *jwt.Token, dbStructure *DBStructure) (User, error
 		return User{}, err
 	}
 
-	for _, user := range dbStructure.Users {
-		if user.Id == userID {
-			return user, nil
-		}
+	user, ok := dbStructure.Users[userID]
+	if !ok {
+		return User{}, ErrNoUserFound
 	}
-
-	return User{}, ErrNoUserFound
+	return user, nil
 }
@@ -0,0 +1,103 @@
+package database
+
+import "time"
+
+// Returns the deleted chirps of an author that are still within the trash retention, in ascending order based on ID
+func (db *DB) GetTrash(authorID int) ([]Chirp, error) {
+	cutoff := time.Now().Add(-db.opts.TrashRetention)
+	trash := []Chirp{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, chirpID := range dbStructure.chirpIDsByAuthor[authorID] {
+			chirp := dbStructure.Chirps[chirpID]
+			if chirp.deleted() && !chirp.DeletedAt.Before(cutoff) {
+				trash = append(trash, chirp)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return trash, nil
+}
+
+// Takes a chirp back out of its author's trash. Chirps deleted longer ago than the trash retention
+// can't be restored, even if they haven't been purged yet
+func (db *DB) RestoreChirp(chirpID, authorID int) (Chirp, error) {
+	cutoff := time.Now().Add(-db.opts.TrashRetention)
+	chirp := Chirp{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		found, ok := dbStructure.Chirps[chirpID]
+		if !ok || !found.deleted() || found.DeletedAt.Before(cutoff) {
+			return ErrChirpNotFound
+		}
+		// Only the author can restore their chirp
+		if found.AuthorId != authorID {
+			return ErrUnauthorized
+		}
+
+		err := dbStructure.apply(Event{Type: EventChirpRestored, ChirpID: chirpID})
+		if err != nil {
+			return err
+		}
+		chirp = dbStructure.Chirps[chirpID]
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+// Permanently removes chirps that were deleted longer than the trash retention before now
+// Chirps with replies are kept as tombstones so the replies aren't orphaned. Media that nothing refers to
+// anymore, once purged chirps are gone, is removed too if it was uploaded longer than the media retention
+// before now. Returns how many chirps were purged and the media removed, whose files can be deleted
+func (db *DB) PurgeDeletedChirps(now time.Time) (int, []Media, error) {
+	cutoff := now.Add(-db.opts.TrashRetention)
+	uploadedBefore := now.Add(-db.opts.MediaRetention)
+	countExpired := func(dbStructure *DBStructure) int {
+		expired := 0
+		for _, chirp := range dbStructure.Chirps {
+			if chirp.expired(cutoff) {
+				expired++
+			}
+		}
+		return expired
+	}
+	expired, unused := 0, 0
+	db.View(func(dbStructure *DBStructure) error {
+		expired = countExpired(dbStructure)
+		unused = len(dbStructure.unusedMedia(uploadedBefore))
+		return nil
+	})
+	// Don't rewrite the database when there is nothing to purge
+	if expired == 0 && unused == 0 {
+		return 0, nil, nil
+	}
+
+	purged := 0
+	removed := []Media{}
+	err := db.Update(func(dbStructure *DBStructure) error {
+		purged = countExpired(dbStructure)
+		if purged > 0 {
+			err := dbStructure.apply(Event{Type: EventChirpsPurged, Before: &cutoff})
+			if err != nil {
+				return err
+			}
+		}
+		// Purged chirps may have been the last to refer to their media, so only look once they are gone
+		mediaIDs := dbStructure.unusedMedia(uploadedBefore)
+		if len(mediaIDs) == 0 {
+			return nil
+		}
+		for _, mediaID := range mediaIDs {
+			removed = append(removed, dbStructure.Media[mediaID])
+		}
+		return dbStructure.apply(Event{Type: EventMediaDeleted, MediaIDs: mediaIDs})
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return purged, removed, nil
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Media is removed by the purge once nothing refers to it and it is past the media retention,
+// and the purge returns it so its files can be deleted
+func TestPurgeRemovesUnusedMedia(t *testing.T) {
+	for _, store := range testStores() {
+		t.Run(store.name, func(t *testing.T) {
+			db, path := openTestStore(t, store)
+			user, err := db.CreateUser("uploader@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			authorID := strconv.Itoa(user.Id)
+			upload := func(name string) Media {
+				t.Helper()
+				media, err := db.CreateMedia(Media{
+					OwnerID:     user.Id,
+					ContentType: "image/png",
+					BlobKey:     name + ".png",
+					URL:         "/media/" + name + ".png",
+					Renditions:  []Rendition{{Name: "thumb", ContentType: "image/jpeg", BlobKey: name + "-thumb.jpg"}},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return media
+			}
+			trashed, unattached, drafted, attached := upload("trashed"), upload("unattached"), upload("drafted"), upload("attached")
+			_, err = db.CreateAvatar(Media{OwnerID: user.Id, ContentType: "image/png", BlobKey: "avatar.png"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			chirp, err := db.CreateChirp("Deleted with its image", authorID, ChirpParams{MediaIDs: []string{trashed.Id}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.DeleteChirp(chirp.Id, user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateChirp("Kept with its image", authorID, ChirpParams{MediaIDs: []string{attached.Id}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateDraft(user.Id, "Not posted yet", ChirpParams{MediaIDs: []string{drafted.Id}}, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			purge := func(now time.Time, wantPurged int, want ...Media) {
+				t.Helper()
+				purged, removed, err := db.PurgeDeletedChirps(now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if purged != wantPurged {
+					t.Fatalf("expected %d chirps to be purged, got %d", wantPurged, purged)
+				}
+				removedIDs := []string{}
+				for _, media := range removed {
+					removedIDs = append(removedIDs, media.Id)
+					if len(media.Renditions) != 1 {
+						t.Fatalf("expected the removed media to keep its renditions, got %+v", media)
+					}
+				}
+				wantIDs := []string{}
+				for _, media := range want {
+					wantIDs = append(wantIDs, media.Id)
+				}
+				slices.Sort(wantIDs)
+				if !slices.Equal(removedIDs, wantIDs) {
+					t.Fatalf("expected media %v to be removed, got %v", wantIDs, removedIDs)
+				}
+			}
+			now := time.Now()
+			// Recent uploads are kept, they may still be attached
+			purge(now.Add(time.Hour), 0)
+			// Media of chirps in the trash is kept, the chirp can be restored with it
+			purge(now.Add(DefaultMediaRetention+time.Hour), 0, unattached)
+			purge(now.Add(DefaultTrashRetention+time.Hour), 1, trashed)
+			purge(now.Add(DefaultTrashRetention+time.Hour), 0)
+
+			db = reopenTestStore(t, store, db, path)
+			for _, media := range []Media{trashed, unattached} {
+				_, err = db.CreateChirp("Gone", authorID, ChirpParams{MediaIDs: []string{media.Id}})
+				if !errors.Is(err, ErrMediaNotFound) {
+					t.Fatalf("expected removed media to be gone after reopening, got %v", err)
+				}
+			}
+			_, err = db.CreateChirp("Still here", authorID, ChirpParams{MediaIDs: []string{drafted.Id, attached.Id}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
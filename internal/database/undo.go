@@ -0,0 +1,66 @@
+package database
+
+// What the transaction in progress has changed, so Update can put it back if the transaction fails
+// Transactions change the data in place, so a write costs the size of the change instead of the whole database
+type undoLog struct {
+	sequences   Sequences
+	logSequence int64
+	// Each step undoes one change, they run newest first
+	steps []func()
+}
+
+// Starts recording changes for a transaction
+func (dbStructure *DBStructure) begin() {
+	dbStructure.undo = &undoLog{sequences: dbStructure.Sequences, logSequence: dbStructure.LogSequence}
+}
+
+// Keeps the changes recorded since begin
+func (dbStructure *DBStructure) commitUndo() {
+	dbStructure.undo = nil
+	dbStructure.pendingEvents = nil
+}
+
+// Undoes every change recorded since begin
+func (dbStructure *DBStructure) rollback() {
+	undo := dbStructure.undo
+	// The helpers the steps call record nothing once the log is gone
+	dbStructure.undo = nil
+	for i := len(undo.steps) - 1; i >= 0; i-- {
+		undo.steps[i]()
+	}
+	dbStructure.Sequences = undo.sequences
+	dbStructure.LogSequence = undo.logSequence
+	dbStructure.pendingEvents = nil
+}
+
+// Records how to undo a change that is about to be made. Changes made outside of a transaction,
+// like replaying the event log, are never undone, so nothing is recorded for them
+func (dbStructure *DBStructure) onRollback(step func()) {
+	if dbStructure.undo != nil {
+		dbStructure.undo.steps = append(dbStructure.undo.steps, step)
+	}
+}
+
+// Sets m[key] to value, recording how to put back what was there before
+// Only for collections without an index, Users and Chirps have putUser and putChirp
+func putEntry[K comparable, V any](dbStructure *DBStructure, m map[K]V, key K, value V) {
+	old, ok := m[key]
+	dbStructure.onRollback(func() {
+		if ok {
+			m[key] = old
+		} else {
+			delete(m, key)
+		}
+	})
+	m[key] = value
+}
+
+// Deletes m[key], if it exists, recording how to put it back
+func deleteEntry[K comparable, V any](dbStructure *DBStructure, m map[K]V, key K) {
+	old, ok := m[key]
+	if !ok {
+		return
+	}
+	dbStructure.onRollback(func() { m[key] = old })
+	delete(m, key)
+}
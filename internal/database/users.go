@@ -3,15 +3,21 @@ package database
 import (
 	"errors"
 	"strconv"
+	"time"
 
 	auth "github.com/ellielle/chirpy/internal/auth"
 )
 
 type User struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id          int       `json:"id"`
+	Uid         string    `json:"uid,omitempty"`
+	Email       string    `json:"email"`
+	Password    string    `json:"password"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// A copy of the media the user picked as their avatar
+	Avatar *Media `json:"avatar,omitempty"`
 }
 
 var ErrInvalidLogin = errors.New("Invalid login")
@@ -20,31 +26,34 @@ var ErrNoUpdates = errors.New("No information to update")
 
 // Creates a new User and saves it to disk
 func (db *DB) CreateUser(email, password string) (User, error) {
-	dbStructure, err := db.loadDB()
+	// hash password with bcrypt
+	// This is slow on purpose, so it is done before the database is locked
+	hash, err := auth.HashPassword(password)
 	if err != nil {
 		return User{}, err
 	}
 
-	_, err = getUserByEmail(email, &dbStructure)
-	if err == nil {
-		return User{}, ErrUserTaken
-	}
-
-	// hash password with bcrypt
-	hash, err := auth.HashPassword(password)
-
-	// Create a new User with the next incremental ID
-	nextID := len(dbStructure.Users) + 1
-	user := User{
-		Id:          nextID,
-		Email:       email,
-		Password:    hash,
-		IsChirpyRed: false,
-	}
-	dbStructure.Users[nextID] = user
-	err = db.writeDB(dbStructure)
+	user := User{}
+	err = db.Update(func(dbStructure *DBStructure) error {
+		// Create a new User with the next ID from the user sequence
+		nextID := dbStructure.nextUserID()
+		createdAt := timestamp()
+		user = User{
+			Id:          nextID,
+			Email:       email,
+			Password:    hash,
+			IsChirpyRed: false,
+			CreatedAt:   createdAt,
+			UpdatedAt:   createdAt,
+		}
+		if db.opts.OpaqueIDs {
+			user.Uid = newOpaqueID()
+		}
+		// Emails are unique ignoring case, this fails with ErrUserTaken for a duplicate
+		return dbStructure.apply(Event{Type: EventUserCreated, User: &user})
+	})
 	if err != nil {
-		return User{}, nil
+		return User{}, err
 	}
 
 	return user, nil
@@ -53,12 +62,12 @@ func (db *DB) CreateUser(email, password string) (User, error) {
 // Logs user in by email and password by matching hashed
 // passwords
 func (db *DB) LoginUser(email, password string) (User, error) {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	foundUser, err := getUserByEmail(email, &dbStructure)
+	foundUser := User{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		user, err := getUserByEmail(email, dbStructure)
+		foundUser = user
+		return err
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -81,28 +90,14 @@ func (db *DB) UpdateUser(id string, updates ...string) (User, error) {
 		return User{}, ErrNoUpdates
 	}
 
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
 	// ID will be in string format after being parsed from token
 	intID, err := strconv.Atoi(id)
-	if err != nil {
-		return User{}, nil
-	}
-
-	foundUser, err := getUserById(intID, &dbStructure)
 	if err != nil {
 		return User{}, err
 	}
 
-	newEmail := foundUser.Email
-	newPassword := foundUser.Password
-
-	if len(updates) > 0 && updates[0] != "" {
-		newEmail = updates[0]
-	}
+	// Hash the new password before taking the write lock
+	newPassword := ""
 	if len(updates) > 1 && updates[1] != "" {
 		newPassword, err = auth.HashPassword(updates[1])
 		if err != nil {
@@ -110,14 +105,24 @@ func (db *DB) UpdateUser(id string, updates ...string) (User, error) {
 		}
 	}
 
-	user := User{
-		Id:          foundUser.Id,
-		Email:       newEmail,
-		Password:    newPassword,
-		IsChirpyRed: foundUser.IsChirpyRed,
-	}
-	dbStructure.Users[foundUser.Id] = user
-	err = db.writeDB(dbStructure)
+	user := User{}
+	err = db.Update(func(dbStructure *DBStructure) error {
+		foundUser, err := getUserById(intID, dbStructure)
+		if err != nil {
+			return err
+		}
+
+		user = foundUser
+		if updates[0] != "" {
+			user.Email = updates[0]
+		}
+		if newPassword != "" {
+			user.Password = newPassword
+		}
+		user.UpdatedAt = timestamp()
+		// Fails with ErrUserTaken if the new email belongs to someone else
+		return dbStructure.apply(Event{Type: EventUserUpdated, User: &user})
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -126,56 +131,28 @@ func (db *DB) UpdateUser(id string, updates ...string) (User, error) {
 }
 
 func (db *DB) UpgradeUser(id int) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	user, err := getUserById(id, &dbStructure)
-	if user.Id == 0 {
-		return errors.New("User not found")
-	}
-
-	user.IsChirpyRed = true
-	dbStructure.Users[user.Id] = user
-
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return db.Update(func(dbStructure *DBStructure) error {
+		return dbStructure.apply(Event{Type: EventUserUpgraded, UserID: id})
+	})
 }
 
 // Find User by ID when user supplies an auth token
 func getUserById(id int, dbStructure *DBStructure) (User, error) {
-	foundUser := User{}
-	for _, user := range dbStructure.Users {
-		if user.Id == id {
-			foundUser = user
-			break
-		}
-	}
-	if foundUser == (User{}) {
+	foundUser, ok := dbStructure.Users[id]
+	if !ok {
 		return User{}, ErrInvalidLogin
 	}
 
 	return foundUser, nil
 }
 
-// Find User in database, and return it
+// Find User in database by email, ignoring case, using the email index
 // Will return an error if the user does not exist
 func getUserByEmail(email string, dbStructure *DBStructure) (User, error) {
-	foundUser := User{}
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			foundUser = user
-			break
-		}
-	}
-	if foundUser == (User{}) {
+	id, ok := dbStructure.userIDsByEmail[emailKey(email)]
+	if !ok {
 		return User{}, ErrInvalidLogin
 	}
 
-	return foundUser, nil
+	return getUserById(id, dbStructure)
 }
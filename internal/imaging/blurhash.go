@@ -0,0 +1,130 @@
+package imaging
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// Size images are scaled down to before their placeholder is worked out. A BlurHash only keeps a
+// handful of frequencies, so nothing a client would see is lost, and it is a lot quicker
+const placeholderSize = 32
+
+// Returns the BlurHash of an image as it is displayed, with 4 components across its longer side and 3 across the other
+// BlurHash has no transparency, so transparent pixels count as white, which is what most clients show them on
+func placeholder(pixels *image.RGBA, orientation int) string {
+	width, height := fit(pixels.Rect.Dx(), pixels.Rect.Dy(), placeholderSize)
+	if height > placeholderSize {
+		height, width = fit(height, width, placeholderSize)
+	}
+	small := orient(resize(pixels, width, height), orientation)
+	componentsX, componentsY := 4, 3
+	if small.Rect.Dy() > small.Rect.Dx() {
+		componentsX, componentsY = 3, 4
+	}
+	return blurHash(small, componentsX, componentsY)
+}
+
+// Encodes an image as a BlurHash, following https://github.com/woltapp/blurhash
+func blurHash(img *image.RGBA, componentsX, componentsY int) string {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+
+	// Linear colour of every pixel, flattened onto white
+	linear := make([][3]float64, width*height)
+	for y := range height {
+		for x := range width {
+			offset := img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			pixel := img.Pix[offset : offset+4]
+			white := 255 - float64(pixel[3])
+			for c := range 3 {
+				linear[y*width+x][c] = sRGBToLinear(float64(pixel[c]) + white)
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := range componentsY {
+		for i := range componentsX {
+			factor := [3]float64{}
+			for y := range height {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := range width {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * basisY
+					for c := range 3 {
+						factor[c] += basis * linear[y*width+x][c]
+					}
+				}
+			}
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			for c := range 3 {
+				factor[c] *= normalisation / float64(width*height)
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	hash := strings.Builder{}
+	writeBase83(&hash, (componentsX-1)+(componentsY-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximum := 1.0
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, factor := range ac {
+			for c := range 3 {
+				actualMaximum = max(actualMaximum, math.Abs(factor[c]))
+			}
+		}
+		quantisedMaximum := int(max(0, min(82, math.Floor(actualMaximum*166-0.5))))
+		maximum = float64(quantisedMaximum+1) / 166
+		writeBase83(&hash, quantisedMaximum, 1)
+	} else {
+		writeBase83(&hash, 0, 1)
+	}
+
+	writeBase83(&hash, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, factor := range ac {
+		value := 0
+		for c := range 3 {
+			quantised := int(max(0, min(18, math.Floor(signPow(factor[c]/maximum, 0.5)*9+9.5))))
+			value = value*19 + quantised
+		}
+		writeBase83(&hash, value, 2)
+	}
+	return hash.String()
+}
+
+// Converts an sRGB value from 0 to 255 to linear light from 0 to 1
+func sRGBToLinear(value float64) float64 {
+	v := value / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// Converts linear light from 0 to 1 to an sRGB value from 0 to 255
+func linearToSRGB(value float64) int {
+	v := max(0, min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+const base83Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Writes value as length base 83 digits, most significant first
+func writeBase83(hash *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		divisor := int(math.Pow(83, float64(i)))
+		hash.WriteByte(base83Digits[value/divisor%83])
+	}
+}
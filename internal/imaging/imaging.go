@@ -0,0 +1,197 @@
+// Package imaging prepares uploaded images to be served: it strips their metadata,
+// and makes the smaller renditions and the placeholder clients show while they load
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+var ErrUnsupportedFormat = errors.New("Only JPEG, PNG and GIF images can be uploaded")
+var ErrUnreadable = errors.New("Image could not be read")
+var ErrTooLarge = fmt.Errorf("Images can be at most %dx%d pixels, and %d megapixels", MaxDimension, MaxDimension, MaxPixels/1_000_000)
+
+// Largest width or height an image can have, in pixels
+const MaxDimension = 8192
+
+// Most pixels an image can have. Images are decoded in full, at 4 bytes a pixel, so this caps the memory one takes
+const MaxPixels = 32_000_000
+
+// File extensions images are saved with, by content type
+var Extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// A smaller copy of an image to make for every upload
+type Spec struct {
+	Name string
+	// The rendition is cropped to exactly Width x Height. Without Crop it keeps the image's
+	// proportions, and is only scaled down if it is wider than Width
+	Width  int
+	Height int
+	Crop   bool
+}
+
+// The renditions made for every image
+var Specs = []Spec{
+	{Name: "thumb", Width: 150, Height: 150, Crop: true},
+	{Name: "display", Width: 1200},
+}
+
+// An encoded image. Name is the name of its Spec, for renditions
+type Image struct {
+	Name        string
+	ContentType string
+	Width       int
+	Height      int
+	Data        []byte
+}
+
+// A processed upload: the original without its metadata, and its renditions in the order of Specs
+type Result struct {
+	Original   Image
+	Renditions []Image
+	// BlurHash of the image, for clients to show until it loads
+	Placeholder string
+}
+
+// Processes an uploaded image. The type is sniffed from the data, whatever the client says it is
+// Widths and heights are the ones the image is displayed at, after its EXIF orientation is applied
+func Process(data []byte) (Result, error) {
+	contentType := http.DetectContentType(data)
+	if _, ok := Extensions[contentType]; !ok {
+		return Result{}, ErrUnsupportedFormat
+	}
+	// Only the header is read, so oversized images are turned away before anything decodes all of their pixels
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Result{}, ErrUnreadable
+	}
+	if config.Width < 1 || config.Height < 1 || config.Width > MaxDimension || config.Height > MaxDimension ||
+		config.Width*config.Height > MaxPixels {
+		return Result{}, ErrTooLarge
+	}
+	// For GIFs this is the first frame, so the renditions of an animation are stills
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Result{}, ErrUnreadable
+	}
+	pixels := toRGBA(decoded)
+
+	orientation := 1
+	stripped := []byte{}
+	switch contentType {
+	case "image/jpeg":
+		orientation = jpegOrientation(data)
+		stripped, err = stripJPEG(data)
+	case "image/png":
+		stripped, err = stripPNG(data)
+	case "image/gif":
+		stripped, err = stripGIF(data)
+	}
+	if err != nil {
+		return Result{}, ErrUnreadable
+	}
+
+	width, height := pixels.Rect.Dx(), pixels.Rect.Dy()
+	if transposes(orientation) {
+		width, height = height, width
+	}
+	original := Image{ContentType: contentType, Width: width, Height: height, Data: stripped}
+	if orientation != 1 {
+		// The orientation goes with the rest of the EXIF data, so the pixels have to be turned to match
+		original.Data, err = encodeJPEG(orient(pixels, orientation), 92)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+
+	result := Result{Original: original}
+	for _, spec := range Specs {
+		rendition, err := render(pixels, orientation, spec)
+		if err != nil {
+			return Result{}, err
+		}
+		result.Renditions = append(result.Renditions, rendition)
+	}
+	result.Placeholder = placeholder(pixels, orientation)
+	return result, nil
+}
+
+// Makes the rendition of an image described by spec
+func render(pixels *image.RGBA, orientation int, spec Spec) (Image, error) {
+	// The size the rendition is displayed at
+	width, height := spec.Width, spec.Height
+	if !spec.Crop {
+		displayedWidth, displayedHeight := pixels.Rect.Dx(), pixels.Rect.Dy()
+		if transposes(orientation) {
+			displayedWidth, displayedHeight = displayedHeight, displayedWidth
+		}
+		width, height = fit(displayedWidth, displayedHeight, spec.Width)
+	}
+	// The source is scaled in its own orientation, and the result turned afterwards.
+	// Crops are centred, so cropping before turning takes the same pixels as cropping after
+	if transposes(orientation) {
+		width, height = height, width
+	}
+	crop := pixels.Rect
+	if spec.Crop {
+		crop = centredCrop(pixels.Rect, width, height)
+	}
+
+	scaled := orient(resize(pixels.SubImage(crop).(*image.RGBA), width, height), orientation)
+	encoded := Image{Name: spec.Name, Width: scaled.Rect.Dx(), Height: scaled.Rect.Dy()}
+	var err error
+	// Transparency needs PNG, anything else is smaller as a JPEG
+	if scaled.Opaque() {
+		encoded.ContentType = "image/jpeg"
+		encoded.Data, err = encodeJPEG(scaled, 85)
+	} else {
+		encoded.ContentType = "image/png"
+		encoded.Data, err = encodePNG(scaled)
+	}
+	return encoded, err
+}
+
+// Returns the size an image scales to to be at most maxWidth wide, keeping its proportions
+// Images that are narrow enough already are left as they are
+func fit(width, height, maxWidth int) (int, int) {
+	if width <= maxWidth {
+		return width, height
+	}
+	return maxWidth, max(1, (height*maxWidth+width/2)/width)
+}
+
+// Returns the largest rectangle in the middle of rect with the proportions of width x height
+func centredCrop(rect image.Rectangle, width, height int) image.Rectangle {
+	cropWidth, cropHeight := rect.Dx(), rect.Dy()
+	if cropWidth*height > cropHeight*width {
+		cropWidth = max(1, cropHeight*width/height)
+	} else {
+		cropHeight = max(1, cropWidth*height/width)
+	}
+	x := rect.Min.X + (rect.Dx()-cropWidth)/2
+	y := rect.Min.Y + (rect.Dy()-cropHeight)/2
+	return image.Rect(x, y, x+cropWidth, y+cropHeight)
+}
+
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	buf := bytes.Buffer{}
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	return buf.Bytes(), err
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	buf := bytes.Buffer{}
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	err := encoder.Encode(&buf, img)
+	return buf.Bytes(), err
+}
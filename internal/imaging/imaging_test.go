@@ -0,0 +1,313 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The fixture every test starts from, an opaque 256x256 PNG
+const fixturePath = "../../assets/logo.png"
+
+func readFixture(t *testing.T) ([]byte, *image.RGBA) {
+	t.Helper()
+	data, err := os.ReadFile(fixturePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, toRGBA(decoded)
+}
+
+// Returns the fixture drawn onto white, cropped to width x height and tiled if that is larger, as a JPEG
+func fixtureJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	_, logo := readFixture(t)
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Rect, image.White, image.Point{}, draw.Src)
+	for y := 0; y < height; y += logo.Rect.Dy() {
+		for x := 0; x < width; x += logo.Rect.Dx() {
+			draw.Draw(canvas, logo.Rect.Add(image.Pt(x, y)), logo, image.Point{}, draw.Over)
+		}
+	}
+	data, err := encodeJPEG(canvas, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Builds little endian EXIF data with an orientation tag, and a GPS IFD holding a latitude reference
+// and the text marker, so the test can look for it in the output
+func exifSegment(orientation uint16, marker string) []byte {
+	tiff := &bytes.Buffer{}
+	tiff.WriteString("II*\x00")
+	binary.Write(tiff, binary.LittleEndian, uint32(8))
+	// IFD0 at 8: orientation and the offset of the GPS IFD
+	gpsIFD := uint32(8 + 2 + 2*12 + 4)
+	binary.Write(tiff, binary.LittleEndian, uint16(2))
+	binary.Write(tiff, binary.LittleEndian, []uint16{0x0112, 3})
+	binary.Write(tiff, binary.LittleEndian, uint32(1))
+	binary.Write(tiff, binary.LittleEndian, []uint16{orientation, 0})
+	binary.Write(tiff, binary.LittleEndian, []uint16{0x8825, 4})
+	binary.Write(tiff, binary.LittleEndian, []uint32{1, gpsIFD})
+	binary.Write(tiff, binary.LittleEndian, uint32(0))
+	// GPS IFD: GPSLatitudeRef, then GPSProcessingMethod pointing at the marker
+	markerOffset := gpsIFD + 2 + 2*12 + 4
+	binary.Write(tiff, binary.LittleEndian, uint16(2))
+	binary.Write(tiff, binary.LittleEndian, []uint16{0x0001, 2})
+	binary.Write(tiff, binary.LittleEndian, []uint32{2, 'N'})
+	binary.Write(tiff, binary.LittleEndian, []uint16{0x001B, 7})
+	binary.Write(tiff, binary.LittleEndian, []uint32{uint32(len(marker)), markerOffset})
+	binary.Write(tiff, binary.LittleEndian, uint32(0))
+	tiff.WriteString(marker)
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	return jpegSegment(0xE1, payload)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// Inserts segments right after the JPEG's start of image marker
+func withJPEGSegments(data []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	return append(out, data[2:]...)
+}
+
+func pngChunk(chunkType string, payload []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, payload...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func TestProcessStripsJPEGMetadata(t *testing.T) {
+	const marker = "GPS-SECRET-MARKER"
+	plain := fixtureJPEG(t, 256, 128)
+	tagged := withJPEGSegments(plain, exifSegment(1, marker), jpegSegment(0xFE, []byte("COMMENT-MARKER")))
+
+	result, err := Process(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leaked := range []string{"Exif", marker, "COMMENT-MARKER"} {
+		if bytes.Contains(result.Original.Data, []byte(leaked)) {
+			t.Errorf("original still contains %q", leaked)
+		}
+	}
+	// Nothing else changed, the image data is copied as it is
+	if !bytes.Equal(result.Original.Data, plain) {
+		t.Error("stripping the metadata changed more than the metadata")
+	}
+	if result.Original.ContentType != "image/jpeg" || result.Original.Width != 256 || result.Original.Height != 128 {
+		t.Errorf("expected a 256x128 JPEG, got %s %dx%d", result.Original.ContentType, result.Original.Width, result.Original.Height)
+	}
+}
+
+// Anything after the end of the image goes, like a trailer image carrying its own EXIF and GPS data
+func TestProcessStripsJPEGTrailer(t *testing.T) {
+	const marker = "GPSLatitude-SECRET"
+	plain := fixtureJPEG(t, 256, 128)
+	trailer := withJPEGSegments(fixtureJPEG(t, 16, 16), exifSegment(1, marker))
+	tagged := append(append([]byte{}, plain...), trailer...)
+	tagged = append(tagged, jpegSegment(0xE1, []byte("Exif\x00\x00"+marker))...)
+
+	result, err := Process(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(result.Original.Data, []byte(marker)) {
+		t.Error("original still contains the trailing EXIF data")
+	}
+	if !bytes.Equal(result.Original.Data, plain) {
+		t.Error("expected the original to end with the first image")
+	}
+}
+
+// The orientation goes with the EXIF data, so the pixels are turned instead
+func TestProcessAppliesJPEGOrientation(t *testing.T) {
+	// 6 is rotated 90 degrees clockwise
+	result, err := Process(withJPEGSegments(fixtureJPEG(t, 256, 128), exifSegment(6, "GPS-SECRET-MARKER")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(result.Original.Data, []byte("GPS-SECRET-MARKER")) {
+		t.Error("original still contains the GPS data")
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(result.Original.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 128 || config.Height != 256 || result.Original.Width != 128 || result.Original.Height != 256 {
+		t.Errorf("expected the original turned to 128x256, got %dx%d reported as %dx%d",
+			config.Width, config.Height, result.Original.Width, result.Original.Height)
+	}
+}
+
+func TestProcessStripsPNGMetadata(t *testing.T) {
+	plain, _ := readFixture(t)
+	// The metadata chunks go between IHDR and the image data
+	const ihdrEnd = 8 + 12 + 13
+	tagged := append([]byte{}, plain[:ihdrEnd]...)
+	tagged = append(tagged, pngChunk("tEXt", []byte("Comment\x00TEXT-MARKER"))...)
+	tagged = append(tagged, pngChunk("iTXt", []byte("Author\x00\x00\x00\x00\x00ITXT-MARKER"))...)
+	tagged = append(tagged, pngChunk("tIME", []byte{0x07, 0xE8, 3, 15, 12, 0, 0})...)
+	tagged = append(tagged, pngChunk("eXIf", []byte("MM\x00*EXIF-MARKER"))...)
+	tagged = append(tagged, plain[ihdrEnd:]...)
+	// Anything after the end of the image goes too
+	tagged = append(tagged, "TRAILING-MARKER"...)
+
+	result, err := Process(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Original.Data, plain) {
+		for _, leaked := range []string{"tEXt", "iTXt", "tIME", "eXIf", "TRAILING-MARKER"} {
+			if bytes.Contains(result.Original.Data, []byte(leaked)) {
+				t.Errorf("original still contains %q", leaked)
+			}
+		}
+		t.Error("stripping the metadata changed more than the metadata")
+	}
+}
+
+func TestProcessRenditionSizes(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		displayWidth  int
+		displayHeight int
+	}{
+		// Smaller than the display width, so it is left at its own size rather than scaled up
+		{"small PNG", func() []byte { data, _ := readFixture(t); return data }(), 256, 256},
+		{"small JPEG", fixtureJPEG(t, 300, 100), 300, 100},
+		{"wide JPEG", fixtureJPEG(t, 2400, 600), 1200, 300},
+		{"tall JPEG", fixtureJPEG(t, 1000, 3000), 1000, 3000},
+		{"odd proportions", fixtureJPEG(t, 1601, 333), 1200, 250},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := Process(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Renditions) != len(Specs) {
+				t.Fatalf("expected %d renditions, got %d", len(Specs), len(result.Renditions))
+			}
+			expected := map[string][2]int{"thumb": {150, 150}, "display": {test.displayWidth, test.displayHeight}}
+			for _, rendition := range result.Renditions {
+				size := expected[rendition.Name]
+				if rendition.Width != size[0] || rendition.Height != size[1] {
+					t.Errorf("expected %s to be %dx%d, got %dx%d", rendition.Name, size[0], size[1], rendition.Width, rendition.Height)
+				}
+				// The sizes reported are the ones that were encoded
+				config, _, err := image.DecodeConfig(bytes.NewReader(rendition.Data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if config.Width != rendition.Width || config.Height != rendition.Height {
+					t.Errorf("%s is reported as %dx%d but encoded at %dx%d", rendition.Name,
+						rendition.Width, rendition.Height, config.Width, config.Height)
+				}
+			}
+		})
+	}
+}
+
+// Transparency needs PNG renditions, opaque images get JPEGs whatever they were uploaded as
+func TestProcessRenditionFormats(t *testing.T) {
+	opaque, logo := readFixture(t)
+	// The same image with its top left quarter cut out
+	draw.Draw(logo, image.Rect(0, 0, 128, 128), image.Transparent, image.Point{}, draw.Src)
+	transparent := bytes.Buffer{}
+	err := png.Encode(&transparent, logo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		data        []byte
+		contentType string
+	}{
+		{"opaque PNG", opaque, "image/jpeg"},
+		{"transparent PNG", transparent.Bytes(), "image/png"},
+		{"JPEG", fixtureJPEG(t, 256, 256), "image/jpeg"},
+	} {
+		result, err := Process(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rendition := range result.Renditions {
+			if rendition.ContentType != test.contentType {
+				t.Errorf("%s: expected %s to be %s, got %s", test.name, rendition.Name, test.contentType, rendition.ContentType)
+			}
+		}
+	}
+}
+
+// Checks the hash is well formed for its number of components, which its first character gives
+func checkBlurHash(t *testing.T, hash string, componentsX, componentsY int) {
+	t.Helper()
+	for _, c := range hash {
+		if !strings.ContainsRune(base83Digits, c) {
+			t.Fatalf("BlurHash %q has %q, which isn't a base 83 digit", hash, c)
+		}
+	}
+	if len(hash) != 4+2*componentsX*componentsY {
+		t.Fatalf("expected a BlurHash of %d characters, got %q", 4+2*componentsX*componentsY, hash)
+	}
+	sizeFlag := strings.IndexByte(base83Digits, hash[0])
+	if sizeFlag%9+1 != componentsX || sizeFlag/9+1 != componentsY {
+		t.Errorf("BlurHash %q has %dx%d components, expected %dx%d", hash, sizeFlag%9+1, sizeFlag/9+1, componentsX, componentsY)
+	}
+}
+
+func TestProcessPlaceholder(t *testing.T) {
+	data, _ := readFixture(t)
+	result, err := Process(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBlurHash(t, result.Placeholder, 4, 3)
+
+	// Portrait images have more components down than across
+	result, err = Process(fixtureJPEG(t, 128, 256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBlurHash(t, result.Placeholder, 3, 4)
+}
+
+// The four characters after the size flag and maximum are the average colour, in sRGB
+func TestBlurHashAverageColour(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(img, img.Rect, image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	hash := blurHash(img, 4, 3)
+	checkBlurHash(t, hash, 4, 3)
+	average := 0
+	for _, c := range hash[2:6] {
+		average = average*83 + strings.IndexRune(base83Digits, c)
+	}
+	if average != 0xFF0000 {
+		t.Errorf("expected BlurHash %q to average to #ff0000, got #%06x", hash, average)
+	}
+}
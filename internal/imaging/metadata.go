@@ -0,0 +1,248 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errMalformed = errors.New("Malformed image")
+
+// Copies a JPEG without its EXIF, XMP and other application segments, or its comments, and without anything
+// after the end of the image, like the trailer some cameras append with a second copy of the EXIF data
+// The image data itself is copied as it is, so nothing is lost to encoding it again. The JFIF header,
+// the ICC colour profile and the Adobe segment are kept, as they change how the image is decoded
+func stripJPEG(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errMalformed
+	}
+	out := bytes.Buffer{}
+	out.Write(data[:2])
+	i := 2
+	for {
+		// Markers can be padded with any number of 0xFF bytes
+		for i+1 < len(data) && data[i] == 0xFF && data[i+1] == 0xFF {
+			i++
+		}
+		if i+2 > len(data) || data[i] != 0xFF {
+			return nil, errMalformed
+		}
+		marker := data[i+1]
+		if marker == 0xD9 {
+			// End of image
+			out.Write(data[i : i+2])
+			return out.Bytes(), nil
+		}
+		if i+4 > len(data) {
+			return nil, errMalformed
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) || end < i+4 {
+			return nil, errMalformed
+		}
+		if keepJPEGSegment(marker, data[i+4:end]) {
+			out.Write(data[i:end])
+		}
+		i = end
+		if marker == 0xDA {
+			// Start of scan. The image data follows its header, up to the next marker. Progressive
+			// images have several scans, with more segments between them
+			scanEnd := entropyCodedEnd(data, i)
+			out.Write(data[i:scanEnd])
+			i = scanEnd
+		}
+	}
+}
+
+// Returns the index of the marker that ends the image data starting at i, or len(data) if there isn't one
+// Inside image data 0xFF is followed by 0x00 when it is part of the data, or by a restart marker
+func entropyCodedEnd(data []byte, i int) int {
+	for ; i+1 < len(data); i++ {
+		if data[i] != 0xFF {
+			continue
+		}
+		next := data[i+1]
+		if next == 0x00 || (next >= 0xD0 && next <= 0xD7) {
+			i++
+			continue
+		}
+		if next != 0xFF {
+			return i
+		}
+	}
+	return len(data)
+}
+
+// Whether a JPEG segment is needed to decode the image
+func keepJPEGSegment(marker byte, payload []byte) bool {
+	switch {
+	case marker == 0xE0:
+		return bytes.HasPrefix(payload, []byte("JFIF\x00"))
+	case marker == 0xE2:
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case marker == 0xEE:
+		return bytes.HasPrefix(payload, []byte("Adobe"))
+	case marker > 0xE0 && marker <= 0xEF, marker == 0xFE:
+		return false
+	}
+	return true
+}
+
+// Returns the EXIF orientation of a JPEG, from 1 to 8, or 1 if it doesn't have one
+func jpegOrientation(data []byte) int {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == 0xDA {
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) || end < i+4 {
+			break
+		}
+		if payload := data[i+4 : end]; marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return exifOrientation(payload[6:])
+		}
+		i = end
+	}
+	return 1
+}
+
+// Reads the orientation tag out of the first IFD of the TIFF structure EXIF data is stored as
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for n := range count {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		// Orientation is a single SHORT, stored at the start of the value field
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// PNG chunks that only carry metadata: text, EXIF and the time the image was last changed
+var pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+// Copies a PNG without its metadata chunks, and without anything after the end of the image
+func stripPNG(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errMalformed
+	}
+	out := bytes.Buffer{}
+	out.WriteString(signature)
+	for i := len(signature); ; {
+		if i+12 > len(data) {
+			return nil, errMalformed
+		}
+		// Length, type, data and CRC
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i+12 {
+			return nil, errMalformed
+		}
+		chunkType := string(data[i+4 : i+8])
+		if !pngMetadataChunks[chunkType] {
+			out.Write(data[i:end])
+		}
+		if chunkType == "IEND" {
+			return out.Bytes(), nil
+		}
+		i = end
+	}
+}
+
+// Copies a GIF without its comments, or any application extension besides the ones that say how many times it loops
+func stripGIF(data []byte) ([]byte, error) {
+	// Header and logical screen descriptor
+	if len(data) < 13 || !(bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))) {
+		return nil, errMalformed
+	}
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+	out := bytes.Buffer{}
+	out.Write(data[:min(i, len(data))])
+	for {
+		if i >= len(data) {
+			return nil, errMalformed
+		}
+		start := i
+		keep := true
+		switch data[i] {
+		case 0x21:
+			// Extension: a label, then data sub-blocks
+			if i+2 > len(data) {
+				return nil, errMalformed
+			}
+			switch data[i+1] {
+			case 0xFE:
+				keep = false
+			case 0xFF:
+				// The first sub-block of an application extension names the application
+				identifier := data[i+2:]
+				keep = bytes.HasPrefix(identifier, []byte("\x0bNETSCAPE2.0")) || bytes.HasPrefix(identifier, []byte("\x0bANIMEXTS1.0"))
+			}
+			i += 2
+		case 0x2C:
+			// Image descriptor, an optional local colour table, the LZW code size, then data sub-blocks
+			if i+11 > len(data) {
+				return nil, errMalformed
+			}
+			packed := data[i+9]
+			i += 10
+			if packed&0x80 != 0 {
+				i += 3 << (packed&0x07 + 1)
+			}
+			i++
+		case 0x3B:
+			out.WriteByte(0x3B)
+			return out.Bytes(), nil
+		default:
+			return nil, errMalformed
+		}
+		// Sub-blocks are each a length byte and that much data, ending with an empty one
+		for {
+			if i >= len(data) {
+				return nil, errMalformed
+			}
+			size := int(data[i])
+			i += 1 + size
+			if size == 0 {
+				break
+			}
+		}
+		if i > len(data) {
+			return nil, errMalformed
+		}
+		if keep {
+			out.Write(data[start:i])
+		}
+	}
+}
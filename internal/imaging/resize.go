@@ -0,0 +1,118 @@
+package imaging
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Returns the image as premultiplied RGBA, with its bounds starting at 0, 0
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// How much of a source pixel goes into a destination pixel
+type contribution struct {
+	index  int
+	weight float64
+}
+
+// Returns, for each of dstSize pixels, the source pixels it covers when srcSize pixels are scaled to dstSize,
+// weighted by how much of each it covers. The weights for one destination pixel add up to 1
+func contributions(srcSize, dstSize int) [][]contribution {
+	scale := float64(srcSize) / float64(dstSize)
+	all := make([][]contribution, dstSize)
+	for d := range all {
+		lo, hi := float64(d)*scale, float64(d+1)*scale
+		for s := int(lo); s < srcSize && float64(s) < hi; s++ {
+			if covered := min(hi, float64(s+1)) - max(lo, float64(s)); covered > 0 {
+				all[d] = append(all[d], contribution{index: s, weight: covered / scale})
+			}
+		}
+	}
+	return all
+}
+
+// Scales src to width x height by averaging the source pixels each destination pixel covers
+// That is a box filter, which is sharp and free of ringing when shrinking, and nearest neighbour when growing
+// Premultiplied colours are averaged, so transparent pixels don't bleed their colour into their neighbours
+func resize(src *image.RGBA, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	columns := contributions(src.Rect.Dx(), width)
+	rows := contributions(src.Rect.Dy(), height)
+
+	// Source rows are scaled across as they are needed, rather than all of them up front,
+	// so this only ever holds one scaled row. Rows on a boundary are scaled twice
+	scaledRow := make([]float64, width*4)
+	sum := make([]float64, width*4)
+	for y, rowContributions := range rows {
+		clear(sum)
+		for _, row := range rowContributions {
+			clear(scaledRow)
+			offset := src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y+row.index)
+			for x, columnContributions := range columns {
+				for _, column := range columnContributions {
+					pixel := src.Pix[offset+column.index*4 : offset+column.index*4+4]
+					for c := range 4 {
+						scaledRow[x*4+c] += float64(pixel[c]) * column.weight
+					}
+				}
+			}
+			for i := range sum {
+				sum[i] += scaledRow[i] * row.weight
+			}
+		}
+		out := dst.Pix[y*dst.Stride : y*dst.Stride+width*4]
+		for i := range out {
+			out[i] = uint8(min(255, sum[i]+0.5))
+		}
+	}
+	return dst
+}
+
+// Whether an EXIF orientation swaps the width and height
+func transposes(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// Turns and flips an image the way its EXIF orientation says it should be displayed
+// Orientations outside 2-8 leave it as it is
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	dstWidth, dstHeight := width, height
+	if transposes(orientation) {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := range height {
+		for x := range width {
+			// Where the pixel at x, y ends up
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored
+				dx, dy = width-1-x, y
+			case 3: // Upside down
+				dx, dy = width-1-x, height-1-y
+			case 4: // Upside down and mirrored
+				dx, dy = x, height-1-y
+			case 5: // Mirrored along the top left to bottom right diagonal
+				dx, dy = y, x
+			case 6: // Turned a quarter clockwise
+				dx, dy = height-1-y, x
+			case 7: // Mirrored along the top right to bottom left diagonal
+				dx, dy = height-1-y, width-1-x
+			case 8: // Turned a quarter anticlockwise
+				dx, dy = y, width-1-x
+			}
+			from := src.PixOffset(src.Rect.Min.X+x, src.Rect.Min.Y+y)
+			to := dst.PixOffset(dx, dy)
+			copy(dst.Pix[to:to+4], src.Pix[from:from+4])
+		}
+	}
+	return dst
+}
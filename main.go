@@ -1,21 +1,35 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 
+	blobs "github.com/ellielle/chirpy/internal/blobs"
 	database "github.com/ellielle/chirpy/internal/database"
 )
 
 type apiConfig struct {
 	fileserverHits int
-	DB             *database.DB
+	DB             database.Store
+	dbBackend      string
 	jwtSecret      string
 	polkaKey       string
+	adminKey       string
+	sweepStats     *sweepStats
+	// Where uploaded media is kept, and how large an upload can be
+	blobs          blobs.Store
+	maxUploadBytes int64
 }
 
 func main() {
@@ -26,18 +40,63 @@ func main() {
 		log.Fatal("Error loading environment")
 	}
 
-	db, err := database.NewDBConnection("database.json")
+	dbCfg, err := loadDBConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Subcommands for managing the database, e.g. "chirpy migrate"
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		err = runCommand(os.Args[1], os.Args[2:], dbCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	db, err := dbCfg.open()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mediaCfg, err := loadMediaConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	blobStore, err := blobs.NewLocalStore(mediaCfg.dir)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	jwtSecret := os.Getenv("JWT_SECRET")
 	polkaKey := os.Getenv("POLKA_API_KEY")
+	// ADMIN_API_KEY protects admin endpoints that expose data, like /admin/backup
+	adminKey := os.Getenv("ADMIN_API_KEY")
 	apiCfg := apiConfig{
 		fileserverHits: 0,
 		DB:             db,
+		dbBackend:      dbCfg.backend,
 		jwtSecret:      jwtSecret,
 		polkaKey:       polkaKey,
+		adminKey:       adminKey,
+		sweepStats:     &sweepStats{},
+		blobs:          blobStore,
+		maxUploadBytes: mediaCfg.maxBytes,
+	}
+
+	// How often expired revoked refresh tokens are swept out of the database
+	sweepInterval := time.Hour
+	if minutes := os.Getenv("TOKEN_SWEEP_INTERVAL_MINUTES"); minutes != "" {
+		n, err := strconv.Atoi(minutes)
+		if err != nil || n <= 0 {
+			log.Fatal("Invalid TOKEN_SWEEP_INTERVAL_MINUTES")
+		}
+		sweepInterval = time.Duration(n) * time.Minute
+	}
+
+	backupCfg, err := loadBackupConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Wipe test database in debug mode
@@ -73,16 +132,55 @@ func main() {
 	mux.HandleFunc("POST /api/refresh", apiCfg.handlerUsersRefresh)
 	// POST endpoint to revoke access token with refresh token
 	mux.HandleFunc("POST /api/revoke", apiCfg.handlerTokensRevoke)
-	// DELETE endpoint to remove chirps
+	// DELETE endpoint to remove chirps, which moves them to the author's trash
 	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.handlerChirpsDelete)
+	// GET endpoint for listing the user's deleted chirps
+	mux.HandleFunc("GET /api/chirps/trash", apiCfg.handlerChirpsTrash)
+	// PATCH endpoint for authors to edit their chirps
+	mux.HandleFunc("PATCH /api/chirps/{chirpID}", apiCfg.handlerChirpsEdit)
+	// GET endpoint for the earlier versions of an edited chirp
+	mux.HandleFunc("GET /api/chirps/{chirpID}/history", apiCfg.handlerChirpsHistory)
+	// GET endpoint for the conversation around a chirp
+	mux.HandleFunc("GET /api/chirps/{chirpID}/thread", apiCfg.handlerChirpsThread)
+	// POST and DELETE endpoints to like and unlike a chirp
+	mux.HandleFunc("POST /api/chirps/{chirpID}/likes", apiCfg.handlerChirpsLike)
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}/likes", apiCfg.handlerChirpsUnlike)
+	// GET endpoint for the chirps a user has liked
+	mux.HandleFunc("GET /api/users/{id}/likes", apiCfg.handlerUsersLikes)
+	// POST endpoint to vote in a chirp's poll, and GET endpoint to see how it stands
+	mux.HandleFunc("POST /api/chirps/{chirpID}/poll/votes", apiCfg.handlerChirpsPollVote)
+	mux.HandleFunc("GET /api/chirps/{chirpID}/poll", apiCfg.handlerChirpsPollGet)
+	// POST endpoint to restore a deleted chirp
+	mux.HandleFunc("POST /api/chirps/{chirpID}/restore", apiCfg.handlerChirpsRestore)
+	// GET endpoint for full-text search over chirps
+	mux.HandleFunc("GET /api/chirps/search", apiCfg.handlerChirpsSearch)
+	// GET endpoints for the chirps with a hashtag, and the chirps that mention a user
+	mux.HandleFunc("GET /api/tags/{tag}/chirps", apiCfg.handlerTagsChirps)
+	mux.HandleFunc("GET /api/users/{id}/mentions", apiCfg.handlerUsersMentions)
+	// Endpoints for the logged in user's drafts, and for publishing one right away
+	mux.HandleFunc("GET /api/drafts", apiCfg.handlerDraftsGet)
+	mux.HandleFunc("POST /api/drafts", apiCfg.handlerDraftsCreate)
+	mux.HandleFunc("PUT /api/drafts/{draftID}", apiCfg.handlerDraftsUpdate)
+	mux.HandleFunc("DELETE /api/drafts/{draftID}", apiCfg.handlerDraftsDelete)
+	mux.HandleFunc("POST /api/drafts/{draftID}/publish", apiCfg.handlerDraftsPublish)
+	// POST endpoint to upload images to attach to chirps, and the route they are served from
+	mux.HandleFunc("POST /api/media", apiCfg.handlerMediaUpload)
+	mux.HandleFunc("GET /media/{key}", apiCfg.handlerMediaGet)
+	// PUT endpoint to upload a new avatar for the logged in user
+	mux.HandleFunc("PUT /api/users/avatar", apiCfg.handlerUsersAvatar)
 
 	// POST endpoint for "Polka" user upgraded events
 	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerPolkaWebhooks)
 
-	// Admin route, which only contains the metrics endpoint for now
+	// Admin routes under the admin subroute
+	// Page hit count metrics endpoint
 	mux.HandleFunc("GET /admin/metrics", apiCfg.handlerMetricsResponse)
 	// Page hit count reset endpoint
 	mux.HandleFunc("GET /admin/reset", apiCfg.handlerMetricsReset)
+	// Streams a snapshot of the database, requires ADMIN_API_KEY
+	mux.HandleFunc("GET /admin/backup", apiCfg.handlerAdminBackup)
+	// Statistics from the revoked token sweeper
+	mux.HandleFunc("GET /admin/tokens", apiCfg.handlerAdminTokenStats)
 
 	// Wrap mux in CORS headers and serve
 	corsMux := middlewareCors(mux)
@@ -91,6 +189,40 @@ func main() {
 		Handler: corsMux,
 	}
 
-	log.Printf("Serving on port: %s\n", port)
-	log.Fatal(server.ListenAndServe())
+	// Shut down cleanly on Ctrl+C or SIGTERM, so pending database writes are flushed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go runTokenSweeper(ctx, db, sweepInterval, apiCfg.sweepStats)
+	// Deleted chirps are kept for DB_TRASH_RETENTION_HOURS and unused uploads for MEDIA_RETENTION_HOURS,
+	// checking hourly is plenty
+	go runTrashPurger(ctx, db, blobStore, time.Hour)
+	// Scheduled chirps are published within this long of their publish_at
+	go runDraftPublisher(ctx, db, 10*time.Second)
+
+	// Hourly snapshots with retention, when BACKUP_DIR is set
+	if backupCfg.dir != "" {
+		go runBackupSchedule(ctx, db, dbCfg, backupCfg)
+	}
+
+	go func() {
+		log.Printf("Serving on port: %s\n", port)
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Print("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Error shutting down server: %s", err)
+	}
+	err = db.Close()
+	if err != nil {
+		log.Fatalf("Error closing database: %s", err)
+	}
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Page size of chirp listings when no limit is given, and the largest limit allowed
+const defaultPageLimit = 100
+const maxPageLimit = 1000
+
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Where the next page of a listing starts. Sent to clients base64 encoded, so they treat it as opaque
+type pageCursor struct {
+	AfterID    int  `json:"after_id"`
+	Descending bool `json:"desc,omitempty"`
+	// Search results are ranked by score before ID, so their cursor needs the score too
+	AfterScore float64 `json:"after_score,omitempty"`
+}
+
+// Returns the opaque string form of a cursor
+func encodeCursor(cursor pageCursor) string {
+	dat, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+// Parses a cursor made by encodeCursor
+func decodeCursor(encoded string) (pageCursor, error) {
+	cursor := pageCursor{}
+	dat, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	err = json.Unmarshal(dat, &cursor)
+	if err != nil || cursor.AfterID <= 0 {
+		return pageCursor{}, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// Reads the optional limit query parameter, defaulting to defaultPageLimit
+func parseLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultPageLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, fmt.Errorf("Invalid limit, expected a number from 1 to %d", maxPageLimit)
+	}
+	return limit, nil
+}
+
+// Points a Link header at the next page: the same request with the cursor swapped for the next one
+func setNextPageLink(w http.ResponseWriter, r *http.Request, cursor pageCursor) {
+	next := *r.URL
+	query := next.Query()
+	query.Set("cursor", encodeCursor(cursor))
+	next.RawQuery = query.Encode()
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ellielle/chirpy/internal/blobs"
+	database "github.com/ellielle/chirpy/internal/database"
+)
+
+// Counters from the revoked token sweeper, served on /admin/tokens
+type sweepStats struct {
+	mu         sync.Mutex
+	Sweeps     int       `json:"sweeps"`
+	LastSweep  time.Time `json:"last_sweep"`
+	LastSwept  int       `json:"last_swept"`
+	TotalSwept int       `json:"total_swept"`
+	Remaining  int       `json:"remaining"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// Sweeps expired revoked refresh tokens out of the database right away and then every interval,
+// until ctx is cancelled
+func runTokenSweeper(ctx context.Context, db database.Store, interval time.Duration, stats *sweepStats) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		swept, remaining, err := db.SweepRevokedTokens(now)
+
+		stats.mu.Lock()
+		stats.Sweeps++
+		stats.LastSweep = now
+		if err != nil {
+			log.Printf("Error sweeping revoked tokens: %s", err)
+			stats.LastError = err.Error()
+		} else {
+			stats.LastError = ""
+			stats.LastSwept = swept
+			stats.TotalSwept += swept
+			stats.Remaining = remaining
+		}
+		stats.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Permanently removes chirps that have been in the trash longer than the retention window,
+// right away and then every interval, until ctx is cancelled. The files of media that nothing
+// refers to anymore are deleted from store
+func runTrashPurger(ctx context.Context, db database.Store, store blobs.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, removed, err := db.PurgeDeletedChirps(time.Now())
+		if err != nil {
+			log.Printf("Error purging deleted chirps: %s", err)
+		}
+		if purged > 0 {
+			log.Printf("Purged %d deleted chirps from the trash", purged)
+		}
+		if len(removed) > 0 {
+			deleteMediaBlobs(store, removed)
+			log.Printf("Deleted %d unused uploads", len(removed))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deletes the files of media whose records are gone, renditions included. Nothing refers to them anymore,
+// so a file that can't be deleted is only logged
+func deleteMediaBlobs(store blobs.Store, removed []database.Media) {
+	for _, media := range removed {
+		keys := []string{media.BlobKey}
+		for _, rendition := range media.Renditions {
+			keys = append(keys, rendition.BlobKey)
+		}
+		for _, key := range keys {
+			err := store.Delete(key)
+			if err != nil {
+				log.Printf("Error deleting media file %s: %s", key, err)
+			}
+		}
+	}
+}
+
+// Publishes scheduled drafts once they are due, right away and then every interval, until ctx is cancelled
+// Drafts that came due while the server was down are published on the first run. Each one is published
+// in the same write that removes the draft, so none is published twice, whatever restarts in between
+func runDraftPublisher(ctx context.Context, db database.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		published, failed, err := db.PublishDueDrafts(time.Now())
+		if err != nil {
+			log.Printf("Error publishing scheduled chirps: %s", err)
+		}
+		if published > 0 {
+			log.Printf("Published %d scheduled chirps", published)
+		}
+		if failed > 0 {
+			log.Printf("Unscheduled %d chirps that could no longer be published", failed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}